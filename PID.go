@@ -1,5 +1,29 @@
 package main
 
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// AntiWindup is how a PID keeps its integral from growing while the output is saturated
+type AntiWindup string
+
+const (
+	AntiWindupNone            AntiWindup = "none"             // Integrate regardless of saturation
+	AntiWindupClamp           AntiWindup = "clamp"            // Conditional integration: stop integrating when it would deepen saturation
+	AntiWindupBackCalculation AntiWindup = "back-calculation" // Bleed the integral by the saturation excess
+)
+
+// ReplanMode is how a PID reacts when the controller switches to a new trajectory
+type ReplanMode string
+
+const (
+	ReplanKeep     ReplanMode = "keep"     // Keep the integral and derivative state
+	ReplanReset    ReplanMode = "reset"    // Clear the integral and derivative state
+	ReplanBumpless ReplanMode = "bumpless" // Re-seed the integral so the output does not jump
+)
+
 type PID struct {
 	// The proportional gain
 	Kp float64
@@ -7,60 +31,213 @@ type PID struct {
 	Ki float64
 	// The derivative gain
 	Kd float64
-	// The previous error
+	// The previous weighted derivative error (c*setpoint - input)
 	PreviousError float64
 	// The integral of the error
 	Integral float64
+	// The filtered derivative of the weighted derivative error
+	Derivative float64
 	// The setpoint
 	Setpoint float64
 	// The output
 	Output float64
-	// The sample time
+	// The nominal sample time, used until the first measured interval
 	SampleTime float64
 	// The maximum output (minimum is -MaxOutput)
 	MaxOutput float64
+
+	// Anti-windup method and the back-calculation tracking time constant in seconds
+	AntiWindup   AntiWindup
+	TrackingTime float64
+	// Time constant of the derivative's first-order filter in seconds, zero disables
+	DerivativeFilter float64
+	// Setpoint weights of the proportional (b) and derivative (c) terms
+	ProportionalWeight float64
+	DerivativeWeight   float64
+	// Reaction to a new trajectory
+	OnReplan ReplanMode
+
+	lastUpdate  time.Time // Time of the previous update, zero before the first
+	bumpless    bool      // Re-seed the integral on the next update
+	initialized bool      // PreviousError holds a real sample
+}
+
+// PIDParameters configures one PID loop
+type PIDParameters struct {
+	Kp                 float64    `json:"kp"`
+	Ki                 float64    `json:"ki"`
+	Kd                 float64    `json:"kd"`
+	MaxOutput          float64    `json:"maxOutput,omitempty"`          // Output limit, defaults to the loop's default limit
+	AntiWindup         AntiWindup `json:"antiWindup,omitempty"`         // "none", "clamp" or "back-calculation" (default)
+	TrackingTime       float64    `json:"trackingTime,omitempty"`       // Back-calculation time constant in seconds, defaults from the gains
+	DerivativeFilter   float64    `json:"derivativeFilter,omitempty"`   // Derivative filter time constant in seconds
+	ProportionalWeight *float64   `json:"proportionalWeight,omitempty"` // Setpoint weight b of the proportional term, defaults to 1
+	DerivativeWeight   float64    `json:"derivativeWeight,omitempty"`   // Setpoint weight c of the derivative term, 0 differentiates the measurement only
+	OnReplan           ReplanMode `json:"onReplan,omitempty"`           // "keep", "reset" or "bumpless" (default)
+}
+
+// validate checks the parameters
+func (p PIDParameters) validate() error {
+	if p.Kp < 0 || p.Ki < 0 || p.Kd < 0 || p.MaxOutput < 0 || p.TrackingTime < 0 || p.DerivativeFilter < 0 {
+		return fmt.Errorf("PID gains, limits and time constants must not be negative")
+	}
+	switch p.AntiWindup {
+	case "", AntiWindupNone, AntiWindupClamp, AntiWindupBackCalculation:
+	default:
+		return fmt.Errorf("unknown anti-windup method %q", p.AntiWindup)
+	}
+	switch p.OnReplan {
+	case "", ReplanKeep, ReplanReset, ReplanBumpless:
+	default:
+		return fmt.Errorf("unknown replan mode %q", p.OnReplan)
+	}
+	return nil
+}
+
+// clone returns a copy that shares no setpoint weight with p
+func (p PIDParameters) clone() *PIDParameters {
+	if p.ProportionalWeight != nil {
+		weight := *p.ProportionalWeight
+		p.ProportionalWeight = &weight
+	}
+	return &p
+}
+
+// newPID creates a PID loop from parameters, with maxOutput as the limit when none is set
+func (p PIDParameters) newPID(sampleTime, maxOutput float64) *PID {
+	pid := NewPID(p.Kp, p.Ki, p.Kd, sampleTime, maxOutput)
+	if p.MaxOutput > 0 {
+		pid.MaxOutput = p.MaxOutput
+	}
+	if p.AntiWindup != "" {
+		pid.AntiWindup = p.AntiWindup
+	}
+	pid.TrackingTime = p.TrackingTime
+	pid.DerivativeFilter = p.DerivativeFilter
+	if p.ProportionalWeight != nil {
+		pid.ProportionalWeight = *p.ProportionalWeight
+	}
+	pid.DerivativeWeight = p.DerivativeWeight
+	if p.OnReplan != "" {
+		pid.OnReplan = p.OnReplan
+	}
+	return pid
 }
 
-// NewPID creates a new PID controller
+// NewPID creates a new PID controller with back-calculation anti-windup,
+// derivative on measurement and bumpless replanning
 func NewPID(kp, ki, kd, sampleTime, maxOutput float64) *PID {
 	return &PID{
-		Kp:         kp,
-		Ki:         ki,
-		Kd:         kd,
-		SampleTime: sampleTime,
-		MaxOutput:  maxOutput,
+		Kp:                 kp,
+		Ki:                 ki,
+		Kd:                 kd,
+		SampleTime:         sampleTime,
+		MaxOutput:          maxOutput,
+		AntiWindup:         AntiWindupBackCalculation,
+		ProportionalWeight: 1,
+		OnReplan:           ReplanBumpless,
 	}
 }
 
-// Update updates the PID controller
-func (pid *PID) Update(input float64) float64 {
+// Update updates the PID controller with the input measured at time now
+func (pid *PID) Update(now time.Time, input float64) float64 {
+	// Use the real interval since the last update, the nominal one before that
+	dt := pid.SampleTime
+	if !pid.lastUpdate.IsZero() {
+		if measured := now.Sub(pid.lastUpdate).Seconds(); measured > 0 {
+			dt = measured
+		}
+	}
+	pid.lastUpdate = now
+
 	// Calculate the error
 	err := pid.Setpoint - input
 
-	// Calculate the integral of the error
-	pid.Integral += err * pid.SampleTime
-
-	// Calculate the derivative of the error
-	derivative := (err - pid.PreviousError) / pid.SampleTime
+	// Proportional term on the weighted setpoint
+	proportional := pid.Kp * (pid.ProportionalWeight*pid.Setpoint - input)
 
-	// Calculate the output
-	pid.Output = pid.Kp*err + pid.Ki*pid.Integral + pid.Kd*derivative
+	// Derivative on the weighted setpoint, so setpoint jumps do not kick the output, low-pass filtered
+	derivativeError := pid.DerivativeWeight*pid.Setpoint - input
+	if pid.initialized {
+		raw := (derivativeError - pid.PreviousError) / dt
+		alpha := 1.0
+		if pid.DerivativeFilter > 0 {
+			alpha = dt / (pid.DerivativeFilter + dt)
+		}
+		pid.Derivative += alpha * (raw - pid.Derivative)
+	}
+	pid.PreviousError = derivativeError
+	pid.initialized = true
+	derivative := pid.Kd * pid.Derivative
 
-	// Clamp the output to the maximum and minimum values
-	if pid.Output > pid.MaxOutput {
-		pid.Output = pid.MaxOutput
-	} else if pid.Output < -pid.MaxOutput {
-		pid.Output = -pid.MaxOutput
+	// Pick up where the previous trajectory's output left off
+	if pid.bumpless {
+		pid.bumpless = false
+		if pid.Ki != 0 {
+			pid.Integral = (pid.Output - proportional - derivative) / pid.Ki
+		}
 	}
 
-	// Update the previous error
-	pid.PreviousError = err
+	// Calculate the integral of the error
+	previousIntegral := pid.Integral
+	pid.Integral += err * dt
+
+	// Calculate the output and clamp it to the maximum and minimum values
+	unsaturated := proportional + pid.Ki*pid.Integral + derivative
+	pid.Output = clamp(unsaturated, pid.MaxOutput)
+
+	// Keep the integral from winding up while saturated
+	if pid.Ki != 0 && pid.Output != unsaturated {
+		switch pid.AntiWindup {
+		case AntiWindupClamp:
+			// Only integrate when it pulls the output back out of saturation
+			if err*unsaturated > 0 {
+				pid.Integral = previousIntegral
+			}
+		case AntiWindupBackCalculation:
+			pid.Integral += (pid.Output - unsaturated) / (pid.Ki * pid.trackingTime()) * dt
+		}
+	}
 
 	return pid.Output
 }
 
+// trackingTime is the back-calculation time constant, by default the
+// geometric mean of the integral and derivative times
+func (pid *PID) trackingTime() float64 {
+	if pid.TrackingTime > 0 {
+		return pid.TrackingTime
+	}
+	if pid.Kp == 0 {
+		return pid.SampleTime
+	}
+	ti := pid.Kp / pid.Ki
+	if pid.Kd > 0 {
+		return math.Sqrt(ti * pid.Kd / pid.Kp)
+	}
+	return ti
+}
+
 // SetSetpoint sets the setpoint of the PID controller
 func (pid *PID) SetSetpoint(setpoint float64) {
 	pid.Setpoint = setpoint
-	// pid.PreviousError = 0
+}
+
+// Reset clears the integral and derivative state
+func (pid *PID) Reset() {
+	pid.Integral = 0
+	pid.Derivative = 0
+	pid.Output = 0
+	pid.initialized = false
+	pid.bumpless = false
+}
+
+// Replanned applies the loop's replan mode when the controller switches trajectory
+func (pid *PID) Replanned() {
+	switch pid.OnReplan {
+	case ReplanReset:
+		pid.Reset()
+	case ReplanBumpless:
+		pid.bumpless = true
+	}
 }
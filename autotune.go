@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"time"
+)
+
+// PlantModel is what a step-response experiment identified about a cart, as
+// seen by its controller through the drive and the sensor
+type PlantModel struct {
+	Mass            float64  `json:"mass"`            // Effective mass
+	CoulombFriction float64  `json:"coulombFriction"` // Force needed before the cart accelerates at all
+	DeadTime        Duration `json:"deadTime"`        // Lag from force command to measured motion, drive and sensor together
+}
+
+// TrackingMetrics is how well one cart followed its trajectories in a scenario
+type TrackingMetrics struct {
+	Status           string  `json:"status"` // "completed" or "failed"
+	Error            string  `json:"error,omitempty"`
+	TrackingErrorRMS float64 `json:"trackingErrorRms"`
+	MaxTrackingError float64 `json:"maxTrackingError"`
+	ControlEffort    float64 `json:"controlEffort"`
+}
+
+// worseThan reports whether this tracking fails where the other completes, or
+// has a larger rms or maximum error with the same status
+func (m TrackingMetrics) worseThan(other TrackingMetrics) bool {
+	if m.Status != other.Status {
+		return m.Status == "failed"
+	}
+	return m.TrackingErrorRMS > other.TrackingErrorRMS || m.MaxTrackingError > other.MaxTrackingError
+}
+
+// TuningResult is the outcome of auto-tuning one cart
+type TuningResult struct {
+	CartId     int                  `json:"cartId"`
+	Plant      PlantModel           `json:"plant"`
+	ControlLaw ControlLawParameters `json:"controlLaw"` // Proposed gains for both cascade loops
+	Scenario   string               `json:"scenario"`   // Scenario the gains were evaluated on, with the cart in cart 1's place
+	Before     TrackingMetrics      `json:"before"`
+	After      TrackingMetrics      `json:"after"`
+	Worse      bool                 `json:"worse"` // The proposed gains track worse than the current ones, they are never applied
+	Applied    bool                 `json:"applied"`
+}
+
+// AutotuneOptions describes the cart to tune and how to judge the result
+type AutotuneOptions struct {
+	Cart              int // 1-based cart number, the plant is identified for it
+	Mass              float64
+	Drive             DriveParameters
+	Sensor            SensorParameters
+	Current           ControlLawParameters // Control law the "before" metrics are taken with
+	Speed             float64              // Desired closed-loop time constant in multiples of the dead time
+	Scenario          string
+	ScenarioDirectory string
+	Seed              uint64
+}
+
+const (
+	defaultAutotuneScenario = "Preprost premik"
+	defaultAutotuneSpeed    = 1.0 // The SIMC recommendation, closed-loop time constant equal to the delay
+	minIntegralIntervals    = 10  // Shortest velocity integral time in control intervals, the loop is sampled too slowly for less
+	stepExperimentDuration  = 1.0 // Seconds of each step experiment
+)
+
+// autotune identifies the cart's plant, proposes gains for both loops of the
+// cascaded PID and compares tracking before and after on a scenario
+func autotune(options AutotuneOptions) (TuningResult, error) {
+	result := TuningResult{CartId: options.Cart, Scenario: options.Scenario}
+	if options.Scenario != "" {
+		if err := checkAutotuneScenario(options); err != nil {
+			return result, err
+		}
+	}
+
+	plant, err := identifyPlant(options.Mass, options.Drive, options.Sensor, options.Seed)
+	if err != nil {
+		return result, err
+	}
+	result.Plant = plant
+	result.ControlLaw = tuneCascade(plant, options.Speed)
+
+	if options.Scenario != "" {
+		result.Before = evaluateTracking(options, options.Current)
+		result.After = evaluateTracking(options, result.ControlLaw)
+		result.Worse = result.After.worseThan(result.Before)
+	}
+	return result, nil
+}
+
+// =====================================================
+// PLANT IDENTIFICATION
+// =====================================================
+
+// identifyPlant applies two force steps to a simulated copy of the cart from
+// rest. The measured positions give the accelerations, and from the two the
+// mass and the Coulomb friction; viscous friction is lumped into these, the
+// experiments are too short for it to matter. The measured velocity's lag
+// behind the fitted ramp is the dead time the velocity loop has to live with.
+func identifyPlant(mass float64, drive DriveParameters, sensor SensorParameters, seed uint64) (PlantModel, error) {
+	limit := float64(defaultMaxForce)
+	if drive.MaxForce > 0 {
+		limit = min(limit, drive.MaxForce)
+	}
+	forces := [2]float64{0.4 * limit, 0.8 * limit}
+
+	var accelerations, deadTimes [2]float64
+	for i, force := range forces {
+		samples := stepResponse(mass, drive, sensor, seed, force)
+		acceleration, deadTime, err := fitStep(samples)
+		if err != nil {
+			return PlantModel{}, fmt.Errorf("step of %.1f N: %w", force, err)
+		}
+		accelerations[i] = acceleration
+		deadTimes[i] = deadTime
+	}
+	if accelerations[1] <= accelerations[0] {
+		return PlantModel{}, fmt.Errorf("a larger force did not accelerate the cart faster")
+	}
+
+	plantMass := (forces[1] - forces[0]) / (accelerations[1] - accelerations[0])
+	return PlantModel{
+		Mass:            plantMass,
+		CoulombFriction: max(0, forces[0]-plantMass*accelerations[0]),
+		DeadTime:        Duration(max(0, (deadTimes[0]+deadTimes[1])/2) * float64(time.Second)),
+	}, nil
+}
+
+// stepSample is what the controller would read at one control tick of a step experiment
+type stepSample struct {
+	time     float64 // Seconds since the step
+	position float64 // Measured displacement
+	velocity float64 // Measured velocity
+}
+
+// stepResponse simulates a cart from rest under a constant force command and
+// returns what its controller would read at every control tick
+func stepResponse(mass float64, drive DriveParameters, sensor SensorParameters, seed uint64, force float64) []stepSample {
+	config := defaultPhysicsConfig()
+	integrator, _ := getIntegrator(config.Integrator)
+	h := config.Timestep.Seconds()
+	start := time.Unix(0, 0)
+
+	carts := []Cart{{Name: "Autotune", Mass: mass, Force: force, Drive: NewActuatorDrive(drive)}}
+	cart := &carts[0]
+	if sensor != (SensorParameters{}) {
+		cart.Sensor = NewEncoderSensor(sensor, start, PhysicsState{}, seed)
+	}
+
+	var samples []stepSample
+	ticks := int(controlInterval / config.Timestep)
+	steps := int(stepExperimentDuration / h)
+	for step := 1; step <= steps; step++ {
+		integrateCarts(carts, integrator, float64(step-1)*h, h)
+		now := start.Add(time.Duration(step) * config.Timestep)
+		if cart.Sensor != nil {
+			cart.Sensor.Sample(now, PhysicsState{Position: cart.Position, Velocity: cart.Velocity})
+		}
+		if step%ticks == 0 {
+			sample := stepSample{time: float64(step) * h, position: cart.Position, velocity: cart.Velocity}
+			if cart.Sensor != nil {
+				measurement := cart.Sensor.Read(now)
+				sample.position, sample.velocity = measurement.Position, measurement.Velocity
+			}
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// fitStep fits the measured positions with p = a/2 (t - L)^2, by least squares
+// on the square root of the position, then averages how far the measured
+// velocity lags behind a*t over the middle of the ramp
+func fitStep(samples []stepSample) (acceleration, deadTime float64, err error) {
+	final := samples[len(samples)-1]
+	if final.position <= 0 {
+		return 0, 0, fmt.Errorf("the cart did not move")
+	}
+
+	var n, sumT, sumR, sumTT, sumTR float64
+	for _, sample := range samples {
+		if sample.position < 0.1*final.position {
+			continue
+		}
+		root := math.Sqrt(sample.position)
+		n++
+		sumT += sample.time
+		sumR += root
+		sumTT += sample.time * sample.time
+		sumTR += sample.time * root
+	}
+	denominator := n*sumTT - sumT*sumT
+	if n < 3 || denominator == 0 {
+		return 0, 0, fmt.Errorf("too few samples of the motion")
+	}
+	slope := (n*sumTR - sumT*sumR) / denominator
+	if slope <= 0 {
+		return 0, 0, fmt.Errorf("the cart did not accelerate")
+	}
+	acceleration = 2 * slope * slope
+
+	lags := 0
+	for _, sample := range samples {
+		if sample.velocity < 0.2*final.velocity || sample.velocity > 0.8*final.velocity {
+			continue
+		}
+		deadTime += sample.time - sample.velocity/acceleration
+		lags++
+	}
+	if lags == 0 {
+		return 0, 0, fmt.Errorf("too few samples of the velocity ramp")
+	}
+	return acceleration, deadTime / float64(lags), nil
+}
+
+// =====================================================
+// GAIN DESIGN
+// =====================================================
+
+// tuneCascade designs both loops with the SIMC rules for an integrating plant
+// with dead time. The velocity loop sees the mass plus the dead time and half
+// a control interval for the held output; the position loop sees the closed
+// velocity loop as a further delay. speed sets each loop's closed-loop time
+// constant in multiples of its delay, larger is slower and more robust. The
+// integral time is kept to several control intervals, however short the delay.
+func tuneCascade(plant PlantModel, speed float64) ControlLawParameters {
+	if speed <= 0 {
+		speed = defaultAutotuneSpeed
+	}
+	delay := time.Duration(plant.DeadTime).Seconds() + controlInterval.Seconds()/2
+
+	velocityTime := speed*delay + delay
+	velocityKp := plant.Mass / velocityTime
+	integralTime := max(4*velocityTime, minIntegralIntervals*controlInterval.Seconds())
+	velocityKi := velocityKp / integralTime
+
+	positionDelay := velocityTime
+	positionKp := 1 / (speed*positionDelay + positionDelay)
+
+	return ControlLawParameters{
+		Type:         "pid",
+		PositionLoop: &PIDParameters{Kp: roundGain(positionKp)},
+		VelocityLoop: &PIDParameters{Kp: roundGain(velocityKp), Ki: roundGain(velocityKi)},
+	}
+}
+
+// roundGain keeps three significant digits, tuned gains are not that precise
+func roundGain(gain float64) float64 {
+	if gain == 0 {
+		return 0
+	}
+	scale := math.Pow(10, 2-math.Floor(math.Log10(math.Abs(gain))))
+	return math.Round(gain*scale) / scale
+}
+
+// =====================================================
+// EVALUATION
+// =====================================================
+
+// evaluateTracking runs the scenario on a fresh simulated clock with every
+// controller using the control law. The tuned cart takes cart 1's place, so
+// that any scenario can judge any cart, and its tracking is returned.
+func evaluateTracking(options AutotuneOptions, controlLaw ControlLawParameters) TrackingMetrics {
+	clock := NewSimulatedClock()
+	carts := defaultCarts()
+	carts[0].Mass = options.Mass
+	randomControlChannel := make(chan ControlMessage, 10)
+	scenarioManager := NewScenarioManager(nil, nil, nil, carts, randomControlChannel, nil, clock)
+	scenarioManager.seed = options.Seed
+	scenarioManager.drive = options.Drive
+	scenarioManager.sensor = options.Sensor
+	scenarioManager.controlLaw = controlLaw
+	scenarioManager.logOutput = io.Discard
+	if err := scenarioManager.LoadScenarioDirectory(options.ScenarioDirectory); err != nil && !os.IsNotExist(err) {
+		return TrackingMetrics{Status: "failed", Error: err.Error()}
+	}
+
+	go physics_loop(scenarioManager, defaultPhysicsConfig())
+	go clock.RunFast()
+	defer clock.Stop()
+
+	// Everything the run started stops with it, the server tunes many times
+	defer func() {
+		close(scenarioManager.physicsExitChannel)
+		close(randomControlChannel) // Ends the goal manager
+		scenarioManager.stopAllControllers()
+	}()
+
+	metrics := TrackingMetrics{Status: "completed"}
+	if err := scenarioManager.RunScenario(options.Scenario); err != nil {
+		metrics.Status = "failed"
+		metrics.Error = err.Error()
+	}
+	report := scenarioManager.controllers[0].Metrics.GetDetailedMetrics()
+	metrics.TrackingErrorRMS = report.TrackingErrorRMS
+	metrics.MaxTrackingError = report.MaxTrackingError
+	metrics.ControlEffort = report.ControlEffort
+	return metrics
+}
+
+// checkAutotuneScenario returns an error if the scenario to evaluate on does not exist
+func checkAutotuneScenario(options AutotuneOptions) error {
+	scenarioManager := NewScenarioManager(nil, nil, nil, defaultCarts(), make(chan ControlMessage, 10), nil, NewSimulatedClock())
+	if err := scenarioManager.LoadScenarioDirectory(options.ScenarioDirectory); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, exists := scenarioManager.definitions[options.Scenario]; !exists {
+		return fmt.Errorf("unknown scenario: %s", options.Scenario)
+	}
+	return nil
+}
+
+// =====================================================
+// ENTRY POINTS
+// =====================================================
+
+// AutotuneCart tunes one of the running carts on a simulated copy of its plant
+// and, if apply is set, switches its controller to the tuned gains unless they
+// track worse than the current ones
+func (sm *ScenarioManager) AutotuneCart(cart int, apply bool) (TuningResult, error) {
+	sm.mu.RLock()
+	controllers := sm.controllers
+	sm.mu.RUnlock()
+	if cart < 1 || cart > len(controllers) {
+		return TuningResult{}, fmt.Errorf("cart %d does not exist", cart)
+	}
+	controller := controllers[cart-1]
+
+	options := AutotuneOptions{
+		Cart:              cart,
+		Mass:              controller.Cart.Mass,
+		Current:           controller.Parameters().ControlLaw,
+		Speed:             defaultAutotuneSpeed,
+		Scenario:          defaultAutotuneScenario,
+		ScenarioDirectory: defaultScenarioDirectory,
+		Seed:              sm.seed,
+	}
+	if drive, ok := controller.Cart.Drive.(*ActuatorDrive); ok {
+		options.Drive = drive.params
+	}
+	if sensor, ok := controller.Cart.Sensor.(*EncoderSensor); ok {
+		options.Sensor = sensor.params
+	}
+
+	log.Printf("[AUTOTUNE] Tuning %s on a simulated copy of its plant", controller.Cart.Name)
+	result, err := autotune(options)
+	if err != nil {
+		return result, err
+	}
+	log.Printf("[AUTOTUNE] %s: mass %.3f, friction %.2f N, dead time %v; position Kp %g, velocity Kp %g Ki %g",
+		controller.Cart.Name, result.Plant.Mass, result.Plant.CoulombFriction, time.Duration(result.Plant.DeadTime),
+		result.ControlLaw.PositionLoop.Kp, result.ControlLaw.VelocityLoop.Kp, result.ControlLaw.VelocityLoop.Ki)
+
+	if apply && result.Worse {
+		log.Printf("[AUTOTUNE] %s: not applying the tuned gains, they track worse than the current ones", controller.Cart.Name)
+	} else if apply {
+		if err := controller.SetControlLaw(result.ControlLaw); err != nil {
+			return result, err
+		}
+		result.Applied = true
+		sm.notifyParameterChange(cart, controller.Parameters())
+	}
+	return result, nil
+}
+
+// runAutotune is the autotune subcommand: it tunes one cart and prints the
+// proposed gains with tracking before and after
+func runAutotune(args []string) int {
+	flags := flag.NewFlagSet("autotune", flag.ContinueOnError)
+	cart := flags.Int("cart", 1, "cart to tune and report metrics for")
+	mass := flags.Float64("mass", 0, "cart mass (default: the cart's mass)")
+	drivePreset := flags.String("drive", "ideal", "drive model of the cart: ideal or realistic")
+	sensorPreset := flags.String("sensor", "ideal", "sensor model of the cart: ideal or encoder")
+	controlPreset := flags.String("control", "pid", "control law to compare against: a preset or a control law JSON file")
+	speed := flags.Float64("speed", defaultAutotuneSpeed, "closed-loop time constant in multiples of the dead time, larger is more robust")
+	scenario := flags.String("scenario", defaultAutotuneScenario, "scenario to compare tracking on with the cart in cart 1's place, empty skips the comparison")
+	scenarioDirectory := flags.String("scenarios", defaultScenarioDirectory, "directory with additional scenario files")
+	seed := flags.Uint64("seed", 1, "seed for the network and sensor simulation")
+	savePath := flags.String("save", "", "write the tuned control law as JSON to this file, for use with -control")
+	verbose := flags.Bool("verbose", false, "print scenario and controller logs")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gocart autotune [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	carts := defaultCarts()
+	if *cart < 1 || *cart > len(carts) {
+		fmt.Fprintf(os.Stderr, "cart %d does not exist\n", *cart)
+		return 2
+	}
+	if *mass == 0 {
+		*mass = carts[*cart-1].Mass
+	}
+	drive, err := getDrivePreset(*drivePreset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	sensor, err := getSensorPreset(*sensorPreset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	current, err := loadControlLaw(*controlPreset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	result, err := autotune(AutotuneOptions{
+		Cart:              *cart,
+		Mass:              *mass,
+		Drive:             drive,
+		Sensor:            sensor,
+		Current:           current,
+		Speed:             *speed,
+		Scenario:          *scenario,
+		ScenarioDirectory: *scenarioDirectory,
+		Seed:              *seed,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "autotune failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Identified plant: mass %.3f, Coulomb friction %.2f N, dead time %v\n",
+		result.Plant.Mass, result.Plant.CoulombFriction, time.Duration(result.Plant.DeadTime).Round(100*time.Microsecond))
+	fmt.Printf("Position loop: Kp %g\n", result.ControlLaw.PositionLoop.Kp)
+	fmt.Printf("Velocity loop: Kp %g, Ki %g\n", result.ControlLaw.VelocityLoop.Kp, result.ControlLaw.VelocityLoop.Ki)
+	if *scenario != "" {
+		fmt.Printf("\nTracking of cart %d in %q, in cart 1's place\n", *cart, *scenario)
+		fmt.Printf("%-8s %-10s %12s %12s %14s\n", "", "status", "rms error", "max error", "control effort")
+		for _, row := range []struct {
+			name    string
+			metrics TrackingMetrics
+		}{{"before", result.Before}, {"after", result.After}} {
+			fmt.Printf("%-8s %-10s %12.4f %12.4f %14.0f", row.name, row.metrics.Status, row.metrics.TrackingErrorRMS, row.metrics.MaxTrackingError, row.metrics.ControlEffort)
+			if row.metrics.Error != "" {
+				fmt.Printf("  (%s)", row.metrics.Error)
+			}
+			fmt.Println()
+		}
+		if result.Worse {
+			fmt.Println("\nThe tuned gains track worse than the current ones, keep the current control law")
+		}
+	}
+
+	if *savePath != "" {
+		data, err := json.MarshalIndent(result.ControlLaw, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*savePath, data, 0o644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error writing control law: %v\n", err)
+			return 2
+		}
+	}
+	return 0
+}
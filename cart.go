@@ -16,6 +16,12 @@ type Cart struct {
 	// The cart's force
 	Force float64
 
+	// The cart's drive, turning the commanded Force into motion (nil is an ideal drive)
+	Drive DriveModel
+
+	// The cart's position sensor, what its controller measures (nil is a perfect sensor)
+	Sensor SensorModel
+
 	// The cart's height
 	Height float64
 	// The cart's width
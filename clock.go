@@ -0,0 +1,325 @@
+package main
+
+import (
+	"container/heap"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the whole simulation. Physics, controllers,
+// trajectories, the network simulator and scenarios all read time through it,
+// so the same code can run against the wall clock or a simulated clock.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// Since returns the time elapsed since t
+	Since(t time.Time) time.Duration
+	// Sleep blocks the calling goroutine for the duration d
+	Sleep(d time.Duration)
+	// After returns a channel that receives the current time once d has elapsed
+	After(d time.Duration) <-chan time.Time
+	// NewTicker returns a ticker that fires every d
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Ticker delivers ticks at regular intervals, mirroring time.Ticker
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// Stop turns off the ticker. No more ticks will be sent after Stop returns.
+func (t *Ticker) Stop() {
+	t.stop()
+}
+
+// =====================================================
+// REAL CLOCK
+// =====================================================
+
+// RealClock is a Clock backed by the wall clock
+type RealClock struct{}
+
+// NewRealClock creates a clock that reads the wall clock
+func NewRealClock() *RealClock {
+	return &RealClock{}
+}
+
+func (RealClock) Now() time.Time                         { return time.Now() }
+func (RealClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (RealClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (RealClock) NewTicker(d time.Duration) *Ticker {
+	ticker := time.NewTicker(d)
+	return &Ticker{C: ticker.C, stop: ticker.Stop}
+}
+
+// =====================================================
+// SIMULATED CLOCK
+// =====================================================
+
+// simulatedEpoch is the fixed start time of every simulated clock, so runs
+// produce identical timestamps and request IDs
+var simulatedEpoch = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// simTimer is a pending one-shot or periodic event on a simulated clock
+type simTimer struct {
+	deadline time.Time
+	seq      uint64        // Registration order, used to break ties between equal deadlines
+	period   time.Duration // Zero for one-shot timers
+	ch       chan time.Time
+	stopped  chan struct{}
+	index    int
+}
+
+// simTimerQueue is a min-heap of timers ordered by deadline, then registration order
+type simTimerQueue []*simTimer
+
+func (q simTimerQueue) Len() int { return len(q) }
+func (q simTimerQueue) Less(i, j int) bool {
+	if q[i].deadline.Equal(q[j].deadline) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].deadline.Before(q[j].deadline)
+}
+func (q simTimerQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *simTimerQueue) Push(x any) {
+	timer := x.(*simTimer)
+	timer.index = len(*q)
+	*q = append(*q, timer)
+}
+func (q *simTimerQueue) Pop() any {
+	old := *q
+	n := len(old)
+	timer := old[n-1]
+	old[n-1] = nil
+	timer.index = -1
+	*q = old[:n-1]
+	return timer
+}
+
+// SimulatedClock is a virtual clock that only moves when it is advanced, either
+// manually with Advance or as fast as possible with RunFast. Timers fire in a
+// fixed order (deadline, then registration order) and ticks are handed over
+// synchronously, so a simulation driven by it is repeatable and is not bound
+// to wall-clock speed.
+type SimulatedClock struct {
+	mu       sync.Mutex
+	now      time.Time
+	timers   simTimerQueue
+	seq      uint64
+	activity uint64        // Incremented on every clock call, used to detect when goroutines have settled
+	wake     chan struct{} // Signalled when a timer is registered
+	stop     chan struct{}
+	running  bool
+}
+
+// NewSimulatedClock creates a simulated clock starting at a fixed epoch
+func NewSimulatedClock() *SimulatedClock {
+	return &SimulatedClock{
+		now:  simulatedEpoch,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (c *SimulatedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activity++
+	return c.now
+}
+
+func (c *SimulatedClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *SimulatedClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *SimulatedClock) After(d time.Duration) <-chan time.Time {
+	// One-shot channels are buffered so an abandoned select never blocks the clock
+	ch := make(chan time.Time, 1)
+	c.addTimer(d, 0, ch)
+	return ch
+}
+
+func (c *SimulatedClock) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for SimulatedClock.NewTicker")
+	}
+	// Ticker channels are unbuffered so each tick is handed over to the receiver
+	ch := make(chan time.Time)
+	timer := c.addTimer(d, d, ch)
+	return &Ticker{C: ch, stop: func() { c.removeTimer(timer) }}
+}
+
+func (c *SimulatedClock) addTimer(d, period time.Duration, ch chan time.Time) *simTimer {
+	c.mu.Lock()
+	if d < 0 {
+		d = 0
+	}
+	c.seq++
+	c.activity++
+	timer := &simTimer{
+		deadline: c.now.Add(d),
+		seq:      c.seq,
+		period:   period,
+		ch:       ch,
+		stopped:  make(chan struct{}),
+	}
+	heap.Push(&c.timers, timer)
+	c.mu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return timer
+}
+
+func (c *SimulatedClock) removeTimer(timer *simTimer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.activity++
+	select {
+	case <-timer.stopped:
+		return // Already stopped
+	default:
+		close(timer.stopped)
+	}
+	if timer.index >= 0 && timer.index < len(c.timers) && c.timers[timer.index] == timer {
+		heap.Remove(&c.timers, timer.index)
+	}
+}
+
+// Advance moves the clock forward by d, firing every timer that falls due on
+// the way in order
+func (c *SimulatedClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+
+	c.settle()
+	for c.fireNext(target) {
+		c.settle()
+	}
+
+	c.mu.Lock()
+	if c.now.Before(target) {
+		c.now = target
+	}
+	c.mu.Unlock()
+}
+
+// RunFast advances the clock from timer to timer as fast as possible until
+// Stop is called. When no timers are pending it waits for one to be registered.
+func (c *SimulatedClock) RunFast() {
+	c.mu.Lock()
+	if c.running {
+		c.mu.Unlock()
+		return
+	}
+	c.running = true
+	c.stop = make(chan struct{})
+	stop := c.stop
+	c.mu.Unlock()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		c.settle()
+		if c.fireNext(time.Time{}) {
+			continue
+		}
+
+		// Nothing scheduled, wait until some goroutine registers a timer
+		select {
+		case <-stop:
+			return
+		case <-c.wake:
+		}
+	}
+}
+
+// Stop ends a RunFast loop
+func (c *SimulatedClock) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running {
+		close(c.stop)
+		c.running = false
+	}
+}
+
+// fireNext fires the earliest pending timer if it is due no later than limit
+// (a zero limit means no limit). It reports whether a timer was fired.
+func (c *SimulatedClock) fireNext(limit time.Time) bool {
+	c.mu.Lock()
+	if len(c.timers) == 0 || (!limit.IsZero() && c.timers[0].deadline.After(limit)) {
+		c.mu.Unlock()
+		return false
+	}
+
+	timer := heap.Pop(&c.timers).(*simTimer)
+	if timer.deadline.After(c.now) {
+		c.now = timer.deadline
+	}
+	now := c.now
+	if timer.period > 0 {
+		// Re-arm periodic timers before handing over the tick, keeping their sequence number
+		timer.deadline = timer.deadline.Add(timer.period)
+		heap.Push(&c.timers, timer)
+	}
+	c.mu.Unlock()
+
+	if timer.period > 0 {
+		// Hand the tick over synchronously unless the ticker is stopped meanwhile
+		select {
+		case timer.ch <- now:
+		case <-timer.stopped:
+		}
+	} else {
+		select {
+		case timer.ch <- now:
+		default:
+		}
+	}
+	return true
+}
+
+// settle yields to the other goroutines until they stop interacting with the
+// clock, so every reaction to the previous event is scheduled before time moves on
+func (c *SimulatedClock) settle() {
+	const quietRounds = 3
+	quiet := 0
+	for quiet < quietRounds {
+		c.mu.Lock()
+		before := c.activity
+		c.mu.Unlock()
+
+		for i := 0; i < 10; i++ {
+			runtime.Gosched()
+		}
+
+		c.mu.Lock()
+		after := c.activity
+		c.mu.Unlock()
+
+		if after == before {
+			quiet++
+		} else {
+			quiet = 0
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// CollisionPolicy decides what the physics loop does when two carts touch
+type CollisionPolicy string
+
+const (
+	// CollisionHalt freezes the simulation until the next scenario resets the carts
+	CollisionHalt CollisionPolicy = "halt"
+	// CollisionImpulse lets the carts bounce off each other according to their mass and the restitution
+	CollisionImpulse CollisionPolicy = "impulse"
+	// CollisionPush keeps the carts in contact so the faster one pushes the other along
+	CollisionPush CollisionPolicy = "push"
+)
+
+// defaultRestitution is the coefficient of restitution used by the impulse model
+const defaultRestitution = 0.5
+
+// contactSlop is the gap below which carts that were touching are still considered in contact
+const contactSlop = 0.5
+
+// maxCollisionEvents bounds how many collisions are kept per scenario
+const maxCollisionEvents = 100
+
+// ParseCollisionPolicy converts a policy name to a CollisionPolicy
+func ParseCollisionPolicy(name string) (CollisionPolicy, error) {
+	switch policy := CollisionPolicy(name); policy {
+	case CollisionHalt, CollisionImpulse, CollisionPush:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown collision policy %q (expected halt, impulse or push)", name)
+	}
+}
+
+// ControllerSnapshot is the state of a controller at a point in time
+type ControllerSnapshot struct {
+	CartId       int     `json:"cartId"`
+	State        string  `json:"state"`
+	Position     float64 `json:"position"`
+	Velocity     float64 `json:"velocity"`
+	Setpoint     float64 `json:"setpoint"`
+	Goal         float64 `json:"goal"`
+	LeftBorder   float64 `json:"leftBorder"`
+	RightBorder  float64 `json:"rightBorder"`
+	StopPosition float64 `json:"stopPosition"` // Where the planned motion comes to rest when braking now
+}
+
+// CollisionEvent records two carts coming into contact
+type CollisionEvent struct {
+	Time          time.Time            `json:"time"`
+	CartA         int                  `json:"cartA"`         // Id of the left cart
+	CartB         int                  `json:"cartB"`         // Id of the right cart
+	Position      float64              `json:"position"`      // Contact point
+	RelativeSpeed float64              `json:"relativeSpeed"` // Closing speed at contact
+	Policy        CollisionPolicy      `json:"policy"`
+	Controllers   []ControllerSnapshot `json:"controllers"`
+}
+
+func (e CollisionEvent) String() string {
+	return fmt.Sprintf("cart %d and cart %d collided at %.2f with relative speed %.2f", e.CartA, e.CartB, e.Position, e.RelativeSpeed)
+}
+
+// snapshotController captures the controller's state as it last published it,
+// with its cart as the physics loop sees it now
+func snapshotController(controller *Controller, now time.Time) ControllerSnapshot {
+	return snapshotState(*controller.Cart, controller.publishedState(), now)
+}
+
+// snapshotState captures a cart and the state its controller published, at time now
+func snapshotState(cart Cart, state publishedState, now time.Time) ControllerSnapshot {
+	snapshot := ControllerSnapshot{
+		CartId:   cart.Id,
+		State:    state.state.String(),
+		Position: cart.Position,
+		Velocity: cart.Velocity,
+		Setpoint: state.setpoint,
+	}
+	if state.left != nil && state.right != nil {
+		snapshot.LeftBorder = state.left.GetStateAt(now).p
+		snapshot.RightBorder = state.right.GetStateAt(now).p
+	}
+	if trajectory := state.current; trajectory != nil {
+		snapshot.Goal = trajectory.end
+		snapshot.StopPosition = state.planner.StoppingPosition(trajectory.GetStateAt(now))
+	}
+	return snapshot
+}
+
+// =====================================================
+// COLLISION STATE
+// =====================================================
+
+// SetCollisionPolicy changes how collisions are handled from the next physics step on
+func (sm *ScenarioManager) SetCollisionPolicy(policy CollisionPolicy, restitution float64) error {
+	if _, err := ParseCollisionPolicy(string(policy)); err != nil {
+		return err
+	}
+	if restitution < 0 || restitution > 1 {
+		return fmt.Errorf("restitution %.2f is outside [0, 1]", restitution)
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.collisionPolicy = policy
+	sm.restitution = restitution
+	log.Printf("[SCENARIO] Collision policy set to %s (restitution %.2f)", policy, restitution)
+	return nil
+}
+
+// GetCollisionPolicy returns the current collision policy and restitution
+func (sm *ScenarioManager) GetCollisionPolicy() (CollisionPolicy, float64) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.collisionPolicy, sm.restitution
+}
+
+// GetCollisions returns the collisions recorded since the carts were last reset
+func (sm *ScenarioManager) GetCollisions() []CollisionEvent {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	result := make([]CollisionEvent, len(sm.collisions))
+	copy(result, sm.collisions)
+	return result
+}
+
+// IsHalted reports whether a collision has halted the simulation
+func (sm *ScenarioManager) IsHalted() bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.halted
+}
+
+// resetCollisions clears the collision history and resumes a halted simulation
+func (sm *ScenarioManager) resetCollisions() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.collisions = nil
+	sm.contacts = make(map[[2]int]bool)
+	sm.halted = false
+}
+
+// recordCollision stores a collision event and halts the simulation if the policy says so
+func (sm *ScenarioManager) recordCollision(event CollisionEvent) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if len(sm.collisions) < maxCollisionEvents {
+		sm.collisions = append(sm.collisions, event)
+	}
+	if event.Policy == CollisionHalt {
+		sm.halted = true
+	}
+}
+
+// =====================================================
+// CONTACT RESOLUTION
+// =====================================================
+
+// handleCollisions finds touching carts, records new contacts and resolves them
+// according to the collision policy. Carts are ordered left to right.
+func (sm *ScenarioManager) handleCollisions(carts []Cart, now time.Time) {
+	policy, restitution := sm.GetCollisionPolicy()
+
+	for i := 0; i+1 < len(carts); i++ {
+		cartA := &carts[i]
+		cartB := &carts[i+1]
+		pair := [2]int{cartA.Id, cartB.Id}
+
+		overlap := (cartA.Position + cartA.Width/2) - (cartB.Position - cartB.Width/2)
+		if overlap <= -contactSlop {
+			sm.mu.Lock()
+			delete(sm.contacts, pair)
+			sm.mu.Unlock()
+			continue
+		}
+		if overlap <= 0 {
+			continue // Touching, but nothing to resolve
+		}
+
+		// Only the first step of a contact is an event, carts pushing each other stay in contact
+		sm.mu.Lock()
+		newContact := !sm.contacts[pair]
+		sm.contacts[pair] = true
+		sm.mu.Unlock()
+
+		if newContact {
+			event := CollisionEvent{
+				Time:          now,
+				CartA:         cartA.Id,
+				CartB:         cartB.Id,
+				Position:      (cartA.Position + cartA.Width/2 + cartB.Position - cartB.Width/2) / 2,
+				RelativeSpeed: cartA.Velocity - cartB.Velocity,
+				Policy:        policy,
+			}
+			for _, controller := range sm.controllers {
+				if controller != nil {
+					event.Controllers = append(event.Controllers, snapshotController(controller, now))
+				}
+			}
+			sm.recordCollision(event)
+			fmt.Printf("Collision detected: %s (policy %s)\n", event, policy)
+		}
+
+		switch policy {
+		case CollisionHalt:
+			cartA.Velocity, cartB.Velocity = 0, 0
+			cartA.Acceleration, cartB.Acceleration = 0, 0
+		case CollisionImpulse:
+			resolveImpulse(cartA, cartB, restitution)
+			separate(cartA, cartB, overlap)
+		case CollisionPush:
+			resolveImpulse(cartA, cartB, 0)
+			separate(cartA, cartB, overlap)
+		}
+	}
+}
+
+// resolveImpulse applies a one-dimensional collision impulse between two
+// approaching carts. A restitution of 1 is perfectly elastic, 0 leaves them
+// moving together.
+func resolveImpulse(cartA, cartB *Cart, restitution float64) {
+	closing := cartA.Velocity - cartB.Velocity
+	if closing <= 0 {
+		return // Already separating
+	}
+	massA, massB := cartMass(cartA), cartMass(cartB)
+	if math.IsInf(massA, 1) && math.IsInf(massB, 1) {
+		return // Neither cart can move
+	}
+	impulse := (1 + restitution) * closing / (1/massA + 1/massB)
+	cartA.Velocity -= impulse / massA
+	cartB.Velocity += impulse / massB
+}
+
+// separate pushes overlapping carts apart in inverse proportion to their mass
+func separate(cartA, cartB *Cart, overlap float64) {
+	massA, massB := cartMass(cartA), cartMass(cartB)
+	total := 1/massA + 1/massB
+	if total == 0 {
+		return // Neither cart can move
+	}
+	cartA.Position -= overlap * (1 / massA) / total
+	cartB.Position += overlap * (1 / massB) / total
+}
+
+// cartMass returns the cart's mass, treating a missing mass as immovable
+func cartMass(cart *Cart) float64 {
+	if cart.Mass <= 0 {
+		return math.Inf(1)
+	}
+	return cart.Mass
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// controlInterval is how often a controller runs its control law
+const controlInterval = 10 * time.Millisecond
+
+// ControlLaw computes the force that makes a cart follow a reference trajectory
+type ControlLaw interface {
+	// Force returns the force command for tracking reference from the measured state at time now
+	Force(reference *Trajectory, now time.Time, position, velocity float64) float64
+	// Setpoint returns the position the law is currently steering to
+	Setpoint() float64
+	// Replanned is called when the controller switches to a new trajectory
+	Replanned()
+}
+
+// ControlLawParameters selects and tunes a controller's control law
+type ControlLawParameters struct {
+	Type           string  `json:"type"`                     // "pid" (default), "lqr" or "mpc"
+	MaxForce       float64 `json:"maxForce,omitempty"`       // Force limit, defaults to defaultMaxForce
+	MaxVelocity    float64 `json:"maxVelocity,omitempty"`    // Velocity limit respected by MPC, defaults to defaultMaxVelocity
+	PositionWeight float64 `json:"positionWeight,omitempty"` // LQR/MPC weight of the position error
+	VelocityWeight float64 `json:"velocityWeight,omitempty"` // LQR/MPC weight of the velocity error
+	ForceWeight    float64 `json:"forceWeight,omitempty"`    // LQR/MPC weight of the force
+	Horizon        int     `json:"horizon,omitempty"`        // MPC prediction steps of controlInterval
+
+	PositionLoop *PIDParameters `json:"positionLoop,omitempty"` // PID: position loop, defaults to defaultPositionLoop
+	VelocityLoop *PIDParameters `json:"velocityLoop,omitempty"` // PID: velocity loop, defaults to defaultVelocityLoop
+}
+
+const (
+	defaultMaxForce    = 150 // Matches the velocity PID's output limit
+	defaultMaxVelocity = 300 // Matches the position PID's output limit
+)
+
+// controlLawPresets are named control laws selectable from the command line
+var controlLawPresets = map[string]ControlLawParameters{
+	"pid": {Type: "pid"},
+	"lqr": {Type: "lqr", PositionWeight: 1e5, VelocityWeight: 100, ForceWeight: 1},
+	"mpc": {Type: "mpc", PositionWeight: 1e5, VelocityWeight: 100, ForceWeight: 1, Horizon: 20},
+}
+
+// getControlLawPreset looks up a control law preset by name
+func getControlLawPreset(name string) (ControlLawParameters, error) {
+	params, exists := controlLawPresets[name]
+	if !exists {
+		names := make([]string, 0, len(controlLawPresets))
+		for preset := range controlLawPresets {
+			names = append(names, preset)
+		}
+		sort.Strings(names)
+		return ControlLawParameters{}, fmt.Errorf("unknown control law %q (expected one of %s)", name, strings.Join(names, ", "))
+	}
+	return params, nil
+}
+
+// loadControlLaw resolves a preset name or reads a control law JSON file, as
+// written by the autotune command
+func loadControlLaw(nameOrPath string) (ControlLawParameters, error) {
+	if params, err := getControlLawPreset(nameOrPath); err == nil {
+		return params, nil
+	}
+	data, err := os.ReadFile(nameOrPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return getControlLawPreset(nameOrPath)
+		}
+		return ControlLawParameters{}, err
+	}
+	var params ControlLawParameters
+	if err := json.Unmarshal(data, &params); err != nil {
+		return ControlLawParameters{}, fmt.Errorf("%s: %w", nameOrPath, err)
+	}
+	if err := params.validate(); err != nil {
+		return ControlLawParameters{}, fmt.Errorf("%s: %w", nameOrPath, err)
+	}
+	return params, nil
+}
+
+// withDefaults fills in unset limits and weights
+func (p ControlLawParameters) withDefaults() ControlLawParameters {
+	if p.Type == "" {
+		p.Type = "pid"
+	}
+	if p.MaxForce == 0 {
+		p.MaxForce = defaultMaxForce
+	}
+	if p.MaxVelocity == 0 {
+		p.MaxVelocity = defaultMaxVelocity
+	}
+	if preset, exists := controlLawPresets[p.Type]; exists {
+		if p.PositionWeight == 0 {
+			p.PositionWeight = preset.PositionWeight
+		}
+		if p.VelocityWeight == 0 {
+			p.VelocityWeight = preset.VelocityWeight
+		}
+		if p.ForceWeight == 0 {
+			p.ForceWeight = preset.ForceWeight
+		}
+		if p.Horizon == 0 {
+			p.Horizon = preset.Horizon
+		}
+	}
+	return p
+}
+
+// validate checks the parameters
+func (p ControlLawParameters) validate() error {
+	switch p.Type {
+	case "", "pid", "lqr", "mpc":
+	default:
+		return fmt.Errorf("unknown control law %q", p.Type)
+	}
+	if p.MaxForce < 0 || p.MaxVelocity < 0 || p.PositionWeight < 0 || p.VelocityWeight < 0 || p.ForceWeight < 0 || p.Horizon < 0 {
+		return fmt.Errorf("control law parameters must not be negative")
+	}
+	if p.PositionLoop != nil {
+		if err := p.PositionLoop.validate(); err != nil {
+			return fmt.Errorf("position loop: %w", err)
+		}
+	}
+	if p.VelocityLoop != nil {
+		if err := p.VelocityLoop.validate(); err != nil {
+			return fmt.Errorf("velocity loop: %w", err)
+		}
+	}
+	return nil
+}
+
+// clone returns a copy that shares no loop parameters with p
+func (p ControlLawParameters) clone() ControlLawParameters {
+	if p.PositionLoop != nil {
+		p.PositionLoop = p.PositionLoop.clone()
+	}
+	if p.VelocityLoop != nil {
+		p.VelocityLoop = p.VelocityLoop.clone()
+	}
+	return p
+}
+
+// newControlLaw creates the control law the parameters describe
+func newControlLaw(params ControlLawParameters, feedForward FeedForward, mass float64) ControlLaw {
+	params = params.withDefaults()
+	switch params.Type {
+	case "lqr":
+		return NewLQRLaw(params, mass)
+	case "mpc":
+		return NewMPCLaw(params, mass)
+	default:
+		law := NewCascadedPIDLaw(mass)
+		if params.PositionLoop != nil {
+			law.PositionPID = params.PositionLoop.newPID(controlInterval.Seconds(), params.MaxVelocity)
+		}
+		if params.VelocityLoop != nil {
+			law.VelocityPID = params.VelocityLoop.newPID(controlInterval.Seconds(), params.MaxForce)
+		}
+		law.FeedForward = feedForward
+		return law
+	}
+}
+
+// =====================================================
+// CASCADED PID
+// =====================================================
+
+// CascadedPIDLaw is a position PID whose output is the setpoint of a velocity PID
+type CascadedPIDLaw struct {
+	PositionPID *PID
+	VelocityPID *PID
+	FeedForward FeedForward // Trajectory feed-forward gains, zero disables
+	mass        float64
+}
+
+// defaultPositionLoop is the position loop's tuning: proportional only, its output is a velocity
+func defaultPositionLoop() PIDParameters {
+	return PIDParameters{Kp: 100}
+}
+
+// defaultVelocityLoop is the velocity loop's tuning, its output is a force
+func defaultVelocityLoop() PIDParameters {
+	return PIDParameters{Kp: 150, Ki: 10}
+}
+
+// NewCascadedPIDLaw creates the cascade with the default loops
+func NewCascadedPIDLaw(mass float64) *CascadedPIDLaw {
+	return &CascadedPIDLaw{
+		VelocityPID: defaultVelocityLoop().newPID(controlInterval.Seconds(), defaultMaxForce),
+		PositionPID: defaultPositionLoop().newPID(controlInterval.Seconds(), defaultMaxVelocity),
+		mass:        mass,
+	}
+}
+
+func (law *CascadedPIDLaw) Force(reference *Trajectory, now time.Time, position, velocity float64) float64 {
+	state := reference.GetStateAt(now)
+	law.PositionPID.SetSetpoint(state.p)
+	control_velocity := law.PositionPID.Update(now, position)
+
+	// Feed the planned velocity into the velocity loop and the planned acceleration into the force
+	control_velocity = clamp(control_velocity+law.FeedForward.VelocityGain*state.v, law.PositionPID.MaxOutput)
+	law.VelocityPID.SetSetpoint(control_velocity)
+	control_force := law.VelocityPID.Update(now, velocity)
+	return clamp(control_force+law.FeedForward.AccelerationGain*law.mass*state.a, law.VelocityPID.MaxOutput)
+}
+
+func (law *CascadedPIDLaw) Setpoint() float64 {
+	return law.PositionPID.Setpoint
+}
+
+func (law *CascadedPIDLaw) Replanned() {
+	law.PositionPID.Replanned()
+	law.VelocityPID.Replanned()
+}
+
+// =====================================================
+// LQR STATE FEEDBACK
+// =====================================================
+
+// LQRLaw feeds forward mass times the planned acceleration and corrects the
+// position and velocity errors with the infinite-horizon LQR gain of the
+// discretized double integrator
+type LQRLaw struct {
+	K        [2]float64 // Gains on position and velocity error
+	maxForce float64
+	mass     float64
+	setpoint float64
+}
+
+// NewLQRLaw computes the LQR gain for the cart's mass at the control interval
+func NewLQRLaw(params ControlLawParameters, mass float64) *LQRLaw {
+	dt := controlInterval.Seconds()
+	a := [2][2]float64{{1, dt}, {0, 1}}
+	b := [2]float64{dt * dt / (2 * mass), dt / mass}
+	q := [2][2]float64{{params.PositionWeight, 0}, {0, params.VelocityWeight}}
+	r := params.ForceWeight
+
+	// Iterate the discrete Riccati equation to convergence
+	p := q
+	var k [2]float64
+	for i := 0; i < 10000; i++ {
+		// pb = P B, btpb = B' P B, btpa = B' P A
+		pb := [2]float64{p[0][0]*b[0] + p[0][1]*b[1], p[1][0]*b[0] + p[1][1]*b[1]}
+		btpb := b[0]*pb[0] + b[1]*pb[1]
+		btpa := [2]float64{pb[0]*a[0][0] + pb[1]*a[1][0], pb[0]*a[0][1] + pb[1]*a[1][1]}
+		k = [2]float64{btpa[0] / (r + btpb), btpa[1] / (r + btpb)}
+
+		// P = Q + A' P (A - B K)
+		closed := [2][2]float64{
+			{a[0][0] - b[0]*k[0], a[0][1] - b[0]*k[1]},
+			{a[1][0] - b[1]*k[0], a[1][1] - b[1]*k[1]},
+		}
+		next := multiply2(transpose2(a), multiply2(p, closed))
+		next[0][0] += q[0][0]
+		next[1][1] += q[1][1]
+
+		converged := math.Abs(next[0][0]-p[0][0]) < 1e-9*math.Abs(p[0][0]) && math.Abs(next[1][1]-p[1][1]) < 1e-9*math.Abs(p[1][1])
+		p = next
+		if converged {
+			break
+		}
+	}
+
+	return &LQRLaw{K: k, maxForce: params.MaxForce, mass: mass}
+}
+
+func (law *LQRLaw) Force(reference *Trajectory, now time.Time, position, velocity float64) float64 {
+	state := reference.GetStateAt(now)
+	law.setpoint = state.p
+	force := law.mass*state.a - law.K[0]*(position-state.p) - law.K[1]*(velocity-state.v)
+	return clamp(force, law.maxForce)
+}
+
+func (law *LQRLaw) Setpoint() float64 {
+	return law.setpoint
+}
+
+// Replanned does nothing, state feedback has no memory
+func (law *LQRLaw) Replanned() {}
+
+func multiply2(a, b [2][2]float64) [2][2]float64 {
+	return [2][2]float64{
+		{a[0][0]*b[0][0] + a[0][1]*b[1][0], a[0][0]*b[0][1] + a[0][1]*b[1][1]},
+		{a[1][0]*b[0][0] + a[1][1]*b[1][0], a[1][0]*b[0][1] + a[1][1]*b[1][1]},
+	}
+}
+
+func transpose2(a [2][2]float64) [2][2]float64 {
+	return [2][2]float64{{a[0][0], a[1][0]}, {a[0][1], a[1][1]}}
+}
+
+// =====================================================
+// RECEDING-HORIZON MPC
+// =====================================================
+
+// mpcIterations is the number of optimizer iterations per control step
+const mpcIterations = 60
+
+// MPCLaw plans the forces over a horizon of control intervals that best follow
+// the reference, subject to the force and velocity limits, and applies the
+// first one. The quadratic program is solved with accelerated projected
+// gradient descent, warm-started from the previous plan.
+type MPCLaw struct {
+	params   ControlLawParameters
+	mass     float64
+	dt       float64
+	pu, vu   [][]float64 // Effect of each planned force on the predicted positions and velocities
+	step     float64     // Gradient step, the inverse of the cost's curvature bound
+	plan     []float64
+	setpoint float64
+}
+
+// NewMPCLaw builds the prediction model for the cart's mass at the control interval
+func NewMPCLaw(params ControlLawParameters, mass float64) *MPCLaw {
+	n := params.Horizon
+	dt := controlInterval.Seconds()
+	law := &MPCLaw{
+		params: params,
+		mass:   mass,
+		dt:     dt,
+		pu:     make([][]float64, n),
+		vu:     make([][]float64, n),
+		plan:   make([]float64, n),
+	}
+	for k := 0; k < n; k++ {
+		law.pu[k] = make([]float64, n)
+		law.vu[k] = make([]float64, n)
+		for j := 0; j <= k; j++ {
+			law.pu[k][j] = dt * dt / mass * (float64(k-j) + 0.5)
+			law.vu[k][j] = dt / mass
+		}
+	}
+
+	// Power iteration for the largest eigenvalue of the cost's Hessian
+	x := make([]float64, n)
+	for i := range x {
+		x[i] = 1
+	}
+	curvature := 0.0
+	for iteration := 0; iteration < 100; iteration++ {
+		hx := law.hessianTimes(x)
+		norm := 0.0
+		for _, value := range hx {
+			norm += value * value
+		}
+		norm = math.Sqrt(norm)
+		if norm == 0 {
+			break
+		}
+		curvature = norm
+		for i := range x {
+			x[i] = hx[i] / norm
+		}
+	}
+	law.step = 1 / curvature
+	return law
+}
+
+// hessianTimes multiplies x by the cost's Hessian
+func (law *MPCLaw) hessianTimes(x []float64) []float64 {
+	n := len(x)
+	p := make([]float64, n)
+	v := make([]float64, n)
+	for k := 0; k < n; k++ {
+		for j := 0; j <= k; j++ {
+			p[k] += law.pu[k][j] * x[j]
+			v[k] += law.vu[k][j] * x[j]
+		}
+	}
+	result := make([]float64, n)
+	for j := 0; j < n; j++ {
+		result[j] = 2 * law.params.ForceWeight * x[j]
+		for k := j; k < n; k++ {
+			result[j] += 2*law.params.PositionWeight*law.pu[k][j]*p[k] + 2*law.params.VelocityWeight*law.vu[k][j]*v[k]
+		}
+	}
+	return result
+}
+
+func (law *MPCLaw) Force(reference *Trajectory, now time.Time, position, velocity float64) float64 {
+	n := law.params.Horizon
+	interval := time.Duration(law.dt * float64(time.Second))
+	law.setpoint = reference.GetStateAt(now).p
+
+	referencePosition := make([]float64, n)
+	referenceVelocity := make([]float64, n)
+	for k := 0; k < n; k++ {
+		state := reference.GetStateAt(now.Add(time.Duration(k+1) * interval))
+		referencePosition[k] = state.p
+		referenceVelocity[k] = state.v
+	}
+
+	// Warm start from the previous plan shifted by one step
+	u := make([]float64, n)
+	copy(u, law.plan[1:])
+	u[n-1] = law.plan[n-1]
+	previous := make([]float64, n)
+	copy(previous, u)
+	y := make([]float64, n)
+	copy(y, u)
+	momentum := 1.0
+
+	predictedPosition := make([]float64, n)
+	predictedVelocity := make([]float64, n)
+	gradient := make([]float64, n)
+	for iteration := 0; iteration < mpcIterations; iteration++ {
+		// Predict the motion under the candidate plan y
+		for k := 0; k < n; k++ {
+			predictedPosition[k] = position + float64(k+1)*law.dt*velocity
+			predictedVelocity[k] = velocity
+			for j := 0; j <= k; j++ {
+				predictedPosition[k] += law.pu[k][j] * y[j]
+				predictedVelocity[k] += law.vu[k][j] * y[j]
+			}
+		}
+
+		// Gradient of the tracking cost and the force cost
+		for j := 0; j < n; j++ {
+			gradient[j] = 2 * law.params.ForceWeight * y[j]
+			for k := j; k < n; k++ {
+				gradient[j] += 2 * law.params.PositionWeight * law.pu[k][j] * (predictedPosition[k] - referencePosition[k])
+				gradient[j] += 2 * law.params.VelocityWeight * law.vu[k][j] * (predictedVelocity[k] - referenceVelocity[k])
+			}
+		}
+
+		// Projected step onto the force and velocity limits, with Nesterov momentum
+		for j := 0; j < n; j++ {
+			u[j] = y[j] - law.step*gradient[j]
+		}
+		law.project(u, velocity)
+		nextMomentum := (1 + math.Sqrt(1+4*momentum*momentum)) / 2
+		for j := 0; j < n; j++ {
+			y[j] = u[j] + (momentum-1)/nextMomentum*(u[j]-previous[j])
+		}
+		momentum = nextMomentum
+		copy(previous, u)
+	}
+
+	copy(law.plan, u)
+	return u[0]
+}
+
+// project makes a plan feasible. Each force is clamped to the force limit and to
+// the forces that keep the predicted velocity after it within the velocity limit,
+// given the forces before it. A cart already too fast brakes as hard as it can.
+func (law *MPCLaw) project(u []float64, velocity float64) {
+	maxForce, maxVelocity := law.params.MaxForce, law.params.MaxVelocity
+	perForce := law.dt / law.mass    // Velocity change of a unit force over one interval
+	perVelocity := law.mass / law.dt // Force that changes the velocity by one over one interval
+	for j := range u {
+		low := (-maxVelocity - velocity) * perVelocity
+		if low < -maxForce {
+			low = -maxForce
+		}
+		high := (maxVelocity - velocity) * perVelocity
+		if high > maxForce {
+			high = maxForce
+		}
+		switch {
+		case low > high:
+			u[j] = -math.Copysign(maxForce, velocity)
+		case u[j] < low:
+			u[j] = low
+		case u[j] > high:
+			u[j] = high
+		}
+		velocity += perForce * u[j]
+	}
+}
+
+func (law *MPCLaw) Setpoint() float64 {
+	return law.setpoint
+}
+
+// Replanned keeps the warm start, the previous plan's forces are still what the cart is doing
+func (law *MPCLaw) Replanned() {}
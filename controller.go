@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -37,6 +39,13 @@ func (s State) String() string {
 	}
 }
 
+// FeedForward sets how much of the planned velocity and acceleration is fed
+// forward past the PIDs. 1 is full feed-forward, 0 disables it.
+type FeedForward struct {
+	VelocityGain     float64 `json:"velocityGain"`     // Planned velocity added to the velocity setpoint
+	AccelerationGain float64 `json:"accelerationGain"` // Mass times planned acceleration added to the force
+}
+
 type Side int
 
 const (
@@ -46,6 +55,7 @@ const (
 
 type RequestParameters struct {
 	Goal        float64
+	Path        []Waypoint // Multi-waypoint path the border move is for, nil for a single goal
 	Request     Request
 	RetryTime   time.Time // Time when the request is to be retried
 	AcceptState State     // State to transition to if the request is accepted
@@ -74,18 +84,25 @@ type Controller struct {
 	GoalTimestamp         int64     // Timestamp of the current goal request
 	BusyUntil             time.Time // Time until which the controller is busy
 
-	VelocityPID     *PID
-	PositionPID     *PID
+	ControlLaw      ControlLaw     // Turns the current trajectory and the measured state into a force
+	Estimator       StateEstimator // Optional, filters measurements before the control law
 	MovementPlanner *MovementPlanner
-	safetyMargin    float64 // Safety margin for goal requests
+	safetyMargin    float64       // Safety margin for goal requests
+	busyDwell       time.Duration // Time spent busy at a reached goal
+
+	// Tunable settings in effect and a change waiting for the next tick
+	parameters        ControllerParameters
+	pendingParameters *ControllerParameters
+	parametersMu      sync.Mutex
 
 	// Metrics for performance monitoring
 	Metrics *MessageMetrics
 
-	IncomingGoalRequest   chan float64  // Channel for incoming goal requests
-	IncomingEmergencyStop chan bool     // Channel for emergency stop commands
-	GoalCompletionReport  chan bool     // Channel to report goal completion to goal manager
-	StopController        chan struct{} // Channel to stop the controller loop
+	IncomingGoalRequest   chan float64    // Channel for incoming goal requests
+	IncomingPathRequest   chan []Waypoint // Channel for incoming multi-waypoint goals
+	IncomingEmergencyStop chan bool       // Channel for emergency stop commands
+	GoalCompletionReport  chan bool       // Channel to report goal completion to goal manager
+	StopController        chan struct{}   // Channel to stop the controller loop
 
 	// Channels for inter-controller communication
 	OutgoingRightRequest  chan Request
@@ -103,11 +120,20 @@ type Controller struct {
 	// Pending emergency stop confirmation to send after our own stop is complete
 	PendingEmergencyStopConfirmation *EmergencyStopConfirmation
 
-	// Pending goal to handle after stopping is complete
-	pendingGoalAfterStop *float64
+	// Pending goal or path to handle after stopping is complete
+	pendingPathAfterStop []Waypoint
+
+	// Time source for ticks, busy periods, retries and request IDs
+	clock Clock
+	// Last request ID handed out, keeps IDs unique when the clock has not moved
+	lastRequestId int64
 
 	// Logger for this controller
 	logger *log.Logger
+
+	// State for other goroutines, published after every event the main loop handles
+	published   publishedState
+	publishedMu sync.Mutex
 }
 
 // LogLevel represents the level of logging
@@ -162,20 +188,18 @@ func (c *Controller) logError(format string, args ...interface{}) {
 }
 
 // NewController creates a new controller for a cart
-func NewController(cart *Cart, leftBorder, rightBorder float64) *Controller {
+func NewController(cart *Cart, leftBorder, rightBorder float64, clock Clock) *Controller {
 	// Initialize trajectories
-	movementPlanner := NewMovementPlanner(200, 100, 300)
+	parameters := defaultControllerParameters()
+	movementPlanner := NewMovementPlanner(parameters.MaxJerk, parameters.MaxAcceleration, parameters.MaxVelocity, clock)
 	leftBorderTrajectory := movementPlanner.GetStationaryTrajectory(leftBorder)
 	rightBorderTrajectory := movementPlanner.GetStationaryTrajectory(rightBorder)
 	currentTrajectory := movementPlanner.GetStationaryTrajectory(cart.Position)
 
-	return &Controller{
+	controller := &Controller{
 		Cart:                  cart,
-		VelocityPID:           NewPID(150, 10, 0, 0.01, 150),
-		PositionPID:           NewPID(100, 0, 0, 0.01, 300),
 		MovementPlanner:       movementPlanner,
-		safetyMargin:          30,
-		Metrics:               NewMessageMetrics(), // Initialize metrics tracking
+		Metrics:               NewMessageMetrics(clock), // Initialize metrics tracking
 		LeftBorderTrajectory:  leftBorderTrajectory,
 		RightBorderTrajectory: rightBorderTrajectory,
 		CurrentTrajectory:     currentTrajectory,
@@ -185,27 +209,46 @@ func NewController(cart *Cart, leftBorder, rightBorder float64) *Controller {
 		StopController:        make(chan struct{}),    // Channel to stop the controller
 		State:                 Idle,
 		PendingRequests:       make(map[int64]*RequestParameters),
+		clock:                 clock,
 		logger:                log.New(os.Stdout, "", log.LstdFlags),
 	}
+	controller.applyParameters(parameters)
+	return controller
+}
+
+// nextRequestId returns a new request ID based on the current time. IDs double as
+// timestamps for tie-breaking, so the cart ID is added to keep neighbours that
+// act at the same instant distinct, and IDs from one controller always increase.
+func (c *Controller) nextRequestId() int64 {
+	requestId := c.clock.Now().UnixNano() + int64(c.Cart.Id)
+	if requestId <= c.lastRequestId {
+		requestId = c.lastRequestId + 1
+	}
+	c.lastRequestId = requestId
+	return requestId
 }
 
 // run_controller starts the controller's main loop
 func (c *Controller) run_controller() {
 	c.logInfo("Starting controller main loop")
 
-	ticker := time.NewTicker(10 * time.Millisecond)
+	ticker := c.clock.NewTicker(controlInterval)
 	defer ticker.Stop()
 
+	c.publishState()
 	for {
 		select {
 		case <-ticker.C:
-			// run PID controllers
-			c.runPIDControllers()
+			// take over parameters changed since the last tick
+			c.applyPendingParameters()
+
+			// run the control law
+			c.runControlLaw()
 
 			// state machine
 			switch c.State {
 			case Busy:
-				if time.Now().After(c.BusyUntil) {
+				if c.clock.Now().After(c.BusyUntil) {
 					c.logInfo("Busy period ended, returning to idle state")
 					c.State = Idle
 					// Report goal completion when busy period ends
@@ -220,7 +263,7 @@ func (c *Controller) run_controller() {
 				if c.CurrentTrajectory.IsFinished() {
 					c.logInfo("Goal reached!")
 					c.State = Busy
-					c.BusyUntil = time.Now().Add(5000 * time.Millisecond) // Simulate busy state for 5s
+					c.BusyUntil = c.clock.Now().Add(c.busyDwell) // Simulate busy state
 				}
 			case Avoiding:
 				// Check if the cart has reached the goal
@@ -246,11 +289,11 @@ func (c *Controller) run_controller() {
 					c.logInfo("Stopping completed")
 
 					// Check if there's a pending goal to handle after stopping
-					if c.pendingGoalAfterStop != nil {
-						goal := *c.pendingGoalAfterStop
-						c.pendingGoalAfterStop = nil // Clear the pending goal
-						c.logInfo("Processing pending goal after stop: %.2f", goal)
-						c.handleGoalRequest(goal, Moving)
+					if c.pendingPathAfterStop != nil {
+						path := c.pendingPathAfterStop
+						c.pendingPathAfterStop = nil // Clear the pending goal
+						c.logInfo("Processing pending goal after stop: %s", describePath(path))
+						c.handlePathRequest(path)
 					} else {
 						c.State = Idle
 						// Notify goal manager that we're ready for a new goal (previous goal was interrupted)
@@ -273,11 +316,22 @@ func (c *Controller) run_controller() {
 			case Idle, Requesting:
 				c.handleGoalRequest(goal, Moving)
 			case Moving, Avoiding, Stopping:
-				c.handleGoalRequestDuringMovement(goal)
+				c.handlePathRequestDuringMovement([]Waypoint{{Position: goal}})
 			default:
 				c.logWarn("Ignoring goal request while not idle (state: %s)", c.State)
 			}
 
+		case path := <-c.IncomingPathRequest:
+			c.logDebug("Processing path request: %s in state %s", describePath(path), c.State)
+			switch c.State {
+			case Idle, Requesting:
+				c.handlePathRequest(path)
+			case Moving, Avoiding, Stopping:
+				c.handlePathRequestDuringMovement(path)
+			default:
+				c.logWarn("Ignoring path request while not idle (state: %s)", c.State)
+			}
+
 		case <-c.IncomingEmergencyStop:
 			c.logInfo("Emergency stop signal received")
 			c.handleEmergencyStop()
@@ -296,12 +350,13 @@ func (c *Controller) run_controller() {
 			c.logDebug("Received response from left neighbor (ID: %d, Type: %v)", response.RequestId, response.Type)
 			c.handleResponse(response, Left)
 		}
+		c.publishState()
 	}
 }
 
 func (c *Controller) retryPendingRequests() {
 	for requestId, pendingRequest := range c.PendingRequests {
-		if time.Now().After(pendingRequest.RetryTime) {
+		if c.clock.Now().After(pendingRequest.RetryTime) {
 			c.logDebug("Request %d is ready for retry", requestId)
 			// Skip retrying requests that have an original request, as the original request will be retried anyways
 			if pendingRequest.OriginalRequest != nil {
@@ -334,6 +389,7 @@ func (c *Controller) retryPendingRequests() {
 					pendingRequest.OriginalUpdateTrajectory,
 					pendingRequest.OriginalTrajectory,
 					pendingRequest.OriginalOutgoingResponse,
+					pendingRequest.Path,
 				)
 			default:
 				c.logError("Unknown request type for retry: %v", pendingRequest.Request.Type)
@@ -343,12 +399,51 @@ func (c *Controller) retryPendingRequests() {
 	}
 }
 
-func (c *Controller) runPIDControllers() {
-	c.PositionPID.SetSetpoint(c.CurrentTrajectory.GetCurrentPosition())
-	control_velocity := c.PositionPID.Update(c.Cart.Position)
-	c.VelocityPID.SetSetpoint(control_velocity)
-	control_force := c.VelocityPID.Update(c.Cart.Velocity)
+// measure returns the cart's state as seen through its sensor
+func (c *Controller) measure() Measurement {
+	now := c.clock.Now()
+	if c.Cart.Sensor == nil {
+		return Measurement{Time: now, Position: c.Cart.Position, Velocity: c.Cart.Velocity}
+	}
+	return c.Cart.Sensor.Read(now)
+}
+
+func (c *Controller) runControlLaw() {
+	measurement := c.measure()
+	position, velocity := measurement.Position, measurement.Velocity
+	now := c.clock.Now()
+	if c.Estimator != nil {
+		// The force applied since the last tick is the previous command
+		estimate := c.Estimator.Update(now, measurement, c.Cart.Force)
+		position, velocity = estimate.Position, estimate.Velocity
+	}
+	control_force := c.ControlLaw.Force(c.CurrentTrajectory, now, position, velocity)
 	c.Cart.applyForce(control_force)
+
+	// Tracking error against the true position, while the cart follows a moving plan
+	if c.State == Moving || c.State == Avoiding || c.State == Stopping {
+		c.Metrics.RecordTrackingError(c.CurrentTrajectory.GetStateAt(now).p - c.Cart.Position)
+	}
+	c.Metrics.RecordControlEffort(control_force, c.Cart.Velocity, controlInterval.Seconds())
+}
+
+// setTrajectory switches the cart to a new trajectory and lets the control law know
+func (c *Controller) setTrajectory(trajectory *Trajectory) {
+	c.CurrentTrajectory = trajectory
+	c.ControlLaw.Replanned()
+
+	// A plan that breaks the planner's own limits points at a planner bug
+	if violations := c.MovementPlanner.ValidateTrajectory(trajectory); len(violations) > 0 {
+		c.Metrics.RecordInvalidTrajectory()
+		for _, violation := range violations {
+			c.logWarn("Invalid trajectory: %s", violation)
+		}
+	}
+}
+
+// clamp limits value to [-limit, limit]
+func clamp(value, limit float64) float64 {
+	return max(-limit, min(limit, value))
 }
 
 func (c *Controller) handleGoalRequest(goal float64, acceptState State) {
@@ -361,48 +456,114 @@ func (c *Controller) handleGoalRequestWithOriginal(goal float64, acceptState Sta
 	// Record goal received for goal-to-movement timing
 	c.Metrics.RecordGoalReceived()
 
-	goalTimestamp := time.Now().UnixNano()
+	goalTimestamp := c.nextRequestId()
 
 	if c.LeftBorderTrajectory.end+c.safetyMargin < goal && goal < c.RightBorderTrajectory.end-c.safetyMargin {
 		c.logDebug("Goal %.2f is within borders [%.2f, %.2f] with safety margin %.2f", goal, c.LeftBorderTrajectory.end, c.RightBorderTrajectory.end, c.safetyMargin)
-		c.acceptGoal(goal, goalTimestamp, acceptState)
+		c.acceptGoal(goal, goalTimestamp, acceptState, requestDeadline(originalRequest))
 	} else {
 		c.logDebug("Goal %.2f is outside borders, need to expand", goal)
-		c.queueBorderMoveRequest(goal, goalTimestamp, acceptState, nil, originalRequest, originalUpdateTrajectory, originalTrajectory, originalOutgoingResponse)
+		c.queueBorderMoveRequest(goal, goalTimestamp, acceptState, nil, originalRequest, originalUpdateTrajectory, originalTrajectory, originalOutgoingResponse, nil)
+	}
+}
+
+// handlePathRequest plans a goal or a multi-waypoint path from standstill. The borders for
+// the whole path are negotiated up front, one side at a time, before the cart moves.
+func (c *Controller) handlePathRequest(path []Waypoint) {
+	if len(path) == 1 {
+		c.handleGoalRequest(path[0].Position, Moving)
+		return
+	}
+	c.logInfo("Received path request: %s", describePath(path))
+	c.Metrics.RecordGoalReceived()
+	c.negotiatePath(path, c.nextRequestId())
+}
+
+// negotiatePath requests the border on one side the path needs, or accepts the path once it fits
+func (c *Controller) negotiatePath(path []Waypoint, goalTimestamp int64) {
+	low, high := pathExtent(path)
+	if c.LeftBorderTrajectory.end+c.safetyMargin >= low {
+		c.queueBorderMoveRequest(low, goalTimestamp, Moving, nil, nil, nil, nil, nil, path)
+	} else if c.RightBorderTrajectory.end-c.safetyMargin <= high {
+		c.queueBorderMoveRequest(high, goalTimestamp, Moving, nil, nil, nil, nil, nil, path)
+	} else {
+		c.acceptPath(path, goalTimestamp)
 	}
 }
 
-func (c *Controller) handleGoalRequestDuringMovement(goal float64) {
-	c.logInfo("Received goal request during movement, stopping first: %.2f", goal)
+// handlePathRequestDuringMovement blends into a new goal or path when the
+// borders allow it, otherwise it stops first and handles it after the stop
+func (c *Controller) handlePathRequestDuringMovement(path []Waypoint) {
+	if c.canBlendInto(path) {
+		c.logInfo("Received goal request during movement, blending into it: %s", describePath(path))
+		c.pendingPathAfterStop = nil
+		c.handlePathRequest(path)
+		return
+	}
+
+	c.logInfo("Received goal request during movement, stopping first: %s", describePath(path))
 
 	// Store the new goal to handle after stopping is complete
-	c.pendingGoalAfterStop = &goal
+	c.pendingPathAfterStop = path
 
 	// Check if the pending goal would require border expansion
 	// If so, we should notify the relevant neighbor about the upcoming stop
-	goalRequiresLeftBorderExpansion := c.LeftBorderTrajectory.end+c.safetyMargin >= goal
-	goalRequiresRightBorderExpansion := c.RightBorderTrajectory.end-c.safetyMargin <= goal
+	goalRequiresLeftBorderExpansion, goalRequiresRightBorderExpansion := c.pathRequiresExpansion(path)
 
 	c.logDebug("Goal analysis: leftExpansion=%v, rightExpansion=%v", goalRequiresLeftBorderExpansion, goalRequiresRightBorderExpansion)
 
 	// Use the emergency stop method to properly coordinate with neighbors
 	// But first, let neighbors know why we're stopping if it affects their borders
 	if goalRequiresLeftBorderExpansion && c.OutgoingLeftRequest != nil {
-		c.logDebug("Pending goal %.2f would require left border expansion, notifying left neighbor", goal)
+		c.logDebug("Pending goal %s would require left border expansion, notifying left neighbor", describePath(path))
 	}
 	if goalRequiresRightBorderExpansion && c.OutgoingRightRequest != nil {
-		c.logDebug("Pending goal %.2f would require right border expansion, notifying right neighbor", goal)
+		c.logDebug("Pending goal %s would require right border expansion, notifying right neighbor", describePath(path))
 	}
 
 	c.handleEmergencyStop()
 }
 
-func (c *Controller) acceptGoal(goal float64, goalTimestamp int64, acceptState State) {
+// pathRequiresExpansion reports which borders a goal or path needs moved
+func (c *Controller) pathRequiresExpansion(path []Waypoint) (left, right bool) {
+	low, high := pathExtent(path)
+	return c.LeftBorderTrajectory.end+c.safetyMargin >= low, c.RightBorderTrajectory.end-c.safetyMargin <= high
+}
+
+// canBlendInto reports whether the cart can go from its current motion straight into
+// the goal or path, which needs the whole replanned trajectory, overshoot included, to
+// stay inside the borders. A stop confirmation outstanding either way rules it out:
+// a neighbor waiting for ours, or us waiting for a neighbor's.
+func (c *Controller) canBlendInto(path []Waypoint) bool {
+	if c.PendingEmergencyStopConfirmation != nil {
+		return false
+	}
+	for _, pendingRequest := range c.PendingRequests {
+		if pendingRequest.Request.Type == EMERGENCY_STOP {
+			return false
+		}
+	}
+	leftLimit := max(c.LeftBorderTrajectory.end, c.LeftBorderTrajectory.GetCurrentPosition()) + c.safetyMargin
+	rightLimit := min(c.RightBorderTrajectory.end, c.RightBorderTrajectory.GetCurrentPosition()) - c.safetyMargin
+	if low, high := pathExtent(path); low <= leftLimit || high >= rightLimit {
+		return false
+	}
+
+	low, high := c.MovementPlanner.CalculateWaypointTrajectory(c.CurrentTrajectory.GetCurrentState(), path).GetBounds()
+	c.logDebug("Blended trajectory to %s spans [%.2f, %.2f], limits [%.2f, %.2f]", describePath(path), low, high, leftLimit, rightLimit)
+	return leftLimit < low && high < rightLimit
+}
+
+// acceptGoal starts moving to an accepted goal. With a deadline, as when giving way to a
+// neighbor, the movement is timed to arrive at the deadline instead of as soon as possible.
+func (c *Controller) acceptGoal(goal float64, goalTimestamp int64, acceptState State, deadline time.Time) {
 	c.logInfo("Goal accepted: %.2f", goal)
 	c.State = acceptState
 	c.GoalTimestamp = goalTimestamp
 	// Handle incoming goal request
-	c.CurrentTrajectory = c.MovementPlanner.CalculatePointToPointTrajectory(c.CurrentTrajectory.GetCurrentPosition(), goal)
+	trajectory, _ := c.planArrivingBy(c.CurrentTrajectory.GetCurrentState(), goal, deadline)
+	c.setTrajectory(trajectory)
+	c.Metrics.RecordGoalOutcome(goal, true, acceptState == Avoiding)
 
 	// Record movement start for goal-to-movement timing
 	if acceptState == Moving {
@@ -410,8 +571,71 @@ func (c *Controller) acceptGoal(goal float64, goalTimestamp int64, acceptState S
 	}
 }
 
-func (c *Controller) rejectGoal(goal float64) {
+// acceptPath starts a multi-waypoint path whose borders are all in place
+func (c *Controller) acceptPath(path []Waypoint, goalTimestamp int64) {
+	c.logInfo("Path accepted: %s", describePath(path))
+	c.State = Moving
+	c.GoalTimestamp = goalTimestamp
+	c.setTrajectory(c.MovementPlanner.CalculateWaypointTrajectory(c.CurrentTrajectory.GetCurrentState(), path))
+	c.Metrics.RecordGoalOutcome(path[len(path)-1].Position, true, false)
+	c.Metrics.RecordMovementStart()
+}
+
+// planArrivingBy plans from a state to rest at end. With a deadline and from rest, the
+// movement is slowed down to arrive at the deadline, so that a neighbor's retreat
+// and the border moves line up with the requester's approach. A deadline that
+// cannot be met falls back to the time-optimal trajectory, and the time it arrives
+// at instead is returned so that the requester can be told.
+func (c *Controller) planArrivingBy(initial internalState, end float64, deadline time.Time) (*Trajectory, time.Time) {
+	if !deadline.IsZero() && math.Abs(initial.v) < 1e-9 && math.Abs(initial.a) < 1e-9 {
+		trajectory, err := c.MovementPlanner.CalculateTrajectoryArrivingAt(initial.p, end, deadline)
+		if err == nil {
+			c.logDebug("Moving to %.2f timed to arrive at %s", end, deadline.Format("15:04:05.000"))
+			return trajectory, time.Time{}
+		}
+		trajectory = c.MovementPlanner.CalculateTrajectoryFromState(initial, end)
+		arrival := trajectory.t0.Add(time.Duration(trajectory.state[7].t * float64(time.Second)))
+		c.logWarn("Moving to %.2f as fast as possible, arriving %v late: %v", end, arrival.Sub(deadline), err)
+		c.Metrics.RecordMissedDeadline()
+		return trajectory, arrival
+	}
+	return c.MovementPlanner.CalculateTrajectoryFromState(initial, end), time.Time{}
+}
+
+// borderDeadline is when the requester's movement would first cross the current
+// border's safety margin, which is when the neighbor must have made room. Forwarded
+// requests keep the original requester's deadline.
+func (c *Controller) borderDeadline(goal float64, path []Waypoint, start, end float64, originalRequest *Request) time.Time {
+	if originalRequest != nil {
+		return originalRequest.Deadline
+	}
+	var approach *Trajectory
+	if path != nil {
+		approach = c.MovementPlanner.CalculateWaypointTrajectory(c.CurrentTrajectory.GetCurrentState(), path)
+	} else {
+		approach = c.MovementPlanner.CalculateTrajectoryFromState(c.CurrentTrajectory.GetCurrentState(), goal)
+	}
+	limit := start - c.safetyMargin
+	if end < start {
+		limit = start + c.safetyMargin
+	}
+	if t, ok := approach.TimeToReach(limit); ok {
+		return approach.t0.Add(time.Duration(t * float64(time.Second)))
+	}
+	return time.Time{}
+}
+
+// requestDeadline is a request's deadline, zero without a request
+func requestDeadline(request *Request) time.Time {
+	if request == nil {
+		return time.Time{}
+	}
+	return request.Deadline
+}
+
+func (c *Controller) rejectGoal(goal float64, acceptState State) {
 	c.logWarn("Goal permanently rejected: %.2f", goal)
+	c.Metrics.RecordGoalOutcome(goal, false, acceptState == Avoiding)
 	c.State = Idle
 	// Notify goal manager that goal was rejected so it can send a new one
 	select {
@@ -421,11 +645,21 @@ func (c *Controller) rejectGoal(goal float64) {
 	}
 }
 
+// abandonGoal rejects a goal interrupted by an emergency stop, the stop itself
+// tells the goal manager once it is complete
+func (c *Controller) abandonGoal(goal float64, path []Waypoint, acceptState State) {
+	if path != nil {
+		goal = path[len(path)-1].Position
+	}
+	c.logWarn("Goal abandoned by emergency stop: %.2f", goal)
+	c.Metrics.RecordGoalOutcome(goal, false, acceptState == Avoiding)
+}
+
 func (c *Controller) postponeGoal(goal float64) {
 	c.logDebug("Goal postponed: %.2f", goal)
 }
 
-func (c *Controller) queueBorderMoveRequest(goal float64, goalTimestamp int64, acceptState State, oldRequestId *int64, originalRequest *Request, originalUpdateTrajectory func(*Trajectory), originalTrajectory *Trajectory, originalOutgoingResponse chan Response) {
+func (c *Controller) queueBorderMoveRequest(goal float64, goalTimestamp int64, acceptState State, oldRequestId *int64, originalRequest *Request, originalUpdateTrajectory func(*Trajectory), originalTrajectory *Trajectory, originalOutgoingResponse chan Response, path []Waypoint) {
 	c.logDebug("Goal out of bounds, queuing border move request: %.2f", goal)
 	c.State = Requesting
 
@@ -435,7 +669,11 @@ func (c *Controller) queueBorderMoveRequest(goal float64, goalTimestamp int64, a
 		if outgoing == nil {
 			c.logWarn("No neighbor available for border move request")
 			// No neighbor, reject request
-			c.rejectGoal(goal)
+			if path != nil {
+				c.rejectGoal(path[len(path)-1].Position, acceptState)
+			} else {
+				c.rejectGoal(goal, acceptState)
+			}
 			// If this was triggered by an original request, reject that request too
 			if originalRequest != nil && originalOutgoingResponse != nil {
 				c.rejectRequest(originalOutgoingResponse, *originalRequest)
@@ -455,11 +693,13 @@ func (c *Controller) queueBorderMoveRequest(goal float64, goalTimestamp int64, a
 				Type:                BORDER_MOVE,
 				ProposedBorderStart: start,
 				ProposedBorderEnd:   end,
+				Deadline:            c.borderDeadline(goal, path, start, end, originalRequest),
 			}
 			requestParameters := RequestParameters{
 				Goal:                     goal,
+				Path:                     path,
 				Request:                  request,
-				RetryTime:                time.Now().Add(1000 * time.Millisecond),
+				RetryTime:                c.clock.Now().Add(1000 * time.Millisecond),
 				AcceptState:              acceptState, // State to transition to if the request is accepted
 				OriginalRequest:          originalRequest,
 				OriginalUpdateTrajectory: originalUpdateTrajectory,
@@ -517,7 +757,7 @@ func (c *Controller) handleResponse(response Response, side Side) {
 	switch response.Type {
 	case ACCEPT:
 		c.logDebug("Processing ACCEPT response")
-		c.handleAcceptResponse(*requestParams, side)
+		c.handleAcceptResponse(*requestParams, side, response.ArrivesAt)
 	case REJECT:
 		c.logDebug("Processing REJECT response")
 		c.handleRejectResponse(*requestParams)
@@ -532,25 +772,38 @@ func (c *Controller) handleResponse(response Response, side Side) {
 	}
 }
 
-func (c *Controller) handleAcceptResponse(requestParams RequestParameters, side Side) {
+// handleAcceptResponse moves our border to meet the neighbor's. A neighbor that cannot
+// move its border by the deadline says when it will have, and ours arrives no sooner.
+func (c *Controller) handleAcceptResponse(requestParams RequestParameters, side Side, arrivesAt time.Time) {
 	c.logInfo("Border move request accepted")
+	deadline := requestParams.Request.Deadline
+	if arrivesAt.After(deadline) {
+		c.logWarn("Neighbor's border arrives %v after the deadline", arrivesAt.Sub(deadline))
+		deadline = arrivesAt
+	}
 	// Update the border trajectory based on the accepted request
 	if side == Left {
 		c.logDebug("Updating left border trajectory to %.2f", requestParams.Request.ProposedBorderEnd)
-		c.LeftBorderTrajectory = c.MovementPlanner.CalculatePointToPointTrajectory(
-			c.LeftBorderTrajectory.GetCurrentPosition(),
+		c.LeftBorderTrajectory, _ = c.planArrivingBy(
+			internalState{p: c.LeftBorderTrajectory.GetCurrentPosition()},
 			requestParams.Request.ProposedBorderEnd,
+			deadline,
 		)
 	} else {
 		c.logDebug("Updating right border trajectory to %.2f", requestParams.Request.ProposedBorderEnd)
-		c.RightBorderTrajectory = c.MovementPlanner.CalculatePointToPointTrajectory(
-			c.RightBorderTrajectory.GetCurrentPosition(),
+		c.RightBorderTrajectory, _ = c.planArrivingBy(
+			internalState{p: c.RightBorderTrajectory.GetCurrentPosition()},
 			requestParams.Request.ProposedBorderEnd,
+			deadline,
 		)
 	}
 
-	// Accept the goal and start moving towards it
-	c.acceptGoal(requestParams.Goal, requestParams.Request.RequestId, requestParams.AcceptState)
+	// A path may need the other border too, otherwise accept the goal and start moving towards it
+	if requestParams.Path != nil {
+		c.negotiatePath(requestParams.Path, requestParams.Request.RequestId)
+	} else {
+		c.acceptGoal(requestParams.Goal, requestParams.Request.RequestId, requestParams.AcceptState, requestDeadline(requestParams.OriginalRequest))
+	}
 
 	// If this was triggered by an original request, accept that request too
 	if requestParams.OriginalRequest != nil && requestParams.OriginalUpdateTrajectory != nil && requestParams.OriginalOutgoingResponse != nil {
@@ -562,7 +815,11 @@ func (c *Controller) handleAcceptResponse(requestParams RequestParameters, side
 func (c *Controller) handleRejectResponse(requestParams RequestParameters) {
 	c.logWarn("Border move request rejected")
 	// Reject the goal and stop moving
-	c.rejectGoal(requestParams.Goal)
+	if requestParams.Path != nil {
+		c.rejectGoal(requestParams.Path[len(requestParams.Path)-1].Position, requestParams.AcceptState)
+	} else {
+		c.rejectGoal(requestParams.Goal, requestParams.AcceptState)
+	}
 
 	// If this was triggered by an original request, reject that request too
 	if requestParams.OriginalRequest != nil && requestParams.OriginalOutgoingResponse != nil {
@@ -573,7 +830,7 @@ func (c *Controller) handleRejectResponse(requestParams RequestParameters) {
 
 func (c *Controller) handleWaitResponse(requestParams RequestParameters) {
 	c.logDebug("Border move request waiting for response")
-	requestParams.RetryTime = time.Now().Add(1000 * time.Millisecond) // Retry after 1000ms
+	requestParams.RetryTime = c.clock.Now().Add(1000 * time.Millisecond) // Retry after 1000ms
 	c.PendingRequests[requestParams.Request.RequestId] = &requestParams
 	c.postponeGoal(requestParams.Goal)
 
@@ -651,12 +908,13 @@ func (c *Controller) handleIncomingBorderMoveRequest(request Request, side Side)
 	}
 
 	if side == Left {
-		// Accept if the proposed border doesn't interfere with our current position + safety margin
+		// Accept if the proposed border doesn't interfere with our footprint + safety margin
 		// AND we don't have a conflicting request OR we should defer to them
 		// AND it doesn't create unsafe overlap
-		acceptImmediately := request.ProposedBorderEnd < c.CurrentTrajectory.end-c.safetyMargin && (!hasConflictingRequest || shouldDeferToNeighbor)
-		c.logDebug("Left border request: acceptImmediately=%v (proposed: %.2f, end: %.2f, safety: %.2f, conflict: %v, defer: %v)",
-			acceptImmediately, request.ProposedBorderEnd, c.CurrentTrajectory.end, c.safetyMargin, hasConflictingRequest, shouldDeferToNeighbor)
+		low, high := c.footprint()
+		acceptImmediately := request.ProposedBorderEnd < low-c.safetyMargin && (!hasConflictingRequest || shouldDeferToNeighbor)
+		c.logDebug("Left border request: acceptImmediately=%v (proposed: %.2f, footprint: [%.2f, %.2f], safety: %.2f, conflict: %v, defer: %v)",
+			acceptImmediately, request.ProposedBorderEnd, low, high, c.safetyMargin, hasConflictingRequest, shouldDeferToNeighbor)
 
 		// If we have a conflict and should defer, we need to stop our current movement first
 		if hasConflictingRequest && shouldDeferToNeighbor && (c.State == Moving || c.State == Avoiding) {
@@ -680,12 +938,13 @@ func (c *Controller) handleIncomingBorderMoveRequest(request Request, side Side)
 			)
 		}
 	} else {
-		// Accept if the proposed border doesn't interfere with our current position + safety margin
+		// Accept if the proposed border doesn't interfere with our footprint + safety margin
 		// AND we don't have a conflicting request OR we should defer to them
 		// AND it doesn't create unsafe overlap
-		acceptImmediately := request.ProposedBorderEnd > c.CurrentTrajectory.end+c.safetyMargin && (!hasConflictingRequest || shouldDeferToNeighbor)
-		c.logDebug("Right border request: acceptImmediately=%v (proposed: %.2f, end: %.2f, safety: %.2f, conflict: %v, defer: %v)",
-			acceptImmediately, request.ProposedBorderEnd, c.CurrentTrajectory.end, c.safetyMargin, hasConflictingRequest, shouldDeferToNeighbor)
+		low, high := c.footprint()
+		acceptImmediately := request.ProposedBorderEnd > high+c.safetyMargin && (!hasConflictingRequest || shouldDeferToNeighbor)
+		c.logDebug("Right border request: acceptImmediately=%v (proposed: %.2f, footprint: [%.2f, %.2f], safety: %.2f, conflict: %v, defer: %v)",
+			acceptImmediately, request.ProposedBorderEnd, low, high, c.safetyMargin, hasConflictingRequest, shouldDeferToNeighbor)
 
 		// If we have a conflict and should defer, we need to stop our current movement first
 		if hasConflictingRequest && shouldDeferToNeighbor && (c.State == Moving || c.State == Avoiding) {
@@ -755,11 +1014,11 @@ func (c *Controller) handleIncomingEmergencyStopRequest(request Request, side Si
 	if anticipateLeftExpansion {
 		// Temporarily simulate a goal that would require left expansion for coordination purposes
 		tempGoal := c.LeftBorderTrajectory.end - c.safetyMargin - 50 // Goal that would need left expansion
-		c.pendingGoalAfterStop = &tempGoal
+		c.pendingPathAfterStop = []Waypoint{{Position: tempGoal}}
 	} else if anticipateRightExpansion {
 		// Temporarily simulate a goal that would require right expansion for coordination purposes
 		tempGoal := c.RightBorderTrajectory.end + c.safetyMargin + 50 // Goal that would need right expansion
-		c.pendingGoalAfterStop = &tempGoal
+		c.pendingPathAfterStop = []Waypoint{{Position: tempGoal}}
 	}
 
 	// Perform our own emergency stop (which will check borders and send requests if needed)
@@ -768,7 +1027,7 @@ func (c *Controller) handleIncomingEmergencyStopRequest(request Request, side Si
 
 	// Clear the temporary goal since it was just for coordination
 	if anticipateLeftExpansion || anticipateRightExpansion {
-		c.pendingGoalAfterStop = nil
+		c.pendingPathAfterStop = nil
 	}
 }
 
@@ -790,9 +1049,10 @@ func (c *Controller) handleBorderMove(
 
 func (c *Controller) acceptRequest(updateTrajectory func(*Trajectory), originalTrajectory *Trajectory, outgoingResponse chan Response, request Request) {
 	c.logDebug("Accepting border move request ID %d (border end: %.2f)", request.RequestId, request.ProposedBorderEnd)
-	trajectory := c.MovementPlanner.CalculatePointToPointTrajectory(
-		originalTrajectory.GetCurrentPosition(),
+	trajectory, arrivesAt := c.planArrivingBy(
+		internalState{p: originalTrajectory.GetCurrentPosition()},
 		request.ProposedBorderEnd,
+		request.Deadline,
 	)
 	updateTrajectory(trajectory)
 	// Record response sent for message counting
@@ -800,6 +1060,7 @@ func (c *Controller) acceptRequest(updateTrajectory func(*Trajectory), originalT
 	outgoingResponse <- Response{
 		RequestId: request.RequestId,
 		Type:      ACCEPT,
+		ArrivesAt: arrivesAt,
 	}
 }
 
@@ -823,6 +1084,16 @@ func (c *Controller) postponeRequest(outgoingResponse chan Response, request Req
 	}
 }
 
+// footprint is the stretch of track the cart may still cover: where it is, where
+// it comes to rest if it brakes now and where its trajectory ends. Braking
+// distances depend on the deceleration limit and speed zones.
+func (c *Controller) footprint() (float64, float64) {
+	position := c.CurrentTrajectory.GetCurrentPosition()
+	stop := c.MovementPlanner.CalculateStoppingTrajectory(c.CurrentTrajectory).end
+	end := c.CurrentTrajectory.end
+	return min(position, stop, end), max(position, stop, end)
+}
+
 func (c *Controller) handleEmergencyStop() {
 	c.logInfo("Emergency stop initiated!")
 
@@ -855,11 +1126,9 @@ func (c *Controller) sendEmergencyStopRequestsAndWait() {
 	// Also check if we have a pending goal that would require border expansion
 	pendingGoalRequiresLeftExpansion := false
 	pendingGoalRequiresRightExpansion := false
-	if c.pendingGoalAfterStop != nil {
-		goal := *c.pendingGoalAfterStop
-		pendingGoalRequiresLeftExpansion = leftBorderEnd+c.safetyMargin >= goal
-		pendingGoalRequiresRightExpansion = rightBorderEnd-c.safetyMargin <= goal
-		c.logDebug("Pending goal %.2f expansion requirements: left=%v, right=%v", goal, pendingGoalRequiresLeftExpansion, pendingGoalRequiresRightExpansion)
+	if c.pendingPathAfterStop != nil {
+		pendingGoalRequiresLeftExpansion, pendingGoalRequiresRightExpansion = c.pathRequiresExpansion(c.pendingPathAfterStop)
+		c.logDebug("Pending goal %s expansion requirements: left=%v, right=%v", describePath(c.pendingPathAfterStop), pendingGoalRequiresLeftExpansion, pendingGoalRequiresRightExpansion)
 	}
 
 	// Only send requests to neighbors whose borders would be violated OR who we'll need for pending goal
@@ -868,7 +1137,7 @@ func (c *Controller) sendEmergencyStopRequestsAndWait() {
 
 	if (violatesLeftBorder || pendingGoalRequiresLeftExpansion) && c.OutgoingLeftRequest != nil {
 		c.logDebug("Sending emergency stop request to left neighbor")
-		requestId := time.Now().UnixNano()
+		requestId := c.nextRequestId()
 		emergencyStopRequest := Request{
 			RequestId: requestId,
 			Type:      EMERGENCY_STOP,
@@ -877,8 +1146,8 @@ func (c *Controller) sendEmergencyStopRequestsAndWait() {
 		// Store this as a pending request to track confirmations
 		requestParams := RequestParameters{
 			Request:     emergencyStopRequest,
-			RetryTime:   time.Now().Add(1000 * time.Millisecond), // Retry if no response
-			AcceptState: Stopping,                                // State to transition to when confirmed
+			RetryTime:   c.clock.Now().Add(1000 * time.Millisecond), // Retry if no response
+			AcceptState: Stopping,                                   // State to transition to when confirmed
 		}
 		c.PendingRequests[requestId] = &requestParams
 		// Record message sent for round trip time measurement
@@ -890,13 +1159,13 @@ func (c *Controller) sendEmergencyStopRequestsAndWait() {
 			c.logWarn("Stop position %.2f would violate left border at %.2f - requesting confirmation", finalStopPosition, leftBorderEnd)
 		}
 		if pendingGoalRequiresLeftExpansion {
-			c.logDebug("Pending goal %.2f will require left border expansion - requesting stop confirmation", *c.pendingGoalAfterStop)
+			c.logDebug("Pending goal %s will require left border expansion - requesting stop confirmation", describePath(c.pendingPathAfterStop))
 		}
 	}
 
 	if (violatesRightBorder || pendingGoalRequiresRightExpansion) && c.OutgoingRightRequest != nil {
 		c.logDebug("Sending emergency stop request to right neighbor")
-		requestId := time.Now().UnixNano()
+		requestId := c.nextRequestId()
 		emergencyStopRequest := Request{
 			RequestId: requestId,
 			Type:      EMERGENCY_STOP,
@@ -905,8 +1174,8 @@ func (c *Controller) sendEmergencyStopRequestsAndWait() {
 		// Store this as a pending request to track confirmations
 		requestParams := RequestParameters{
 			Request:     emergencyStopRequest,
-			RetryTime:   time.Now().Add(1000 * time.Millisecond), // Retry if no response
-			AcceptState: Stopping,                                // State to transition to when confirmed
+			RetryTime:   c.clock.Now().Add(1000 * time.Millisecond), // Retry if no response
+			AcceptState: Stopping,                                   // State to transition to when confirmed
 		}
 		c.PendingRequests[requestId] = &requestParams
 		// Record message sent for round trip time measurement
@@ -918,7 +1187,7 @@ func (c *Controller) sendEmergencyStopRequestsAndWait() {
 			c.logWarn("Stop position %.2f would violate right border at %.2f - requesting confirmation", finalStopPosition, rightBorderEnd)
 		}
 		if pendingGoalRequiresRightExpansion {
-			c.logDebug("Pending goal %.2f will require right border expansion - requesting stop confirmation", *c.pendingGoalAfterStop)
+			c.logDebug("Pending goal %s will require right border expansion - requesting stop confirmation", describePath(c.pendingPathAfterStop))
 		}
 	}
 
@@ -957,9 +1226,9 @@ func (c *Controller) executeEmergencyStop() {
 
 	// Transition to stopping state and stop the cart
 	c.State = Stopping
-	c.CurrentTrajectory = c.MovementPlanner.CalculateStoppingTrajectory(
+	c.setTrajectory(c.MovementPlanner.CalculateStoppingTrajectory(
 		c.CurrentTrajectory,
-	)
+	))
 
 	// Stop border movements if:
 	// 1. Our stop position would violate them, OR
@@ -984,11 +1253,15 @@ func (c *Controller) executeEmergencyStop() {
 		}
 	}
 
-	// Clear all pending requests except emergency stop confirmations
+	// Clear all pending requests except emergency stop confirmations. A goal of
+	// our own still waiting for a border is abandoned, and its answer ignored,
+	// so it is rejected here rather than left undecided.
 	newPendingRequests := make(map[int64]*RequestParameters)
 	for id, params := range c.PendingRequests {
 		if params.Request.Type == EMERGENCY_STOP {
 			newPendingRequests[id] = params
+		} else if params.OriginalRequest == nil {
+			c.abandonGoal(params.Goal, params.Path, params.AcceptState)
 		}
 	}
 	c.PendingRequests = newPendingRequests
@@ -1027,8 +1300,9 @@ func (c *Controller) tryToGiveWay(updateTrajectory func(*Trajectory), originalTr
 
 		if canAvoidImmediately {
 			c.logDebug("Accepting request - avoidance maneuver is within borders")
-			// Avoidance maneuver is immediately successful, accept the original request
-			c.handleGoalRequest(avoidanceGoal, Avoiding)
+			// Avoidance maneuver is immediately successful, accept the original request.
+			// The request is passed along only for its deadline, the goal needs no border move.
+			c.handleGoalRequestWithOriginal(avoidanceGoal, Avoiding, &request, nil, nil, nil)
 			c.acceptRequest(updateTrajectory, originalTrajectory, outgoingResponse, request)
 		} else {
 			c.logDebug("Need border expansion for avoidance - forwarding request")
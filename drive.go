@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DriveModel turns the force a controller commands into the force that moves
+// the cart. The physics loop calls Update once per integration step and uses
+// Force inside the integrator, so velocity-dependent effects are integrated
+// along with the motion.
+type DriveModel interface {
+	// Update advances the actuator by dt seconds with the latest command and returns the motor force
+	Update(command, dt float64) float64
+	// Force returns the net force on the cart for a motor force in the given state
+	Force(motorForce float64, state PhysicsState) float64
+}
+
+// DriveParameters describes a cart's motor and running gear. Zero values
+// disable the corresponding effect, so the zero value is an ideal drive.
+type DriveParameters struct {
+	CoulombFriction float64  `json:"coulombFriction,omitempty"` // Dry friction force opposing motion
+	ViscousFriction float64  `json:"viscousFriction,omitempty"` // Friction force per unit of velocity
+	MaxForce        float64  `json:"maxForce,omitempty"`        // Motor force limit
+	MaxForceRate    float64  `json:"maxForceRate,omitempty"`    // Motor force slew rate limit per second
+	TransportDelay  Duration `json:"transportDelay,omitempty"`  // Dead time between command and motor
+	DACResolution   float64  `json:"dacResolution,omitempty"`   // Smallest force step the command can express
+}
+
+// stictionVelocity is the speed below which Coulomb friction is scaled down,
+// a smooth stand-in for static friction that keeps the equations non-stiff
+const stictionVelocity = 0.05
+
+// drivePresets are named drive configurations selectable from the command line
+var drivePresets = map[string]DriveParameters{
+	"ideal": {},
+	"realistic": {
+		CoulombFriction: 5,
+		ViscousFriction: 0.1,
+		MaxForce:        150,
+		MaxForceRate:    3000,
+		TransportDelay:  Duration(5 * time.Millisecond),
+		DACResolution:   300.0 / 4096, // 12-bit DAC over the full force range
+	},
+}
+
+// getDrivePreset looks up a drive preset by name
+func getDrivePreset(name string) (DriveParameters, error) {
+	params, exists := drivePresets[name]
+	if !exists {
+		names := make([]string, 0, len(drivePresets))
+		for preset := range drivePresets {
+			names = append(names, preset)
+		}
+		sort.Strings(names)
+		return DriveParameters{}, fmt.Errorf("unknown drive preset %q (expected one of %s)", name, strings.Join(names, ", "))
+	}
+	return params, nil
+}
+
+// validate checks the parameters
+func (p DriveParameters) validate() error {
+	if p.CoulombFriction < 0 || p.ViscousFriction < 0 || p.MaxForce < 0 || p.MaxForceRate < 0 || p.TransportDelay < 0 || p.DACResolution < 0 {
+		return fmt.Errorf("drive parameters must not be negative")
+	}
+	return nil
+}
+
+// =====================================================
+// ACTUATOR DRIVE
+// =====================================================
+
+// delayedCommand is a command waiting out the transport delay
+type delayedCommand struct {
+	time    float64
+	command float64
+}
+
+// ActuatorDrive is a motor with quantized, delayed, rate- and force-limited
+// commands acting on a cart with Coulomb and viscous friction
+type ActuatorDrive struct {
+	params DriveParameters
+
+	time       float64          // Seconds of simulation the drive has seen
+	pending    []delayedCommand // Commands not yet through the transport delay
+	delayed    float64          // Command currently at the motor input
+	motorForce float64
+}
+
+// NewActuatorDrive creates a drive with the given parameters
+func NewActuatorDrive(params DriveParameters) *ActuatorDrive {
+	return &ActuatorDrive{params: params}
+}
+
+func (d *ActuatorDrive) Update(command, dt float64) float64 {
+	d.time += dt
+
+	// DAC quantization of the controller output
+	if d.params.DACResolution > 0 {
+		command = math.Round(command/d.params.DACResolution) * d.params.DACResolution
+	}
+
+	// Transport delay
+	delay := time.Duration(d.params.TransportDelay).Seconds()
+	if delay > 0 {
+		d.pending = append(d.pending, delayedCommand{time: d.time, command: command})
+		for len(d.pending) > 0 && d.pending[0].time <= d.time-delay+1e-9 {
+			d.delayed = d.pending[0].command
+			d.pending = d.pending[1:]
+		}
+	} else {
+		d.delayed = command
+	}
+
+	// Slew rate limit
+	target := d.delayed
+	if d.params.MaxForceRate > 0 {
+		maxChange := d.params.MaxForceRate * dt
+		target = d.motorForce + math.Max(-maxChange, math.Min(maxChange, target-d.motorForce))
+	}
+
+	// Force limit
+	if d.params.MaxForce > 0 {
+		target = math.Max(-d.params.MaxForce, math.Min(d.params.MaxForce, target))
+	}
+
+	d.motorForce = target
+	return d.motorForce
+}
+
+func (d *ActuatorDrive) Force(motorForce float64, state PhysicsState) float64 {
+	friction := d.params.ViscousFriction * state.Velocity
+	if d.params.CoulombFriction > 0 {
+		friction += d.params.CoulombFriction * math.Tanh(state.Velocity/stictionVelocity)
+	}
+	return motorForce - friction
+}
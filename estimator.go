@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StateEstimator fuses position measurements with the applied force into an
+// estimate of the cart's position, velocity and acceleration
+type StateEstimator interface {
+	// Update predicts to now with the force applied since the last update and corrects with the measurement
+	Update(now time.Time, measurement Measurement, force float64) Estimate
+	// Current returns the latest estimate
+	Current() Estimate
+}
+
+// Estimate is a state estimator's view of the cart
+type Estimate struct {
+	Position     float64
+	Velocity     float64
+	Acceleration float64
+	Residual     float64       // Last measurement minus the predicted position
+	Covariance   [3][3]float64 // Covariance of (position, velocity, acceleration), zero for fixed-gain filters
+}
+
+// EstimatorParameters selects and tunes a controller's state estimator
+type EstimatorParameters struct {
+	Type             string  `json:"type"`                       // "none", "kalman" or "alpha-beta"
+	ProcessNoise     float64 `json:"processNoise,omitempty"`     // Kalman: spectral density of the unmodelled jerk
+	MeasurementNoise float64 `json:"measurementNoise,omitempty"` // Kalman: standard deviation of the position measurement
+	Alpha            float64 `json:"alpha,omitempty"`            // Alpha-beta: position correction gain
+	Beta             float64 `json:"beta,omitempty"`             // Alpha-beta: velocity correction gain
+}
+
+// estimatorPresets are named estimator configurations selectable from the command line
+var estimatorPresets = map[string]EstimatorParameters{
+	"none":       {Type: "none"},
+	"kalman":     {Type: "kalman", ProcessNoise: 5000, MeasurementNoise: 0.1},
+	"alpha-beta": {Type: "alpha-beta", Alpha: 0.5, Beta: 0.15},
+}
+
+// getEstimatorPreset looks up an estimator preset by name
+func getEstimatorPreset(name string) (EstimatorParameters, error) {
+	params, exists := estimatorPresets[name]
+	if !exists {
+		names := make([]string, 0, len(estimatorPresets))
+		for preset := range estimatorPresets {
+			names = append(names, preset)
+		}
+		sort.Strings(names)
+		return EstimatorParameters{}, fmt.Errorf("unknown estimator preset %q (expected one of %s)", name, strings.Join(names, ", "))
+	}
+	return params, nil
+}
+
+// validate checks the parameters
+func (p EstimatorParameters) validate() error {
+	switch p.Type {
+	case "", "none":
+	case "kalman":
+		if p.ProcessNoise <= 0 || p.MeasurementNoise <= 0 {
+			return fmt.Errorf("kalman estimator needs positive process and measurement noise")
+		}
+	case "alpha-beta":
+		if p.Alpha <= 0 || p.Alpha > 1 || p.Beta <= 0 || p.Beta > 2 {
+			return fmt.Errorf("alpha-beta estimator needs 0 < alpha <= 1 and 0 < beta <= 2")
+		}
+	default:
+		return fmt.Errorf("unknown estimator type %q", p.Type)
+	}
+	return nil
+}
+
+// newStateEstimator creates the estimator the parameters describe, or nil for none
+func newStateEstimator(params EstimatorParameters, mass float64, now time.Time, position float64) StateEstimator {
+	switch params.Type {
+	case "kalman":
+		return NewKalmanEstimator(params.ProcessNoise, params.MeasurementNoise, mass, now, position)
+	case "alpha-beta":
+		return NewAlphaBetaEstimator(params.Alpha, params.Beta, mass, now, position)
+	default:
+		return nil
+	}
+}
+
+// =====================================================
+// KALMAN FILTER
+// =====================================================
+
+// KalmanEstimator is a constant-acceleration Kalman filter. The applied force
+// enters as a known input, the state's acceleration is the part the force does
+// not explain (friction, drive lag), modelled as driven by white jerk noise.
+type KalmanEstimator struct {
+	q    float64 // Jerk spectral density
+	r    float64 // Measurement variance
+	mass float64
+
+	x          [3]float64 // Position, velocity, unexplained acceleration
+	p          [3][3]float64
+	lastUpdate time.Time
+	lastSample time.Time // Time of the last measurement used, held samples are not fused twice
+	lastForce  float64
+	residual   float64
+
+	mu sync.Mutex
+}
+
+// NewKalmanEstimator creates a Kalman filter starting at rest at position
+func NewKalmanEstimator(processNoise, measurementNoise, mass float64, now time.Time, position float64) *KalmanEstimator {
+	r := measurementNoise * measurementNoise
+	return &KalmanEstimator{
+		q:          processNoise,
+		r:          r,
+		mass:       mass,
+		x:          [3]float64{position, 0, 0},
+		p:          [3][3]float64{{r, 0, 0}, {0, 1, 0}, {0, 0, 1}},
+		lastUpdate: now,
+		lastSample: now,
+	}
+}
+
+func (k *KalmanEstimator) Update(now time.Time, measurement Measurement, force float64) Estimate {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// Predict with the force that was applied since the last update
+	dt := now.Sub(k.lastUpdate).Seconds()
+	k.lastUpdate = now
+	if dt > 0 {
+		input := force / k.mass
+		a := k.x[2] + input
+		k.x[0] += k.x[1]*dt + 0.5*a*dt*dt
+		k.x[1] += a * dt
+
+		f := [3][3]float64{{1, dt, 0.5 * dt * dt}, {0, 1, dt}, {0, 0, 1}}
+		dt2, dt3 := dt*dt, dt*dt*dt
+		q := [3][3]float64{
+			{dt3 * dt2 / 20, dt2 * dt2 / 8, dt3 / 6},
+			{dt2 * dt2 / 8, dt3 / 3, dt2 / 2},
+			{dt3 / 6, dt2 / 2, dt},
+		}
+		fp := multiply3(f, k.p)
+		k.p = multiply3(fp, transpose3(f))
+		for i := range k.p {
+			for j := range k.p[i] {
+				k.p[i][j] += k.q * q[i][j]
+			}
+		}
+	}
+	k.lastForce = force
+
+	// Correct with the measurement unless it was already used. A delayed measurement
+	// is compared with the prediction at its own time, projected back from now.
+	if measurement.Time.After(k.lastSample) {
+		k.lastSample = measurement.Time
+		age := max(0, now.Sub(measurement.Time).Seconds())
+		h := [3]float64{1, -age, 0.5 * age * age}
+		predicted := h[0]*k.x[0] + h[1]*k.x[1] + h[2]*(k.x[2]+force/k.mass)
+		residual := measurement.Position - predicted
+
+		var ph [3]float64 // P Hᵀ
+		for i := range ph {
+			for j := range h {
+				ph[i] += k.p[i][j] * h[j]
+			}
+		}
+		s := h[0]*ph[0] + h[1]*ph[1] + h[2]*ph[2] + k.r
+		gain := [3]float64{ph[0] / s, ph[1] / s, ph[2] / s}
+		for i := range k.x {
+			k.x[i] += gain[i] * residual
+		}
+		// P = (I - K H) P, H P is the transpose of P Hᵀ
+		for i := range k.p {
+			for j := range k.p[i] {
+				k.p[i][j] -= gain[i] * ph[j]
+			}
+		}
+		k.residual = residual
+	}
+
+	return k.current()
+}
+
+func (k *KalmanEstimator) Current() Estimate {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.current()
+}
+
+func (k *KalmanEstimator) current() Estimate {
+	return Estimate{
+		Position:     k.x[0],
+		Velocity:     k.x[1],
+		Acceleration: k.x[2] + k.lastForce/k.mass,
+		Residual:     k.residual,
+		Covariance:   k.p,
+	}
+}
+
+func multiply3(a, b [3][3]float64) [3][3]float64 {
+	var result [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				result[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return result
+}
+
+func transpose3(a [3][3]float64) [3][3]float64 {
+	var result [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			result[i][j] = a[j][i]
+		}
+	}
+	return result
+}
+
+// =====================================================
+// ALPHA-BETA FILTER
+// =====================================================
+
+// AlphaBetaEstimator predicts with the applied force and corrects position and
+// velocity with fixed gains. Its acceleration estimate is the force over mass.
+type AlphaBetaEstimator struct {
+	alpha, beta float64
+	mass        float64
+
+	position, velocity float64
+	lastUpdate         time.Time
+	lastSample         time.Time
+	lastForce          float64
+	residual           float64
+
+	mu sync.Mutex
+}
+
+// NewAlphaBetaEstimator creates an alpha-beta filter starting at rest at position
+func NewAlphaBetaEstimator(alpha, beta, mass float64, now time.Time, position float64) *AlphaBetaEstimator {
+	return &AlphaBetaEstimator{
+		alpha:      alpha,
+		beta:       beta,
+		mass:       mass,
+		position:   position,
+		lastUpdate: now,
+		lastSample: now,
+	}
+}
+
+func (f *AlphaBetaEstimator) Update(now time.Time, measurement Measurement, force float64) Estimate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dt := now.Sub(f.lastUpdate).Seconds()
+	f.lastUpdate = now
+	a := force / f.mass
+	if dt > 0 {
+		f.position += f.velocity*dt + 0.5*a*dt*dt
+		f.velocity += a * dt
+	}
+	f.lastForce = force
+
+	// A delayed measurement is compared with the prediction at its own time
+	if measurement.Time.After(f.lastSample) {
+		interval := measurement.Time.Sub(f.lastSample).Seconds()
+		f.lastSample = measurement.Time
+		age := max(0, now.Sub(measurement.Time).Seconds())
+		f.residual = measurement.Position - (f.position - f.velocity*age + 0.5*a*age*age)
+		f.position += f.alpha * f.residual
+		f.velocity += f.beta / interval * f.residual
+	}
+
+	return f.current()
+}
+
+func (f *AlphaBetaEstimator) Current() Estimate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.current()
+}
+
+func (f *AlphaBetaEstimator) current() Estimate {
+	return Estimate{
+		Position:     f.position,
+		Velocity:     f.velocity,
+		Acceleration: f.lastForce / f.mass,
+		Residual:     f.residual,
+	}
+}
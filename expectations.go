@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Expectation is a pass/fail condition a scenario declares about its own run.
+// During is checked on every monitoring tick while the scenario runs, AtEnd once
+// after it finishes. Either may be nil.
+type Expectation struct {
+	Description string
+	During      func(sm *ScenarioManager) error
+	AtEnd       func(sm *ScenarioManager) error
+}
+
+// expectationCheckInterval is how often During checks run
+const expectationCheckInterval = 10 * time.Millisecond
+
+// finalPositionTolerance is how close a cart must end to its expected position by default
+const finalPositionTolerance = 1.0
+
+// borderOverlapTolerance allows for rounding when comparing neighbouring borders
+const borderOverlapTolerance = 0.01
+
+// goalMatchTolerance is how close a recorded goal must be to the expected one
+const goalMatchTolerance = 1e-6
+
+// expect registers expectations for the scenario that is currently running
+func (sm *ScenarioManager) expect(expectations ...Expectation) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.expectations = append(sm.expectations, expectations...)
+}
+
+// resetExpectations clears the expectations and failures of the previous scenario
+func (sm *ScenarioManager) resetExpectations() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.expectations = nil
+	sm.expectationFailures = nil
+}
+
+// recordExpectationFailure stores the first failure of each expectation
+func (sm *ScenarioManager) recordExpectationFailure(index int, err error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.expectationFailures == nil {
+		sm.expectationFailures = make(map[int]string)
+	}
+	if _, exists := sm.expectationFailures[index]; !exists {
+		sm.expectationFailures[index] = fmt.Sprintf("%s: %v", sm.expectations[index].Description, err)
+	}
+}
+
+// monitorExpectations runs the During checks until stop is closed
+func (sm *ScenarioManager) monitorExpectations(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := sm.clock.NewTicker(expectationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			sm.mu.RLock()
+			expectations := make([]Expectation, len(sm.expectations))
+			copy(expectations, sm.expectations)
+			sm.mu.RUnlock()
+
+			for i, expectation := range expectations {
+				if expectation.During == nil {
+					continue
+				}
+				if err := expectation.During(sm); err != nil {
+					sm.recordExpectationFailure(i, err)
+				}
+			}
+		}
+	}
+}
+
+// evaluateExpectations runs the AtEnd checks and returns every failure as one error
+func (sm *ScenarioManager) evaluateExpectations() error {
+	sm.mu.RLock()
+	expectations := make([]Expectation, len(sm.expectations))
+	copy(expectations, sm.expectations)
+	sm.mu.RUnlock()
+
+	for i, expectation := range expectations {
+		if expectation.AtEnd == nil {
+			continue
+		}
+		if err := expectation.AtEnd(sm); err != nil {
+			sm.recordExpectationFailure(i, err)
+		}
+	}
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	if len(sm.expectationFailures) == 0 {
+		return nil
+	}
+	failures := make([]string, 0, len(sm.expectationFailures))
+	for i := range sm.expectations {
+		if failure, exists := sm.expectationFailures[i]; exists {
+			failures = append(failures, failure)
+		}
+	}
+	return fmt.Errorf("%s", strings.Join(failures, "; "))
+}
+
+// =====================================================
+// EXPECTATIONS
+// =====================================================
+
+// controllerAt returns the controller for a cart index, or an error if it does not exist
+func (sm *ScenarioManager) controllerAt(cart int) (*Controller, error) {
+	controllers := sm.controllers
+	if cart < 0 || cart >= len(controllers) || controllers[cart] == nil {
+		return nil, fmt.Errorf("cart %d does not exist", cart+1)
+	}
+	return controllers[cart], nil
+}
+
+// ExpectNoCollision fails if any two carts overlap at any time
+func ExpectNoCollision() Expectation {
+	return Expectation{
+		Description: "no collision",
+		During: func(sm *ScenarioManager) error {
+			// The physics loop records every contact as it happens, the carts
+			// themselves are its to read
+			if collisions := sm.GetCollisions(); len(collisions) > 0 {
+				return fmt.Errorf("%s", collisions[0])
+			}
+			return nil
+		},
+	}
+}
+
+// ExpectNoBorderOverlap fails if a cart's right border ever passes its right neighbour's left border
+func ExpectNoBorderOverlap(tolerance float64) Expectation {
+	return Expectation{
+		Description: "no border overlap",
+		During: func(sm *ScenarioManager) error {
+			sm.mu.RLock()
+			controllers := sm.controllers
+			sm.mu.RUnlock()
+			for i := 0; i+1 < len(controllers); i++ {
+				// The controllers replace their borders as they run, so read what they published
+				rightBorder, leftBorder := controllers[i].publishedState().right, controllers[i+1].publishedState().left
+				if rightBorder == nil || leftBorder == nil {
+					continue // Not published yet
+				}
+				right, left := rightBorder.GetCurrentPosition(), leftBorder.GetCurrentPosition()
+				if right > left+tolerance {
+					return fmt.Errorf("cart %d right border %.2f is past cart %d left border %.2f", i+1, right, i+2, left)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// ExpectFinalPosition fails if the cart does not end within tolerance of position
+func ExpectFinalPosition(cart int, position, tolerance float64) Expectation {
+	return Expectation{
+		Description: fmt.Sprintf("cart %d ends at %.2f", cart+1, position),
+		AtEnd: func(sm *ScenarioManager) error {
+			controller, err := sm.controllerAt(cart)
+			if err != nil {
+				return err
+			}
+			actual := controller.Cart.Position
+			if math.Abs(actual-position) > tolerance {
+				return fmt.Errorf("final position %.2f is not within %.2f of %.2f", actual, tolerance, position)
+			}
+			return nil
+		},
+	}
+}
+
+// ExpectFinalPositionBetween fails if the cart does not end inside [min, max]
+func ExpectFinalPositionBetween(cart int, min, max float64) Expectation {
+	return Expectation{
+		Description: fmt.Sprintf("cart %d ends between %.2f and %.2f", cart+1, min, max),
+		AtEnd: func(sm *ScenarioManager) error {
+			controller, err := sm.controllerAt(cart)
+			if err != nil {
+				return err
+			}
+			actual := controller.Cart.Position
+			if actual < min || actual > max {
+				return fmt.Errorf("final position %.2f is outside [%.2f, %.2f]", actual, min, max)
+			}
+			return nil
+		},
+	}
+}
+
+// expectGoalOutcome checks the last decision the cart made on a requested goal
+func expectGoalOutcome(cart int, goal float64, accepted bool) Expectation {
+	verb := map[bool]string{true: "accepted", false: "rejected"}[accepted]
+	return Expectation{
+		Description: fmt.Sprintf("cart %d goal %.2f %s", cart+1, goal, verb),
+		AtEnd: func(sm *ScenarioManager) error {
+			controller, err := sm.controllerAt(cart)
+			if err != nil {
+				return err
+			}
+			var outcome *GoalOutcome
+			for _, recorded := range controller.Metrics.GetGoalOutcomes() {
+				if !recorded.Avoidance && math.Abs(recorded.Goal-goal) < goalMatchTolerance {
+					outcome = &recorded
+				}
+			}
+			if outcome == nil {
+				return fmt.Errorf("goal was never decided")
+			}
+			if outcome.Accepted != accepted {
+				return fmt.Errorf("goal was %s", map[bool]string{true: "accepted", false: "rejected"}[outcome.Accepted])
+			}
+			return nil
+		},
+	}
+}
+
+// ExpectGoalAccepted fails unless the cart's last decision on goal was to accept it
+func ExpectGoalAccepted(cart int, goal float64) Expectation {
+	return expectGoalOutcome(cart, goal, true)
+}
+
+// ExpectGoalRejected fails unless the cart's last decision on goal was to reject it
+func ExpectGoalRejected(cart int, goal float64) Expectation {
+	return expectGoalOutcome(cart, goal, false)
+}
+
+// ExpectMaxTrackingError fails if the cart ever strayed further than limit from its planned position
+func ExpectMaxTrackingError(cart int, limit float64) Expectation {
+	return Expectation{
+		Description: fmt.Sprintf("cart %d tracks within %.2f", cart+1, limit),
+		AtEnd: func(sm *ScenarioManager) error {
+			controller, err := sm.controllerAt(cart)
+			if err != nil {
+				return err
+			}
+			if largest := controller.Metrics.GetMaxTrackingError(); largest > limit {
+				return fmt.Errorf("tracking error reached %.2f", largest)
+			}
+			return nil
+		},
+	}
+}
+
+// ExpectValidTrajectories fails if any controller planned a trajectory that failed validation
+func ExpectValidTrajectories() Expectation {
+	return Expectation{
+		Description: "valid trajectories",
+		AtEnd: func(sm *ScenarioManager) error {
+			for i, controller := range sm.controllers {
+				if count := controller.Metrics.GetInvalidTrajectoryCount(); count > 0 {
+					return fmt.Errorf("cart %d planned %d invalid trajectories", i+1, count)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// ExpectMaxNegotiationTime fails if any goal of the cart took longer than limit from receipt to movement
+func ExpectMaxNegotiationTime(cart int, limit time.Duration) Expectation {
+	return Expectation{
+		Description: fmt.Sprintf("cart %d negotiates within %v", cart+1, limit),
+		AtEnd: func(sm *ScenarioManager) error {
+			controller, err := sm.controllerAt(cart)
+			if err != nil {
+				return err
+			}
+			if longest := controller.Metrics.GetMaxGoalToMovementDelay(); longest > limit {
+				return fmt.Errorf("negotiation took %v", longest)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"time"
+)
+
+// =====================================================
+// PROTOCOL EXPLORATION
+// =====================================================
+
+// ExplorationOptions bound the interleavings explored for one scenario
+type ExplorationOptions struct {
+	Scenario          string
+	ScenarioDirectory string
+	Depth             int           // Decisions that branch per run, later ones deliver the oldest message
+	Losses            int           // Messages one run may lose
+	Waits             int           // Times one run may hold every message while Wait passes, so timers fire first
+	Wait              time.Duration // How long a wait holds the messages
+	Step              time.Duration // Time that passes between decisions while no message is held
+	Settle            time.Duration // Time after the timeline for every goal to be decided
+	MaxRuns           int
+	Seed              uint64
+	Verbose           bool // Keep the controller logs
+}
+
+// ExplorationChoice is one decision of the scheduler. Messages are named by
+// their content, so a trace replays even if their queue ids differ.
+type ExplorationChoice struct {
+	Time      float64 `json:"time"`      // Seconds since the run started
+	Operation string  `json:"operation"` // "deliver", "drop" or "wait"
+	Link      int     `json:"link,omitempty"`
+	Direction string  `json:"direction,omitempty"`
+	Kind      string  `json:"kind,omitempty"`
+	Summary   string  `json:"summary,omitempty"`
+}
+
+func (c ExplorationChoice) String() string {
+	if c.Operation == "wait" {
+		return fmt.Sprintf("%7.3fs wait", c.Time)
+	}
+	return fmt.Sprintf("%7.3fs %-7s link %d, %s: %s", c.Time, c.Operation, c.Link, c.Direction, c.Summary)
+}
+
+// sameMessage reports whether a choice names a held message
+func (c ExplorationChoice) sameMessage(message HeldMessage) bool {
+	return c.Link == message.Link && c.Direction == message.Direction && c.Kind == message.Kind && c.Summary == message.Summary
+}
+
+// ExplorationTrace is one explored run. Traces that violate an invariant are
+// written out and can be replayed with explore -replay.
+type ExplorationTrace struct {
+	Scenario  string              `json:"scenario"`
+	Seed      uint64              `json:"seed"`
+	Step      Duration            `json:"step"`
+	Wait      Duration            `json:"wait"`
+	Settle    Duration            `json:"settle"`
+	Choices   []ExplorationChoice `json:"choices"`
+	Violation string              `json:"violation,omitempty"`
+}
+
+// ExplorationResult summarizes an exploration
+type ExplorationResult struct {
+	Runs       int
+	Complete   bool              // Every interleaving within the bounds was run
+	Violations int               // Runs stop at the first one
+	Trace      *ExplorationTrace // The violating run, if any
+}
+
+// chooser picks one of the choices at a decision point, given how many decisions came before
+type chooser func(decision int, choices []ExplorationChoice) (int, error)
+
+// explorationDefinition returns a copy of a scenario in which the scheduler is
+// the whole network: every link is manual, and the scenario's own delays,
+// faults, network changes and message steps are left out
+func explorationDefinition(definition *ScenarioDefinition) (*ScenarioDefinition, error) {
+	data, err := json.Marshal(definition)
+	if err != nil {
+		return nil, err
+	}
+	explored := &ScenarioDefinition{}
+	if err := json.Unmarshal(data, explored); err != nil {
+		return nil, err
+	}
+	explored.Network = &NetworkSpec{LinkSpec: linkSpec(defaultNetworkConfig().LinkConfig)}
+	explored.Network.Manual = true
+	explored.Faults = nil
+	explored.Expectations = nil
+	explored.Timeline = slices.DeleteFunc(explored.Timeline, func(action ScenarioAction) bool {
+		return action.Action == "network" || action.Action == "message"
+	})
+	return explored, nil
+}
+
+// explorationChoices lists what the scheduler may do next: deliver any held
+// message, drop one while losses are left, or wait while waits are left. The
+// first choice delivers the oldest message, as a well-behaved network would.
+// Copies of the same message, like retries, are one choice.
+func explorationChoices(held []HeldMessage, lossesLeft, waitsLeft bool) []ExplorationChoice {
+	slices.SortStableFunc(held, func(a, b HeldMessage) int {
+		return cmp.Or(a.HeldAt.Compare(b.HeldAt), cmp.Compare(a.Link, b.Link), cmp.Compare(a.Direction, b.Direction),
+			cmp.Compare(a.Kind, b.Kind), cmp.Compare(a.Summary, b.Summary))
+	})
+	var messages []ExplorationChoice
+	for _, message := range held {
+		choice := ExplorationChoice{Link: message.Link, Direction: message.Direction, Kind: message.Kind, Summary: message.Summary}
+		if !slices.ContainsFunc(messages, func(c ExplorationChoice) bool { return c.sameMessage(message) }) {
+			messages = append(messages, choice)
+		}
+	}
+
+	var choices []ExplorationChoice
+	for _, choice := range messages {
+		choice.Operation = "deliver"
+		choices = append(choices, choice)
+	}
+	if lossesLeft {
+		for _, choice := range messages {
+			choice.Operation = "drop"
+			choices = append(choices, choice)
+		}
+	}
+	if waitsLeft {
+		choices = append(choices, ExplorationChoice{Operation: "wait"})
+	}
+	return choices
+}
+
+// checkSafety returns the first safety invariant the carts violate: a collision
+// or an alarm of the safety monitor
+func checkSafety(sm *ScenarioManager) error {
+	if err := ExpectNoCollision().During(sm); err != nil {
+		return fmt.Errorf("collision: %w", err)
+	}
+	if alarms := sm.GetSafetyAlarms(); len(alarms) > 0 {
+		return fmt.Errorf("safety alarm: %s", alarms[0])
+	}
+	return nil
+}
+
+// checkLiveness returns the first goal of the timeline that was never decided,
+// or a controller still waiting for a neighbour
+func checkLiveness(sm *ScenarioManager, definition *ScenarioDefinition) error {
+	sm.mu.RLock()
+	controllers := sm.controllers
+	sm.mu.RUnlock()
+	for _, action := range definition.Timeline {
+		goal := action.Position
+		switch action.Action {
+		case "goal":
+		case "path":
+			goal = action.Waypoints[len(action.Waypoints)-1].Position
+		default:
+			continue
+		}
+		decided := slices.ContainsFunc(controllers[action.Cart-1].Metrics.GetGoalOutcomes(), func(outcome GoalOutcome) bool {
+			return !outcome.Avoidance && math.Abs(outcome.Goal-goal) < goalMatchTolerance
+		})
+		if !decided {
+			return fmt.Errorf("cart %d goal %.2f was never decided", action.Cart, goal)
+		}
+	}
+	for i, controller := range controllers {
+		if controller.publishedState().state == Requesting {
+			return fmt.Errorf("cart %d is still requesting", i+1)
+		}
+	}
+	return nil
+}
+
+// exploreRun runs a scenario once on a fresh simulated clock, holding every
+// message until choose decides what happens to it. It returns the choices made,
+// how many there were at each of the first depth decisions, and the first
+// invariant violated.
+func exploreRun(definition *ScenarioDefinition, options ExplorationOptions, choose chooser) ([]ExplorationChoice, []int, error) {
+	clock := NewSimulatedClock()
+	randomControlChannel := make(chan ControlMessage, 10)
+	sm := NewScenarioManager(nil, nil, nil, defaultCarts(), randomControlChannel, nil, clock)
+	sm.seed = options.Seed
+	if !options.Verbose {
+		sm.logOutput = io.Discard
+	}
+
+	go physics_loop(sm, defaultPhysicsConfig())
+	done := make(chan error, 1)
+	go func() {
+		done <- sm.runDefinition(definition)
+	}()
+
+	// Everything the run started stops with it, so that many runs fit in memory
+	defer func() {
+		close(sm.physicsExitChannel)
+		close(randomControlChannel) // Ends the goal manager
+		sm.stopAllControllers()
+		clock.Advance(options.Step)
+	}()
+
+	var choices []ExplorationChoice
+	var counts []int
+	losses, waits := options.Losses, options.Waits
+	start := clock.Now()
+	var settleUntil time.Time
+
+	for settleUntil.IsZero() || clock.Now().Before(settleUntil) {
+		select {
+		case err := <-done:
+			if err != nil {
+				return choices, counts, fmt.Errorf("timeline failed: %w", err)
+			}
+			settleUntil = clock.Now().Add(options.Settle)
+		default:
+		}
+		if err := checkSafety(sm); err != nil {
+			return choices, counts, err
+		}
+
+		held := sm.messageQueue.Messages()
+		if len(held) == 0 {
+			clock.Advance(options.Step)
+			continue
+		}
+
+		available := explorationChoices(held, losses > 0, waits > 0)
+		index, err := choose(len(choices), available)
+		if err != nil {
+			return choices, counts, err
+		}
+		if len(choices) < options.Depth {
+			counts = append(counts, len(available))
+		}
+		choice := available[index]
+		choice.Time = clock.Since(start).Seconds()
+		choices = append(choices, choice)
+
+		switch choice.Operation {
+		case "wait":
+			waits--
+			clock.Advance(options.Wait)
+			continue
+		case "drop":
+			losses--
+		}
+		id := slices.IndexFunc(held, choice.sameMessage)
+		if err := sm.messageQueue.apply(choice.Operation, held[id].Id, 0); err != nil {
+			return choices, counts, err
+		}
+		clock.Advance(0)
+	}
+	return choices, counts, checkLiveness(sm, definition)
+}
+
+// explore runs a scenario under every interleaving within the bounds, depth
+// first, until one violates an invariant. Each run replays the choices of the
+// previous one up to its last decision with an untried choice left.
+func explore(options ExplorationOptions, progress func(run int, choices []ExplorationChoice, err error)) (ExplorationResult, error) {
+	definition, err := loadExplorationScenario(options.Scenario, options.ScenarioDirectory)
+	if err != nil {
+		return ExplorationResult{}, err
+	}
+
+	result := ExplorationResult{}
+	var prefix []int
+	for result.Runs < options.MaxRuns {
+		var taken []int
+		choices, counts, err := exploreRun(definition, options, func(decision int, choices []ExplorationChoice) (int, error) {
+			index := 0
+			if decision < len(prefix) {
+				index = prefix[decision]
+			}
+			if decision < options.Depth {
+				taken = append(taken, index)
+			}
+			return index, nil
+		})
+		result.Runs++
+		progress(result.Runs, choices, err)
+		if err != nil {
+			result.Violations++
+			result.Trace = &ExplorationTrace{
+				Scenario:  options.Scenario,
+				Seed:      options.Seed,
+				Step:      Duration(options.Step),
+				Wait:      Duration(options.Wait),
+				Settle:    Duration(options.Settle),
+				Choices:   choices,
+				Violation: err.Error(),
+			}
+			return result, nil
+		}
+
+		// Backtrack to the last decision with a choice left
+		next := len(taken) - 1
+		for next >= 0 && taken[next]+1 >= counts[next] {
+			next--
+		}
+		if next < 0 {
+			result.Complete = true
+			return result, nil
+		}
+		prefix = append(taken[:next:next], taken[next]+1)
+	}
+	return result, nil
+}
+
+// replay runs a trace's choices again, then delivers the oldest message like explore does
+func replay(trace ExplorationTrace, scenarioDirectory string, verbose bool) ([]ExplorationChoice, error) {
+	definition, err := loadExplorationScenario(trace.Scenario, scenarioDirectory)
+	if err != nil {
+		return nil, err
+	}
+	options := ExplorationOptions{
+		Step:    time.Duration(trace.Step),
+		Wait:    time.Duration(trace.Wait),
+		Settle:  time.Duration(trace.Settle),
+		Seed:    trace.Seed,
+		Losses:  len(trace.Choices),
+		Waits:   len(trace.Choices),
+		Verbose: verbose,
+	}
+	choices, _, err := exploreRun(definition, options, func(decision int, choices []ExplorationChoice) (int, error) {
+		if decision >= len(trace.Choices) {
+			return 0, nil
+		}
+		recorded := trace.Choices[decision]
+		index := slices.IndexFunc(choices, func(c ExplorationChoice) bool {
+			return c.Operation == recorded.Operation && c.Link == recorded.Link && c.Direction == recorded.Direction &&
+				c.Kind == recorded.Kind && c.Summary == recorded.Summary
+		})
+		if index < 0 {
+			return 0, fmt.Errorf("trace diverged at decision %d: %s is not possible", decision+1, recorded)
+		}
+		if verbose {
+			fmt.Println(choices[index].String())
+		}
+		return index, nil
+	})
+	return choices, err
+}
+
+// loadExplorationScenario loads a scenario by name and prepares it for exploration
+func loadExplorationScenario(name, scenarioDirectory string) (*ScenarioDefinition, error) {
+	sm := NewScenarioManager(nil, nil, nil, defaultCarts(), make(chan ControlMessage, 10), nil, NewSimulatedClock())
+	if err := sm.LoadScenarioDirectory(scenarioDirectory); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	definition, exists := sm.definitions[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown scenario: %s", name)
+	}
+	if len(definition.Carts) < 2 || len(definition.Carts) > 4 {
+		return nil, fmt.Errorf("scenario %s has %d carts, exploration needs 2 to 4", name, len(definition.Carts))
+	}
+	return explorationDefinition(definition)
+}
+
+// runExplore is the explore subcommand: it explores the message interleavings
+// of a scenario, or replays a trace
+func runExplore(args []string) int {
+	flags := flag.NewFlagSet("explore", flag.ContinueOnError)
+	depth := flags.Int("depth", 8, "decisions that branch per run, later ones deliver the oldest message")
+	losses := flags.Int("losses", 1, "messages one run may lose")
+	waits := flags.Int("waits", 1, "times one run may hold every message while -wait passes")
+	wait := flags.Duration("wait", time.Second, "how long a wait holds the messages, the retry interval by default")
+	step := flags.Duration("step", 10*time.Millisecond, "time that passes between decisions while no message is held")
+	settle := flags.Duration("settle", 5*time.Second, "time after the timeline for every goal to be decided")
+	maxRuns := flags.Int("max-runs", 1000, "stop after this many runs")
+	seed := flags.Uint64("seed", 1, "seed for the simulation")
+	scenarioDirectory := flags.String("scenarios", defaultScenarioDirectory, "directory with additional scenario files")
+	tracePath := flags.String("trace", "exploration_trace.json", "write a violating run to this file")
+	replayPath := flags.String("replay", "", "replay a trace written by an earlier exploration instead of exploring")
+	verbose := flags.Bool("verbose", false, "print every run's choices, and scenario and controller logs")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gocart explore [flags] scenario\n       gocart explore -replay trace.json [-verbose]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *replayPath == "" && flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if *depth < 0 || *losses < 0 || *waits < 0 || *wait <= 0 || *step <= 0 || *settle < 0 || *maxRuns < 1 {
+		fmt.Fprintln(os.Stderr, "bounds must not be negative, and wait, step and max-runs must be positive")
+		return 2
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	if *replayPath != "" {
+		data, err := os.ReadFile(*replayPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 2
+		}
+		var trace ExplorationTrace
+		if err := json.Unmarshal(data, &trace); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid trace: %v\n", err)
+			return 2
+		}
+		fmt.Printf("Replaying %d choices in %q\n", len(trace.Choices), trace.Scenario)
+		if _, err := replay(trace, *scenarioDirectory, *verbose); err != nil {
+			fmt.Printf("VIOLATED  %v\n", err)
+			return 1
+		}
+		fmt.Println("No invariant was violated")
+		return 0
+	}
+
+	options := ExplorationOptions{
+		Scenario:          flags.Arg(0),
+		ScenarioDirectory: *scenarioDirectory,
+		Depth:             *depth,
+		Losses:            *losses,
+		Waits:             *waits,
+		Wait:              *wait,
+		Step:              *step,
+		Settle:            *settle,
+		MaxRuns:           *maxRuns,
+		Seed:              *seed,
+		Verbose:           *verbose,
+	}
+	wallStart := time.Now()
+	result, err := explore(options, func(run int, choices []ExplorationChoice, err error) {
+		if *verbose {
+			fmt.Printf("Run %d, %d choices\n", run, len(choices))
+			for _, choice := range choices {
+				fmt.Println("  " + choice.String())
+			}
+		} else if run%50 == 0 {
+			fmt.Printf("%d runs\n", run)
+		}
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	coverage := "every interleaving within the bounds"
+	if !result.Complete {
+		coverage = "stopped before every interleaving within the bounds"
+	}
+	fmt.Printf("%d runs in %.1fs, %s\n", result.Runs, time.Since(wallStart).Seconds(), coverage)
+	if result.Trace == nil {
+		fmt.Println("No invariant was violated")
+		return 0
+	}
+
+	fmt.Printf("VIOLATED  %s\n", result.Trace.Violation)
+	for _, choice := range result.Trace.Choices {
+		fmt.Println("  " + choice.String())
+	}
+	data, err := json.MarshalIndent(result.Trace, "", "  ")
+	if err == nil {
+		err = os.WriteFile(*tracePath, data, 0o644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing trace: %v\n", err)
+		return 2
+	}
+	fmt.Printf("Trace written to %s, replay it with: gocart explore -replay %s\n", *tracePath, *tracePath)
+	return 1
+}
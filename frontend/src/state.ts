@@ -13,6 +13,13 @@ export type SocketData = {
   position: number;
   timestamp: string;
 
+  // What the controller measures through the cart's sensor
+  measuredPosition: number;
+  measuredVelocity: number;
+
+  // State estimator output, when the controller has one
+  estimator?: EstimatorReport;
+
   leftBorder: number;
   rightBorder: number;
   goal: number;
@@ -29,6 +36,14 @@ export type SocketData = {
   metrics: MessageMetricsReport;
 };
 
+export type EstimatorReport = {
+  position: number;
+  velocity: number;
+  acceleration: number;
+  residual: number; // Last measurement minus the predicted position
+  covariance: number[][]; // Of position, velocity and acceleration
+};
+
 export type MessageMetricsReport = {
   averageRoundTripTime: number; // in nanoseconds
   averageGoalToMovementTime: number; // in nanoseconds
@@ -36,11 +51,62 @@ export type MessageMetricsReport = {
   scenarioMessageCount: number;
   roundTripTimeCount: number;
   goalToMovementCount: number;
+  trackingErrorRms: number; // planned minus actual position while moving
+  maxTrackingError: number;
+  controlEffort: number; // integral of force squared
+  mechanicalEnergy: number; // integral of |force * velocity|
+};
+
+export type ControllerSnapshot = {
+  cartId: number;
+  state: string;
+  position: number;
+  velocity: number;
+  setpoint: number;
+  goal: number;
+  leftBorder: number;
+  rightBorder: number;
+  stopPosition: number; // Where the cart would come to rest if it braked now
 };
 
+export type CollisionEvent = {
+  time: string;
+  cartA: number;
+  cartB: number;
+  position: number;
+  relativeSpeed: number;
+  policy: CollisionPolicy;
+  controllers: ControllerSnapshot[];
+};
+
+export type SafetyInvariant = 'containment' | 'border_overlap' | 'stopping_point';
+
+export type SafetyAlarm = {
+  time: string;
+  invariant: SafetyInvariant;
+  carts: number[];
+  message: string;
+  controllers: ControllerSnapshot[];
+};
+
+export type Waypoint = {
+  position: number;
+  velocity?: number; // Pass-through speed, omitted for a stop
+  dwell?: string;    // Time to stay at a stop, e.g. "1s"
+};
+
+export type CollisionPolicy = 'halt' | 'impulse' | 'push';
+
 export type AllCartsData = {
   carts: SocketData[];
   timestamp: string;
+
+  // Collisions since the carts were last reset, and whether one halted the simulation
+  collisions: CollisionEvent[];
+  halted: boolean;
+
+  // Safety alarms since the carts were last reset
+  safetyAlarms: SafetyAlarm[];
 };
 
 export type TestResult = {
@@ -84,6 +150,9 @@ const scenarios = ref<CoordinationScenario[]>([])
 const lastScenarioResult = ref<ScenarioResult | null>(null)
 const scenarioCallbacks = ref<((message: any) => void)[]>([])
 
+// Collision handling configuration as last confirmed by the server
+const collisionPolicy = ref<{ policy: CollisionPolicy; restitution: number; error?: string } | null>(null)
+
 // Signal for clearing charts when scenarios start
 const clearChartsSignal = ref(0)
 
@@ -158,6 +227,23 @@ function handleScenarioMessage(messageData: any) {
   scenarioCallbacks.value.forEach(cb => cb(messageData))
 }
 
+function handleCollisionMessage(messageData: any) {
+  switch (messageData.type) {
+    case 'collision_policy':
+      collisionPolicy.value = messageData.data
+      break
+  }
+}
+
+function handleSafetyMessage(messageData: any) {
+  switch (messageData.type) {
+    case 'safety_alarm':
+      // Show the alarm right away, the next cart data brings the full list
+      latestData.value?.safetyAlarms.push(messageData.data)
+      break
+  }
+}
+
 const callbacks = ref<Array<(data: SocketData) => void>>([])
 
 export function registerCallback(callback: (data: SocketData) => void) {
@@ -188,6 +274,18 @@ export function connectWebSocket(url: string = 'ws://localhost:8080/ws') {
       return
     }
     
+    // Check if it's a collision message
+    if (messageData.type && messageData.type.includes('collision')) {
+      handleCollisionMessage(messageData)
+      return
+    }
+
+    // Check if it's a safety message
+    if (messageData.type && messageData.type.includes('safety')) {
+      handleSafetyMessage(messageData)
+      return
+    }
+    
     // Otherwise, treat as cart data
     const allCartsData: AllCartsData = messageData
     latestData.value = allCartsData
@@ -237,6 +335,11 @@ export function useWebSocket() {
     sendControlMessage('setGoal', cartId - 1, position) // Convert to 0-based index
   }
 
+  // Send a multi-waypoint path to a specific cart
+  const setPath = (cartId: number, waypoints: Waypoint[]) => {
+    sendMessage(JSON.stringify({ command: 'setPath', controller: cartId - 1, waypoints }))
+  }
+
   // Emergency stop for a specific cart
   const emergencyStop = (cartId: number) => {
     sendControlMessage('emergencyStop', cartId - 1) // Convert to 0-based index
@@ -313,6 +416,14 @@ export function useWebSocket() {
     sendScenarioMessage({ type: 'scenario_status' })
   }
 
+  function setCollisionPolicy(policy: CollisionPolicy, restitution?: number) {
+    sendScenarioMessage({
+      type: 'set_collision_policy',
+      policy,
+      ...(restitution !== undefined && { restitution })
+    })
+  }
+
   function onScenarioUpdate(callback: (message: any) => void) {
     scenarioCallbacks.value.push(callback)
     
@@ -334,9 +445,11 @@ export function useWebSocket() {
     scenarios: readonly(scenarios),
     lastScenarioResult: readonly(lastScenarioResult),
     clearChartsSignal: readonly(clearChartsSignal),
+    collisionPolicy: readonly(collisionPolicy),
     
     // Actions
     setGoal,
+    setPath,
     emergencyStop,
     toggleRandomGoals,
     getCartData,
@@ -352,6 +465,7 @@ export function useWebSocket() {
     runScenario,
     getScenarioStatus,
     onScenarioUpdate,
+    setCollisionPolicy,
     
     // Raw connection for advanced use
     connection: readonly(connection)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"math/rand"
 	"time"
 )
@@ -45,10 +46,12 @@ type GoalManager struct {
 	lastGoalTime   []time.Time // When the last goal was sent
 	lastFailTime   []time.Time // When the last goal failed/was abandoned
 	controllerBusy []bool      // Whether each controller is busy with a goal
+
+	clock Clock // Time source for goal intervals and cooldowns
 }
 
 // NewGoalManager creates a new goal manager
-func NewGoalManager(controllerGoalChannels []chan<- float64, controllerCompletionChannels []<-chan bool, randomControlChannel <-chan ControlMessage) *GoalManager {
+func NewGoalManager(controllerGoalChannels []chan<- float64, controllerCompletionChannels []<-chan bool, randomControlChannel <-chan ControlMessage, clock Clock) *GoalManager {
 	numControllers := len(controllerGoalChannels)
 	return &GoalManager{
 		controllerGoalChannels:       controllerGoalChannels,
@@ -60,6 +63,7 @@ func NewGoalManager(controllerGoalChannels []chan<- float64, controllerCompletio
 		lastGoalTime:                 make([]time.Time, numControllers),
 		lastFailTime:                 make([]time.Time, numControllers),
 		controllerBusy:               make([]bool, numControllers),
+		clock:                        clock,
 	}
 }
 
@@ -105,7 +109,7 @@ func (gm *GoalManager) Start() {
 
 // handleRandomGoalGeneration processes random goal generation commands
 func (gm *GoalManager) handleRandomGoalGeneration() {
-	fmt.Println("Goal manager waiting for commands...")
+	log.Println("Goal manager waiting for commands...")
 	for msg := range gm.randomControlChannel {
 		fmt.Printf("Goal manager received command: %s, enabled: %t\n", msg.Command, msg.Enabled)
 		if msg.Command == "randomGoals" {
@@ -140,7 +144,7 @@ func (gm *GoalManager) startRandomGoals() {
 		// Stagger the start of goal generation to reduce simultaneous conflicts
 		go func(index int) {
 			// Wait for staggered delay
-			time.Sleep(time.Duration(index) * gm.config.StaggerDelay)
+			gm.clock.Sleep(time.Duration(index) * gm.config.StaggerDelay)
 			gm.manageGoalsForController(index, gm.stopChannels[index])
 		}(i)
 	}
@@ -209,7 +213,7 @@ func (gm *GoalManager) manageGoalsForController(index int, stop chan struct{}) {
 				gm.waitBeforeNextGoal(index, false)
 			} else {
 				fmt.Printf("Controller %d abandoned goal\n", index+1)
-				gm.lastFailTime[index] = time.Now()
+				gm.lastFailTime[index] = gm.clock.Now()
 				// Failed/abandoned goal - apply cooldown period
 				gm.waitBeforeNextGoal(index, true)
 			}
@@ -233,7 +237,7 @@ func (gm *GoalManager) sendGoalToController(index int) bool {
 
 	select {
 	case gm.controllerGoalChannels[index] <- goal:
-		gm.lastGoalTime[index] = time.Now()
+		gm.lastGoalTime[index] = gm.clock.Now()
 		gm.controllerBusy[index] = true
 		fmt.Printf("Generated goal for controller %d: %.2f\n", index+1, goal)
 		return true
@@ -253,18 +257,18 @@ func (gm *GoalManager) waitBeforeNextGoal(index int, failed bool) {
 		fmt.Printf("Controller %d: applying %.1fs cooldown after goal failure\n", index+1, waitTime.Seconds())
 	} else {
 		// Check if we need to wait for minimum persistence time
-		timeSinceLastGoal := time.Since(gm.lastGoalTime[index])
+		timeSinceLastGoal := gm.clock.Since(gm.lastGoalTime[index])
 		if timeSinceLastGoal < gm.config.MinGoalPersistence {
 			extraWait := gm.config.MinGoalPersistence - timeSinceLastGoal
 			fmt.Printf("Controller %d: waiting extra %.1fs for goal persistence\n", index+1, extraWait.Seconds())
-			time.Sleep(extraWait)
+			gm.clock.Sleep(extraWait)
 		}
 
 		// Normal random interval
 		waitTime = gm.getRandomInterval()
 	}
 
-	time.Sleep(waitTime)
+	gm.clock.Sleep(waitTime)
 }
 
 // getRandomInterval returns a random interval between min and max goal intervals
@@ -288,7 +292,7 @@ func (gm *GoalManager) generateGoalForController(index int) float64 {
 
 func (gm *GoalManager) randomSleep() {
 	interval := gm.getRandomInterval()
-	time.Sleep(interval)
+	gm.clock.Sleep(interval)
 }
 
 // generateSmartGoalForController generates a goal that tries to avoid immediate conflicts
@@ -296,7 +300,7 @@ func (gm *GoalManager) generateSmartGoalForController(index int) float64 {
 	baseGoal := gm.generateGoalForController(index)
 
 	// Simple conflict avoidance: if recent failures, try to pick goals further from borders
-	if time.Since(gm.lastFailTime[index]) < 2*gm.config.CooldownAfterFail {
+	if gm.clock.Since(gm.lastFailTime[index]) < 2*gm.config.CooldownAfterFail {
 		if gm.config.UsePerCartRanges {
 			// Generate goals more towards the center of the cart's range
 			rangeStart := float64(index*400) - 200
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// scenarioList collects repeated -scenario flags
+type scenarioList []string
+
+func (l *scenarioList) String() string     { return strings.Join(*l, ", ") }
+func (l *scenarioList) Set(v string) error { *l = append(*l, v); return nil }
+
+// CartMetrics pairs a cart with its message metrics at the end of a scenario
+type CartMetrics struct {
+	CartId  int                  `json:"cartId"`
+	Metrics MessageMetricsReport `json:"metrics"`
+}
+
+// ScenarioReport is the outcome of one scenario in a batch run
+type ScenarioReport struct {
+	Name               string           `json:"name"`
+	Category           string           `json:"category"`
+	Status             string           `json:"status"` // "completed" or "failed"
+	Error              string           `json:"error,omitempty"`
+	SimulatedDuration  float64          `json:"simulatedDuration"` // Seconds on the simulation clock
+	WallDuration       float64          `json:"wallDuration"`      // Seconds of real time
+	Carts              []CartMetrics    `json:"carts"`
+	Collisions         []CollisionEvent `json:"collisions,omitempty"`
+	SafetyAlarms       []SafetyAlarm    `json:"safetyAlarms,omitempty"`       // Raised by the safety monitor, they do not fail a scenario by themselves
+	SkippedSafetyTicks int              `json:"skippedSafetyTicks,omitempty"` // Physics ticks the safety monitor fell too far behind to check
+	Network            []LinkReport     `json:"network,omitempty"`            // Messages on each link between neighbours
+}
+
+// BatchReport is the machine-readable result of a headless run
+type BatchReport struct {
+	Clock        string           `json:"clock"` // "simulated" or "real"
+	Started      time.Time        `json:"started"`
+	Passed       int              `json:"passed"`
+	Failed       int              `json:"failed"`
+	SafetyAlarms int              `json:"safetyAlarms"` // Raised in every scenario together
+	Scenarios    []ScenarioReport `json:"scenarios"`
+}
+
+// runHeadless runs scenarios without the WebSocket server and returns the process exit code
+func runHeadless(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	var names scenarioList
+	flags.Var(&names, "scenario", "scenario to run (repeatable); positional arguments are also accepted")
+	all := flags.Bool("all", false, "run all scenarios")
+	list := flags.Bool("list", false, "list the available scenarios and exit")
+	realtime := flags.Bool("realtime", false, "run on the wall clock instead of the simulated clock")
+	reportPath := flags.String("report", "", "write the report to this file (default: none)")
+	format := flags.String("format", "", "report format: json or junit (default: from the report file extension)")
+	seed := flags.Uint64("seed", 1, "seed for the network simulation")
+	collisionPolicy := flags.String("collision-policy", string(CollisionHalt), "collision handling: halt, impulse or push")
+	restitution := flags.Float64("restitution", defaultRestitution, "coefficient of restitution for the impulse collision policy")
+	physicsConfig := defaultPhysicsConfig()
+	addPhysicsFlags(flags, &physicsConfig)
+	simulationConfig := defaultSimulationConfig()
+	addSimulationFlags(flags, &simulationConfig)
+	scenarioDirectory := flags.String("scenarios", defaultScenarioDirectory, "directory with additional scenario files")
+	verbose := flags.Bool("verbose", false, "print scenario and controller logs")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gocart run [flags] [scenario...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	names = append(names, flags.Args()...)
+	if err := physicsConfig.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	if err := simulationConfig.load(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	var clock Clock
+	var simulatedClock *SimulatedClock
+	if *realtime {
+		clock = NewRealClock()
+	} else {
+		simulatedClock = NewSimulatedClock()
+		clock = simulatedClock
+	}
+
+	scenarioManager := NewScenarioManager(nil, nil, nil, defaultCarts(), make(chan ControlMessage, 10), nil, clock)
+	scenarioManager.seed = *seed
+	if !*verbose {
+		scenarioManager.logOutput = io.Discard
+	}
+	simulationConfig.apply(scenarioManager)
+	policy, err := ParseCollisionPolicy(*collisionPolicy)
+	if err == nil {
+		err = scenarioManager.SetCollisionPolicy(policy, *restitution)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	if err := scenarioManager.LoadScenarioDirectory(*scenarioDirectory); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "error loading scenarios: %v\n", err)
+		return 2
+	}
+
+	available := scenarioManager.GetScenarios()
+	if *list {
+		for _, scenario := range available {
+			fmt.Printf("%-40s %-12s %s\n", scenario.Name, scenario.Category, scenario.Description)
+		}
+		return 0
+	}
+
+	// Resolve which scenarios to run
+	categories := make(map[string]string)
+	for _, scenario := range available {
+		categories[scenario.Name] = scenario.Category
+	}
+	if *all || len(names) == 0 {
+		names = names[:0]
+		for _, scenario := range available {
+			names = append(names, scenario.Name)
+		}
+	}
+	for _, name := range names {
+		if _, exists := categories[name]; !exists {
+			fmt.Fprintf(os.Stderr, "unknown scenario: %s\n", name)
+			return 2
+		}
+	}
+
+	go physics_loop(scenarioManager, physicsConfig)
+
+	if simulatedClock != nil {
+		go simulatedClock.RunFast()
+		defer simulatedClock.Stop()
+	}
+
+	report := BatchReport{
+		Clock:   map[bool]string{true: "real", false: "simulated"}[*realtime],
+		Started: time.Now().UTC(),
+	}
+
+	for _, name := range names {
+		simulatedStart := clock.Now()
+		wallStart := time.Now()
+
+		// Any collision fails the scenario, whatever the policy did about it
+		err := scenarioManager.RunScenario(name)
+		collisions := scenarioManager.GetCollisions()
+		if err == nil && len(collisions) > 0 {
+			err = fmt.Errorf("collision detected: %s", collisions[0])
+		}
+
+		result := ScenarioReport{
+			Name:               name,
+			Category:           categories[name],
+			Status:             "completed",
+			SimulatedDuration:  clock.Since(simulatedStart).Seconds(),
+			WallDuration:       time.Since(wallStart).Seconds(),
+			Collisions:         collisions,
+			SafetyAlarms:       scenarioManager.GetSafetyAlarms(),
+			SkippedSafetyTicks: scenarioManager.SkippedSafetyTicks(),
+			Network:            scenarioManager.NetworkReport(),
+		}
+		if err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+			report.Failed++
+		} else {
+			report.Passed++
+		}
+		for _, controller := range scenarioManager.controllers {
+			result.Carts = append(result.Carts, CartMetrics{
+				CartId:  controller.Cart.Id,
+				Metrics: controller.Metrics.GetDetailedMetrics(),
+			})
+		}
+		report.SafetyAlarms += len(result.SafetyAlarms)
+		report.Scenarios = append(report.Scenarios, result)
+
+		fmt.Printf("%-9s %-40s %7.2fs simulated, %7.3fs wall", strings.ToUpper(result.Status), name, result.SimulatedDuration, result.WallDuration)
+		if result.Error != "" {
+			fmt.Printf("  (%s)", result.Error)
+		}
+		if len(result.SafetyAlarms) > 0 {
+			fmt.Printf("  [%d safety alarms, first %s]", len(result.SafetyAlarms), result.SafetyAlarms[0])
+		}
+		if result.SkippedSafetyTicks > 0 {
+			fmt.Printf("  [%d ticks not checked for safety]", result.SkippedSafetyTicks)
+		}
+		fmt.Println()
+	}
+
+	fmt.Printf("%d passed, %d failed, %d safety alarms\n", report.Passed, report.Failed, report.SafetyAlarms)
+
+	if *reportPath != "" {
+		if err := writeReport(report, *reportPath, *format); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing report: %v\n", err)
+			return 2
+		}
+	}
+
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// writeReport writes the batch report as JSON or JUnit XML
+func writeReport(report BatchReport, path, format string) error {
+	if format == "" {
+		if strings.EqualFold(filepath.Ext(path), ".xml") {
+			format = "junit"
+		} else {
+			format = "json"
+		}
+	}
+
+	var data []byte
+	var err error
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(report, "", "  ")
+	case "junit":
+		data, err = marshalJUnit(report)
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+// marshalJUnit converts the report to JUnit XML, with the cart metrics as each case's output
+func marshalJUnit(report BatchReport) ([]byte, error) {
+	suite := junitTestSuite{
+		Name:      "gocart.coordination",
+		Tests:     len(report.Scenarios),
+		Failures:  report.Failed,
+		Timestamp: report.Started.Format(time.RFC3339),
+	}
+	for _, scenario := range report.Scenarios {
+		metrics, err := json.Marshal(scenario.Carts)
+		if err != nil {
+			return nil, err
+		}
+		testCase := junitTestCase{
+			Name:      scenario.Name,
+			ClassName: "gocart." + scenario.Category,
+			Time:      scenario.SimulatedDuration,
+			SystemOut: string(metrics),
+		}
+		if scenario.Status == "failed" {
+			testCase.Failure = &junitFailure{Message: scenario.Error}
+		}
+		suite.Time += scenario.SimulatedDuration
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	data, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func input_loop(scenarioManager *ScenarioManager, exit_channel chan struct{}, randomControlChannel chan<- ControlMessage) {
@@ -13,7 +15,19 @@ func input_loop(scenarioManager *ScenarioManager, exit_channel chan struct{}, ra
 
 	fmt.Println("Usage: \n" +
 		"goal <controller_index> <goal_position> - Set a goal for a specific controller.\n" +
+		"path <controller_index> <waypoint>... - Drive through waypoints: position, position@velocity (pass through) or position+dwell.\n" +
 		"random [on|off] - Start or stop automatic goal generation.\n" +
+		"collision <halt|impulse|push> [restitution] - Set how collisions are handled.\n" +
+		"autotune <controller_index> [apply] - Tune a controller's PID gains, optionally applying them.\n" +
+		"params [controller_index] - Show controller parameters.\n" +
+		"params save <file> - Save every controller's parameters to a file.\n" +
+		"set <controller_index> <parameter> <value> - Change a parameter, e.g. set 1 controlLaw.velocityLoop.kp 120.\n" +
+		"network [link] - Show the network of every link, link k joins cart k and cart k+1.\n" +
+		"network <link|all> <setting> <value> - Change a link's network, e.g. network 2 partitioned true.\n" +
+		"network <link|all> reset - Return a link to the network the carts were set up with.\n" +
+		"messages - Show the messages held by manual links, see network <link|all> manual true.\n" +
+		"messages <deliver|drop|duplicate> <id|next> - Act on a held message, next is the oldest one.\n" +
+		"messages delay <id|next> <duration> - Deliver a held message after a delay, e.g. messages delay 3 500ms.\n" +
 		"exit - Exit the program.")
 
 	for {
@@ -53,6 +67,25 @@ func input_loop(scenarioManager *ScenarioManager, exit_channel chan struct{}, ra
 			}
 			scenarioManager.goalChannels[controllerIndexInt-1] <- goalPositionFloat
 
+		case "path":
+			if len(words) < 3 {
+				fmt.Println("Usage: path <controller_index> <waypoint>... (waypoint: position, position@velocity or position+dwell)")
+				continue
+			}
+			controllerIndexInt, err := strconv.Atoi(words[1])
+			if err != nil {
+				fmt.Println("Invalid controller index:", words[1])
+				continue
+			}
+			path, err := parseWaypoints(words[2:])
+			if err != nil {
+				fmt.Println("Invalid path:", err)
+				continue
+			}
+			if err := scenarioManager.SendPath(controllerIndexInt, path); err != nil {
+				fmt.Println("Error sending path:", err)
+			}
+
 		case "random":
 			if len(words) < 2 {
 				fmt.Println("Usage: random [on|off]")
@@ -67,8 +100,209 @@ func input_loop(scenarioManager *ScenarioManager, exit_channel chan struct{}, ra
 			}
 			randomControlChannel <- controlMsg
 
+		case "collision":
+			if len(words) < 2 {
+				policy, restitution := scenarioManager.GetCollisionPolicy()
+				fmt.Printf("Collision policy: %s (restitution %.2f)\n", policy, restitution)
+				fmt.Println("Usage: collision <halt|impulse|push> [restitution]")
+				continue
+			}
+			policy, err := ParseCollisionPolicy(words[1])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			_, restitution := scenarioManager.GetCollisionPolicy()
+			if len(words) > 2 {
+				restitution, err = strconv.ParseFloat(words[2], 64)
+				if err != nil {
+					fmt.Println("Invalid restitution:", words[2])
+					continue
+				}
+			}
+			if err := scenarioManager.SetCollisionPolicy(policy, restitution); err != nil {
+				fmt.Println(err)
+			}
+
+		case "autotune":
+			if len(words) < 2 {
+				fmt.Println("Usage: autotune <controller_index> [apply]")
+				continue
+			}
+			cart, err := strconv.Atoi(words[1])
+			if err != nil {
+				fmt.Println("Invalid controller index:", words[1])
+				continue
+			}
+			apply := len(words) > 2 && words[2] == "apply"
+			result, err := scenarioManager.AutotuneCart(cart, apply)
+			if err != nil {
+				fmt.Println("Autotune failed:", err)
+				continue
+			}
+			fmt.Printf("Plant: mass %.3f, Coulomb friction %.2f N, dead time %v\n", result.Plant.Mass, result.Plant.CoulombFriction, time.Duration(result.Plant.DeadTime))
+			fmt.Printf("Position loop Kp %g, velocity loop Kp %g Ki %g\n", result.ControlLaw.PositionLoop.Kp, result.ControlLaw.VelocityLoop.Kp, result.ControlLaw.VelocityLoop.Ki)
+			fmt.Printf("Tracking RMS in %q: before %.3f, after %.3f\n", result.Scenario, result.Before.TrackingErrorRMS, result.After.TrackingErrorRMS)
+			if result.Applied {
+				fmt.Println("Applied the tuned gains")
+			} else if result.Worse {
+				fmt.Println("Not applied: the tuned gains track worse than the current ones")
+			}
+
+		case "params":
+			if len(words) > 2 && words[1] == "save" {
+				data, err := json.MarshalIndent(scenarioManager.ParameterSnapshot(), "", "  ")
+				if err == nil {
+					err = os.WriteFile(words[2], data, 0o644)
+				}
+				if err != nil {
+					fmt.Println("Error saving parameters:", err)
+				} else {
+					fmt.Println("Saved parameters to", words[2])
+				}
+				continue
+			}
+			var value interface{} = scenarioManager.ParameterSnapshot()
+			if len(words) > 1 {
+				cart, err := strconv.Atoi(words[1])
+				if err != nil {
+					fmt.Println("Invalid controller index:", words[1])
+					continue
+				}
+				value, err = scenarioManager.GetParameters(cart)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+			}
+			data, _ := json.MarshalIndent(value, "", "  ")
+			fmt.Println(string(data))
+
+		case "set":
+			if len(words) < 4 {
+				fmt.Println("Usage: set <controller_index> <parameter> <value>")
+				continue
+			}
+			cart, err := strconv.Atoi(words[1])
+			if err != nil {
+				fmt.Println("Invalid controller index:", words[1])
+				continue
+			}
+			patch, err := parameterPatch(words[2], strings.Join(words[3:], " "))
+			if err == nil {
+				_, err = scenarioManager.PatchParameters(cart, patch)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+
+		case "network":
+			links := scenarioManager.LinkNetworks()
+			if len(words) < 3 {
+				if len(words) == 2 {
+					link, err := strconv.Atoi(words[1])
+					if err != nil || link < 1 || link > len(links) {
+						fmt.Println("Invalid link:", words[1])
+						continue
+					}
+					links = links[link-1 : link]
+				}
+				data, _ := json.MarshalIndent(links, "", "  ")
+				fmt.Println(string(data))
+				continue
+			}
+			link := 0
+			if words[1] != "all" {
+				link, err = strconv.Atoi(words[1])
+				if err != nil {
+					fmt.Println("Invalid link:", words[1])
+					continue
+				}
+			}
+			if words[2] == "reset" {
+				err = scenarioManager.ResetLinkNetwork(link)
+			} else if len(words) < 4 {
+				fmt.Println("Usage: network <link|all> <setting> <value>")
+				continue
+			} else {
+				var patch []byte
+				patch, err = parameterPatch(words[2], strings.Join(words[3:], " "))
+				if err == nil {
+					_, err = scenarioManager.PatchLinkNetwork(link, patch)
+				}
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+
+		case "messages":
+			queue := scenarioManager.Messages()
+			if len(words) < 2 {
+				messages := queue.Messages()
+				if len(messages) == 0 {
+					fmt.Println("No messages are held")
+				}
+				for _, message := range messages {
+					fmt.Printf("#%d link %d, %s: %s\n", message.Id, message.Link, message.Direction, message.Summary)
+				}
+				continue
+			}
+			if len(words) < 3 || words[1] == "delay" && len(words) < 4 {
+				fmt.Println("Usage: messages <deliver|drop|duplicate> <id|next> or messages delay <id|next> <duration>")
+				continue
+			}
+			id := 0
+			if words[2] != "next" {
+				id, err = strconv.Atoi(words[2])
+				if err != nil || id < 1 {
+					fmt.Println("Invalid message id:", words[2])
+					continue
+				}
+			}
+			var delay time.Duration
+			if words[1] == "delay" {
+				delay, err = time.ParseDuration(words[3])
+				if err != nil {
+					fmt.Println("Invalid delay:", words[3])
+					continue
+				}
+			}
+			if err := queue.apply(words[1], id, delay); err != nil {
+				fmt.Println(err)
+			}
+
 		default:
 			fmt.Println("Unknown command:", input)
 		}
 	}
 }
+
+// parseWaypoints reads console waypoints: 600 stops, 400@150 passes through
+// at 150 and 600+1s stops for a second
+func parseWaypoints(words []string) ([]Waypoint, error) {
+	var path []Waypoint
+	for _, word := range words {
+		var waypoint Waypoint
+		position := word
+		if before, after, found := strings.Cut(word, "@"); found {
+			velocity, err := strconv.ParseFloat(after, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid velocity in %q", word)
+			}
+			position, waypoint.Velocity = before, velocity
+		} else if before, after, found := strings.Cut(word, "+"); found {
+			dwell, err := time.ParseDuration(after)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dwell in %q", word)
+			}
+			position, waypoint.Dwell = before, Duration(dwell)
+		}
+		value, err := strconv.ParseFloat(position, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid position in %q", word)
+		}
+		waypoint.Position = value
+		path = append(path, waypoint)
+	}
+	return path, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// CartDrift is how far one cart strayed from the reference run
+type CartDrift struct {
+	CartId             int     `json:"cartId"`
+	MaxPositionDrift   float64 `json:"maxPositionDrift"`
+	RMSPositionDrift   float64 `json:"rmsPositionDrift"`
+	FinalPositionDrift float64 `json:"finalPositionDrift"`
+	MaxVelocityDrift   float64 `json:"maxVelocityDrift"`
+}
+
+// IntegratorDrift is the outcome of running the scenario with one integrator
+type IntegratorDrift struct {
+	Integrator string      `json:"integrator"`
+	Status     string      `json:"status"` // "completed" or "failed"
+	Error      string      `json:"error,omitempty"`
+	Samples    int         `json:"samples"`
+	Carts      []CartDrift `json:"carts"`
+}
+
+// IntegratorComparison is the report of a compare-integrators run
+type IntegratorComparison struct {
+	Scenario       string            `json:"scenario"`
+	Reference      string            `json:"reference"`
+	Timestep       string            `json:"timestep"`
+	Substeps       int               `json:"substeps"`
+	SampleInterval string            `json:"sampleInterval"`
+	Results        []IntegratorDrift `json:"results"`
+}
+
+// runIntegratorComparison runs one scenario with several integrators on the
+// simulated clock and reports how far each drifts from the first one
+func runIntegratorComparison(args []string) int {
+	flags := flag.NewFlagSet("compare-integrators", flag.ContinueOnError)
+	defaults := defaultPhysicsConfig()
+	integratorList := flags.String("integrators", "rk4,"+strings.Join(withoutName(integratorNames(), "rk4"), ","), "comma-separated integrators, the first is the reference")
+	timestep := flags.Duration("timestep", defaults.Timestep, "fixed physics timestep")
+	substeps := flags.Int("substeps", defaults.Substeps, "integration substeps per physics timestep")
+	sampleInterval := flags.Duration("sample", 10*time.Millisecond, "how often cart states are compared")
+	seed := flags.Uint64("seed", 1, "seed for the network simulation")
+	simulationConfig := defaultSimulationConfig()
+	addSimulationFlags(flags, &simulationConfig)
+	scenarioDirectory := flags.String("scenarios", defaultScenarioDirectory, "directory with additional scenario files")
+	reportPath := flags.String("report", "", "write the comparison as JSON to this file")
+	verbose := flags.Bool("verbose", false, "print scenario and controller logs")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gocart compare-integrators [flags] scenario")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	scenario := flags.Arg(0)
+	if *sampleInterval <= 0 {
+		fmt.Fprintln(os.Stderr, "sample interval must be positive")
+		return 2
+	}
+
+	if err := simulationConfig.load(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	names := strings.Split(*integratorList, ",")
+	for _, name := range names {
+		config := PhysicsConfig{Integrator: name, Timestep: *timestep, Substeps: *substeps}
+		if err := config.validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 2
+		}
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	report := IntegratorComparison{
+		Scenario:       scenario,
+		Reference:      names[0],
+		Timestep:       timestep.String(),
+		Substeps:       *substeps,
+		SampleInterval: sampleInterval.String(),
+	}
+
+	var reference [][]PhysicsState
+	failed := false
+	for i, name := range names {
+		config := PhysicsConfig{Integrator: name, Timestep: *timestep, Substeps: *substeps}
+		samples, err := sampleScenario(scenario, config, simulationConfig, *seed, *scenarioDirectory, *sampleInterval, *verbose)
+		result := IntegratorDrift{Integrator: name, Status: "completed", Samples: len(samples)}
+		if err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+			failed = true
+		}
+		if i == 0 {
+			reference = samples
+		}
+		result.Carts = compareSamples(reference, samples)
+		report.Results = append(report.Results, result)
+	}
+
+	fmt.Printf("Scenario %q, reference %s, timestep %v x %d substeps\n", scenario, report.Reference, *timestep, *substeps)
+	fmt.Printf("%-20s %4s %12s %12s %12s %14s\n", "integrator", "cart", "max drift", "rms drift", "final drift", "max vel drift")
+	for _, result := range report.Results {
+		if result.Status == "failed" {
+			fmt.Printf("%-20s FAILED (%s)\n", result.Integrator, result.Error)
+		}
+		for _, cart := range result.Carts {
+			fmt.Printf("%-20s %4d %12.6f %12.6f %12.6f %14.6f\n", result.Integrator, cart.CartId,
+				cart.MaxPositionDrift, cart.RMSPositionDrift, cart.FinalPositionDrift, cart.MaxVelocityDrift)
+		}
+	}
+
+	if *reportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*reportPath, data, 0o644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error writing report: %v\n", err)
+			return 2
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// sampleScenario runs a scenario on a fresh simulated clock and records every cart's state at a fixed interval
+func sampleScenario(scenario string, config PhysicsConfig, simulationConfig SimulationConfig, seed uint64, scenarioDirectory string, interval time.Duration, verbose bool) ([][]PhysicsState, error) {
+	clock := NewSimulatedClock()
+	randomControlChannel := make(chan ControlMessage, 10)
+	scenarioManager := NewScenarioManager(nil, nil, nil, defaultCarts(), randomControlChannel, nil, clock)
+	scenarioManager.seed = seed
+	simulationConfig.apply(scenarioManager)
+	if !verbose {
+		scenarioManager.logOutput = io.Discard
+	}
+	if err := scenarioManager.LoadScenarioDirectory(scenarioDirectory); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	go physics_loop(scenarioManager, config)
+	go clock.RunFast()
+	defer clock.Stop()
+
+	// Everything the run started stops with it, one run is made per integrator
+	defer func() {
+		close(scenarioManager.physicsExitChannel)
+		close(randomControlChannel) // Ends the goal manager
+		scenarioManager.stopAllControllers()
+	}()
+
+	var samples [][]PhysicsState
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				carts := scenarioManager.carts
+				sample := make([]PhysicsState, len(carts))
+				for i, cart := range carts {
+					sample[i] = PhysicsState{Position: cart.Position, Velocity: cart.Velocity}
+				}
+				samples = append(samples, sample)
+			}
+		}
+	}()
+
+	err := scenarioManager.RunScenario(scenario)
+	close(stop)
+	<-stopped
+	return samples, err
+}
+
+// compareSamples computes the drift of each cart between two sampled runs
+func compareSamples(reference, samples [][]PhysicsState) []CartDrift {
+	count := min(len(reference), len(samples))
+	if count == 0 {
+		return nil
+	}
+	carts := min(len(reference[count-1]), len(samples[count-1]))
+	drifts := make([]CartDrift, carts)
+	sumSquares := make([]float64, carts)
+	compared := make([]int, carts)
+
+	for k := 0; k < count; k++ {
+		for i := 0; i < carts && i < len(reference[k]) && i < len(samples[k]); i++ {
+			positionDrift := math.Abs(samples[k][i].Position - reference[k][i].Position)
+			velocityDrift := math.Abs(samples[k][i].Velocity - reference[k][i].Velocity)
+			drifts[i].MaxPositionDrift = math.Max(drifts[i].MaxPositionDrift, positionDrift)
+			drifts[i].MaxVelocityDrift = math.Max(drifts[i].MaxVelocityDrift, velocityDrift)
+			drifts[i].FinalPositionDrift = positionDrift
+			sumSquares[i] += positionDrift * positionDrift
+			compared[i]++
+		}
+	}
+	for i := range drifts {
+		drifts[i].CartId = i + 1
+		if compared[i] > 0 {
+			drifts[i].RMSPositionDrift = math.Sqrt(sumSquares[i] / float64(compared[i]))
+		}
+	}
+	return drifts
+}
+
+// withoutName returns names without the given entry
+func withoutName(names []string, name string) []string {
+	result := make([]string, 0, len(names))
+	for _, n := range names {
+		if n != name {
+			result = append(result, n)
+		}
+	}
+	return result
+}
@@ -1,16 +1,63 @@
 package main
 
-import "log"
+import (
+	"flag"
+	"log"
+	"os"
+)
 
-func main() {
-
-	// Initialize base cart definitions (these will be used as templates by the scenario manager)
-	carts := []Cart{
+// defaultCarts returns the base cart definitions (these will be used as templates by the scenario manager)
+func defaultCarts() []Cart {
+	return []Cart{
 		{Name: "Cart 1", Id: 1, Position: 200, Velocity: 0, Acceleration: 0, Mass: 1, Force: 0, Width: 50, Height: 40},
 		{Name: "Cart 2", Id: 2, Position: 600, Velocity: 0, Acceleration: 0, Mass: 1, Force: 0, Width: 50, Height: 40},
 		{Name: "Cart 3", Id: 3, Position: 1000, Velocity: 0, Acceleration: 0, Mass: 1, Force: 0, Width: 50, Height: 40},
 		{Name: "Cart 4", Id: 4, Position: 1400, Velocity: 0, Acceleration: 0, Mass: 1, Force: 0, Width: 50, Height: 40},
 	}
+}
+
+func main() {
+
+	// Headless batch mode: gocart run [flags] [scenario...]
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		os.Exit(runHeadless(os.Args[2:]))
+	}
+
+	// Integrator diagnostics: gocart compare-integrators [flags] scenario
+	if len(os.Args) > 1 && os.Args[1] == "compare-integrators" {
+		os.Exit(runIntegratorComparison(os.Args[2:]))
+	}
+
+	// PID tuning: gocart autotune [flags]
+	if len(os.Args) > 1 && os.Args[1] == "autotune" {
+		os.Exit(runAutotune(os.Args[2:]))
+	}
+
+	// Planner property checks: gocart check-planner [flags]
+	if len(os.Args) > 1 && os.Args[1] == "check-planner" {
+		os.Exit(runPlannerCheck(os.Args[2:]))
+	}
+
+	// Protocol exploration: gocart explore [flags] scenario
+	if len(os.Args) > 1 && os.Args[1] == "explore" {
+		os.Exit(runExplore(os.Args[2:]))
+	}
+
+	// Physics settings are fixed for the lifetime of the server
+	physicsConfig := defaultPhysicsConfig()
+	addPhysicsFlags(flag.CommandLine, &physicsConfig)
+	simulationConfig := defaultSimulationConfig()
+	addSimulationFlags(flag.CommandLine, &simulationConfig)
+	flag.Parse()
+	if err := physicsConfig.validate(); err != nil {
+		log.Fatalf("Invalid physics configuration: %v", err)
+	}
+	if err := simulationConfig.load(); err != nil {
+		log.Fatalf("Invalid simulation settings: %v", err)
+	}
+
+	// Initialize base cart definitions
+	carts := defaultCarts()
 
 	// Initialize exit channel
 	exit_channel := make(chan struct{})
@@ -19,11 +66,20 @@ func main() {
 	// Create a channel for random goal control from the frontend
 	randomControlChannel := make(chan ControlMessage, 10)
 
+	// The interactive server runs in real time
+	clock := NewRealClock()
+
 	// Create the scenario manager with empty initial state (it will set up controllers when running default scenario)
-	scenarioManager := NewScenarioManager(nil, nil, nil, carts, randomControlChannel, nil)
+	scenarioManager := NewScenarioManager(nil, nil, nil, carts, randomControlChannel, nil, clock)
+	simulationConfig.apply(scenarioManager)
+
+	// Load user scenario files on top of the built-in ones
+	if err := scenarioManager.LoadScenarioDirectory(defaultScenarioDirectory); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error loading scenarios: %v", err)
+	}
 
 	// Start the physics loop with scenario manager
-	go physics_loop(scenarioManager, exit_channel)
+	go physics_loop(scenarioManager, physicsConfig)
 
 	// Start input loop
 	go input_loop(scenarioManager, exit_channel, randomControlChannel)
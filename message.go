@@ -1,5 +1,10 @@
 package main
 
+import (
+	"fmt"
+	"time"
+)
+
 type ResponseType int
 
 const (
@@ -12,6 +17,7 @@ const (
 type Response struct {
 	RequestId int64
 	Type      ResponseType
+	ArrivesAt time.Time // For an ACCEPT that misses the request's deadline, when the border will have moved
 }
 
 type RequestType int
@@ -26,4 +32,45 @@ type Request struct {
 	Type                RequestType
 	ProposedBorderStart float64
 	ProposedBorderEnd   float64
+	Deadline            time.Time // When the requester will first need the new border, zero if it does not say
+}
+
+func (t ResponseType) String() string {
+	switch t {
+	case ACCEPT:
+		return "ACCEPT"
+	case REJECT:
+		return "REJECT"
+	case WAIT:
+		return "WAIT"
+	case STOP_CONFIRM:
+		return "STOP_CONFIRM"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+func (t RequestType) String() string {
+	switch t {
+	case BORDER_MOVE:
+		return "BORDER_MOVE"
+	case EMERGENCY_STOP:
+		return "EMERGENCY_STOP"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+func (r Request) String() string {
+	if r.Type == BORDER_MOVE {
+		return fmt.Sprintf("%s request %d, border [%.2f, %.2f]", r.Type, r.RequestId, r.ProposedBorderStart, r.ProposedBorderEnd)
+	}
+	return fmt.Sprintf("%s request %d", r.Type, r.RequestId)
+}
+
+func (r Response) String() string {
+	if !r.ArrivesAt.IsZero() {
+		return fmt.Sprintf("%s response to request %d, border late until %s", r.Type, r.RequestId, r.ArrivesAt.Format("15:04:05.000"))
+	}
+	return fmt.Sprintf("%s response to request %d", r.Type, r.RequestId)
 }
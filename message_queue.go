@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// =====================================================
+// MANUAL NETWORK
+// =====================================================
+
+// HeldMessage is a message a manual link holds until an operator acts on it
+type HeldMessage struct {
+	Id        int       `json:"id"`
+	Link      int       `json:"link"`      // Link k joins cart k and cart k+1
+	Direction string    `json:"direction"` // "left to right" or "right to left"
+	Kind      string    `json:"kind"`      // "request" or "response"
+	Summary   string    `json:"summary"`
+	Message   any       `json:"message"` // The Request or Response itself
+	HeldAt    time.Time `json:"heldAt"`
+
+	network   *NetworkDelaySimulator
+	direction Direction
+	deliver   func() // Hands the message to the receiver now
+	forward   func() // Sends the message over the link as its faults dictate
+}
+
+// MessageQueue holds the messages in flight on manual links, so that an
+// operator can choose which one to deliver, drop, duplicate or delay next
+type MessageQueue struct {
+	clock     Clock
+	nextId    int
+	messages  []*HeldMessage // In the order they were sent
+	observers []func([]HeldMessage)
+	mu        sync.Mutex
+	notifyMu  sync.Mutex // Keeps the observers' snapshots in the order of the changes
+}
+
+func NewMessageQueue(clock Clock) *MessageQueue {
+	return &MessageQueue{clock: clock, nextId: 1}
+}
+
+// hold adds a message to the queue. Called with the link's lock held, so that
+// a link leaving manual mode cannot miss it.
+func (q *MessageQueue) hold(message *HeldMessage) {
+	q.mu.Lock()
+	message.Id = q.nextId
+	message.HeldAt = q.clock.Now()
+	q.nextId++
+	q.messages = append(q.messages, message)
+	q.mu.Unlock()
+	log.Printf("[MESSAGES] Holding #%d on link %d (%s): %s", message.Id, message.Link, message.Direction, message.Summary)
+	q.notify()
+}
+
+// release takes the held messages of one direction of a link, in order
+func (q *MessageQueue) release(network *NetworkDelaySimulator, direction Direction) []*HeldMessage {
+	q.mu.Lock()
+	var released []*HeldMessage
+	q.messages = slices.DeleteFunc(q.messages, func(message *HeldMessage) bool {
+		if message.network == network && message.direction == direction {
+			released = append(released, message)
+			return true
+		}
+		return false
+	})
+	q.mu.Unlock()
+	if len(released) > 0 {
+		q.notify()
+	}
+	return released
+}
+
+// clear forgets every held message, e.g. when the carts are replaced
+func (q *MessageQueue) clear() {
+	q.mu.Lock()
+	q.messages = nil
+	q.mu.Unlock()
+	q.notify()
+}
+
+// Messages returns the held messages, oldest first
+func (q *MessageQueue) Messages() []HeldMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	messages := make([]HeldMessage, 0, len(q.messages))
+	for _, message := range q.messages {
+		messages = append(messages, *message)
+	}
+	return messages
+}
+
+// Find returns the id of the oldest held message on a link (any link for 0) of
+// a kind (any kind for "")
+func (q *MessageQueue) Find(link int, kind string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, message := range q.messages {
+		if (link == 0 || message.Link == link) && (kind == "" || message.Kind == kind) {
+			return message.Id, nil
+		}
+	}
+	if kind == "" {
+		kind = "message"
+	}
+	if link == 0 {
+		return 0, fmt.Errorf("no %s is held", kind)
+	}
+	return 0, fmt.Errorf("no %s is held on link %d", kind, link)
+}
+
+// take removes a held message from the queue, the oldest one for id 0
+func (q *MessageQueue) take(id int) (*HeldMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, message := range q.messages {
+		if id == 0 || message.Id == id {
+			q.messages = slices.Delete(q.messages, i, i+1)
+			return message, nil
+		}
+	}
+	if id == 0 {
+		return nil, fmt.Errorf("no message is held")
+	}
+	return nil, fmt.Errorf("message #%d is not held", id)
+}
+
+// Deliver hands a held message to its receiver, the oldest one for id 0
+func (q *MessageQueue) Deliver(id int) error {
+	message, err := q.take(id)
+	if err != nil {
+		return err
+	}
+	log.Printf("[MESSAGES] Delivering #%d: %s", message.Id, message.Summary)
+	message.deliver()
+	q.notify()
+	return nil
+}
+
+// Drop loses a held message, the oldest one for id 0
+func (q *MessageQueue) Drop(id int) error {
+	message, err := q.take(id)
+	if err != nil {
+		return err
+	}
+	log.Printf("[MESSAGES] Dropping #%d: %s", message.Id, message.Summary)
+	message.network.lost(message.direction)
+	q.notify()
+	return nil
+}
+
+// Delay delivers a held message, the oldest one for id 0, after d without waiting for the operator
+func (q *MessageQueue) Delay(id int, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("delay must be positive")
+	}
+	message, err := q.take(id)
+	if err != nil {
+		return err
+	}
+	log.Printf("[MESSAGES] Delaying #%d by %v: %s", message.Id, d, message.Summary)
+	go func() {
+		q.clock.Sleep(d)
+		log.Printf("[MESSAGES] Delivering delayed #%d: %s", message.Id, message.Summary)
+		message.deliver()
+	}()
+	q.notify()
+	return nil
+}
+
+// Duplicate holds a second copy of a held message, the oldest one for id 0,
+// right behind it. It returns the copy's id.
+func (q *MessageQueue) Duplicate(id int) (int, error) {
+	q.mu.Lock()
+	index := slices.IndexFunc(q.messages, func(message *HeldMessage) bool {
+		return id == 0 || message.Id == id
+	})
+	if index < 0 {
+		q.mu.Unlock()
+		if id == 0 {
+			return 0, fmt.Errorf("no message is held")
+		}
+		return 0, fmt.Errorf("message #%d is not held", id)
+	}
+	original := q.messages[index]
+	duplicate := *original
+	duplicate.Id = q.nextId
+	q.nextId++
+	q.messages = slices.Insert(q.messages, index+1, &duplicate)
+	q.mu.Unlock()
+
+	log.Printf("[MESSAGES] Duplicated #%d as #%d: %s", original.Id, duplicate.Id, duplicate.Summary)
+	duplicate.network.duplicated(duplicate.direction)
+	q.notify()
+	return duplicate.Id, nil
+}
+
+// apply carries out an operation named by the operator on a held message
+func (q *MessageQueue) apply(operation string, id int, delay time.Duration) error {
+	switch operation {
+	case "deliver":
+		return q.Deliver(id)
+	case "drop":
+		return q.Drop(id)
+	case "duplicate":
+		_, err := q.Duplicate(id)
+		return err
+	case "delay":
+		return q.Delay(id, delay)
+	default:
+		return fmt.Errorf("unknown message operation %q", operation)
+	}
+}
+
+// OnChange registers a function called with the held messages after every change
+func (q *MessageQueue) OnChange(observer func([]HeldMessage)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.observers = append(q.observers, observer)
+}
+
+// notify tells the observers about the held messages. Called after every change
+// once the queue's lock is released, one notification at a time.
+func (q *MessageQueue) notify() {
+	q.notifyMu.Lock()
+	defer q.notifyMu.Unlock()
+	q.mu.Lock()
+	observers := q.observers
+	q.mu.Unlock()
+	if len(observers) == 0 {
+		return
+	}
+	messages := q.Messages()
+	for _, observer := range observers {
+		observer(messages)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"math"
 	"sync"
 	"time"
 )
@@ -20,17 +21,39 @@ type MessageMetrics struct {
 	movementStartTime    *time.Time      // When movement actually started
 	goalToMovementDelays []time.Duration // Collection of goal-to-movement delays
 
+	// Goal decisions, in the order they were made
+	goalOutcomes []GoalOutcome
+
+	// Tracking error between the planned and the actual position
+	trackingErrorSquares float64
+	trackingErrorCount   int64
+	maxTrackingError     float64
+
+	// Control effort: integral of force squared and of absolute mechanical power
+	controlEffort    float64
+	mechanicalEnergy float64
+
+	// Planned trajectories that failed validation
+	invalidTrajectories int64
+
+	// Timed movements that could not arrive by their deadline
+	missedDeadlines int64
+
 	// Message counting for scenarios
 	scenarioMessageCount int64 // Messages sent/received during current scenario
 	scenarioStartTime    *time.Time
+
+	clock Clock // Time source for all measurements
 }
 
 // NewMessageMetrics creates a new message metrics tracker
-func NewMessageMetrics() *MessageMetrics {
+func NewMessageMetrics(clock Clock) *MessageMetrics {
 	return &MessageMetrics{
 		pendingMessages:      make(map[int64]time.Time),
 		roundTripTimes:       make([]time.Duration, 0),
 		goalToMovementDelays: make([]time.Duration, 0),
+		goalOutcomes:         make([]GoalOutcome, 0),
+		clock:                clock,
 	}
 }
 
@@ -38,7 +61,7 @@ func NewMessageMetrics() *MessageMetrics {
 func (m *MessageMetrics) RecordMessageSent(requestId int64) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.pendingMessages[requestId] = time.Now()
+	m.pendingMessages[requestId] = m.clock.Now()
 	m.scenarioMessageCount++
 }
 
@@ -55,7 +78,7 @@ func (m *MessageMetrics) RecordMessageReceived(requestId int64) {
 	defer m.mu.Unlock()
 
 	if sentTime, exists := m.pendingMessages[requestId]; exists {
-		roundTripTime := time.Since(sentTime)
+		roundTripTime := m.clock.Since(sentTime)
 		m.roundTripTimes = append(m.roundTripTimes, roundTripTime)
 		m.totalRoundTripTime += roundTripTime
 		m.messageCount++
@@ -67,7 +90,7 @@ func (m *MessageMetrics) RecordMessageReceived(requestId int64) {
 func (m *MessageMetrics) RecordGoalReceived() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	now := time.Now()
+	now := m.clock.Now()
 	m.goalReceivedTime = &now
 }
 
@@ -76,7 +99,7 @@ func (m *MessageMetrics) RecordMovementStart() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	now := time.Now()
+	now := m.clock.Now()
 	m.movementStartTime = &now
 
 	if m.goalReceivedTime != nil {
@@ -85,11 +108,105 @@ func (m *MessageMetrics) RecordMovementStart() {
 	}
 }
 
+// GoalOutcome records whether a controller accepted or rejected a goal
+type GoalOutcome struct {
+	Goal      float64   `json:"goal"`
+	Accepted  bool      `json:"accepted"`
+	Avoidance bool      `json:"avoidance"` // Goal was an avoidance manoeuvre, not a requested goal
+	Time      time.Time `json:"time"`
+}
+
+// RecordGoalOutcome records the decision on a goal
+func (m *MessageMetrics) RecordGoalOutcome(goal float64, accepted, avoidance bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.goalOutcomes = append(m.goalOutcomes, GoalOutcome{
+		Goal:      goal,
+		Accepted:  accepted,
+		Avoidance: avoidance,
+		Time:      m.clock.Now(),
+	})
+}
+
+// GetGoalOutcomes returns a copy of all goal decisions
+func (m *MessageMetrics) GetGoalOutcomes() []GoalOutcome {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	outcomes := make([]GoalOutcome, len(m.goalOutcomes))
+	copy(outcomes, m.goalOutcomes)
+	return outcomes
+}
+
+// GetMaxGoalToMovementDelay returns the longest goal-to-movement delay
+func (m *MessageMetrics) GetMaxGoalToMovementDelay() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var longest time.Duration
+	for _, delay := range m.goalToMovementDelays {
+		longest = max(longest, delay)
+	}
+	return longest
+}
+
+// RecordTrackingError records one sample of planned minus actual position
+func (m *MessageMetrics) RecordTrackingError(err float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trackingErrorSquares += err * err
+	m.trackingErrorCount++
+	m.maxTrackingError = max(m.maxTrackingError, math.Abs(err))
+}
+
+// GetMaxTrackingError returns the largest tracking error recorded
+func (m *MessageMetrics) GetMaxTrackingError() float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.maxTrackingError
+}
+
+// trackingErrorRMS calculates the RMS tracking error, the caller must hold the lock
+func (m *MessageMetrics) trackingErrorRMS() float64 {
+	if m.trackingErrorCount == 0 {
+		return 0
+	}
+	return math.Sqrt(m.trackingErrorSquares / float64(m.trackingErrorCount))
+}
+
+// RecordControlEffort records a force applied at the given velocity for dt seconds
+func (m *MessageMetrics) RecordControlEffort(force, velocity, dt float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.controlEffort += force * force * dt
+	m.mechanicalEnergy += math.Abs(force*velocity) * dt
+}
+
+// RecordInvalidTrajectory counts a planned trajectory that failed validation
+func (m *MessageMetrics) RecordInvalidTrajectory() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.invalidTrajectories++
+}
+
+// GetInvalidTrajectoryCount returns how many planned trajectories failed validation
+func (m *MessageMetrics) GetInvalidTrajectoryCount() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.invalidTrajectories
+}
+
+// RecordMissedDeadline counts a timed movement that could not arrive by its deadline
+func (m *MessageMetrics) RecordMissedDeadline() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.missedDeadlines++
+}
+
 // StartScenario resets scenario-specific metrics
 func (m *MessageMetrics) StartScenario() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	now := time.Now()
+	now := m.clock.Now()
 	m.scenarioStartTime = &now
 	m.scenarioMessageCount = 0
 }
@@ -98,7 +215,11 @@ func (m *MessageMetrics) StartScenario() {
 func (m *MessageMetrics) GetAverageRoundTripTime() time.Duration {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.averageRoundTripTime()
+}
 
+// averageRoundTripTime calculates the average round trip time, the caller must hold the lock
+func (m *MessageMetrics) averageRoundTripTime() time.Duration {
 	if m.messageCount == 0 {
 		return 0
 	}
@@ -109,7 +230,11 @@ func (m *MessageMetrics) GetAverageRoundTripTime() time.Duration {
 func (m *MessageMetrics) GetAverageGoalToMovementDelay() time.Duration {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.averageGoalToMovementDelay()
+}
 
+// averageGoalToMovementDelay calculates the average goal-to-movement delay, the caller must hold the lock
+func (m *MessageMetrics) averageGoalToMovementDelay() time.Duration {
 	if len(m.goalToMovementDelays) == 0 {
 		return 0
 	}
@@ -141,12 +266,18 @@ func (m *MessageMetrics) GetDetailedMetrics() MessageMetricsReport {
 	defer m.mu.RUnlock()
 
 	return MessageMetricsReport{
-		AverageRoundTripTime:      m.GetAverageRoundTripTime(),
-		AverageGoalToMovementTime: m.GetAverageGoalToMovementDelay(),
+		AverageRoundTripTime:      m.averageRoundTripTime(),
+		AverageGoalToMovementTime: m.averageGoalToMovementDelay(),
 		TotalMessageCount:         m.messageCount,
 		ScenarioMessageCount:      m.scenarioMessageCount,
 		RoundTripTimeCount:        int64(len(m.roundTripTimes)),
 		GoalToMovementCount:       int64(len(m.goalToMovementDelays)),
+		TrackingErrorRMS:          m.trackingErrorRMS(),
+		MaxTrackingError:          m.maxTrackingError,
+		ControlEffort:             m.controlEffort,
+		MechanicalEnergy:          m.mechanicalEnergy,
+		InvalidTrajectories:       m.invalidTrajectories,
+		MissedDeadlines:           m.missedDeadlines,
 	}
 }
 
@@ -158,4 +289,10 @@ type MessageMetricsReport struct {
 	ScenarioMessageCount      int64         `json:"scenarioMessageCount"`
 	RoundTripTimeCount        int64         `json:"roundTripTimeCount"`
 	GoalToMovementCount       int64         `json:"goalToMovementCount"`
+	TrackingErrorRMS          float64       `json:"trackingErrorRms"`
+	MaxTrackingError          float64       `json:"maxTrackingError"`
+	ControlEffort             float64       `json:"controlEffort"`    // Integral of force squared
+	MechanicalEnergy          float64       `json:"mechanicalEnergy"` // Integral of absolute force times velocity
+	InvalidTrajectories       int64         `json:"invalidTrajectories"`
+	MissedDeadlines           int64         `json:"missedDeadlines"` // Timed movements that arrived late, moving as fast as possible
 }
@@ -1,14 +1,40 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"math"
+	"slices"
+	"strings"
 	"time"
 )
 
 type MovementPlanner struct {
 	max_jerk         float64
 	max_acceleration float64
+	max_deceleration float64 // Limit while slowing down, may be harder than max_acceleration
 	max_velocity     float64
+	speedLimits      []SpeedZone // Lower velocity limits on parts of the track
+
+	clock Clock // Time source for trajectory start times
+}
+
+// SpeedZone is a stretch of track with its own velocity limit
+type SpeedZone struct {
+	Start       float64 `json:"start"`
+	End         float64 `json:"end"`
+	MaxVelocity float64 `json:"maxVelocity"`
+}
+
+// validate checks a speed zone
+func (z SpeedZone) validate() error {
+	if z.Start >= z.End {
+		return fmt.Errorf("speed zone [%.2f, %.2f] is empty", z.Start, z.End)
+	}
+	if z.MaxVelocity <= 0 {
+		return fmt.Errorf("speed zone [%.2f, %.2f] needs a positive maximum velocity", z.Start, z.End)
+	}
+	return nil
 }
 
 type internalState struct {
@@ -43,10 +69,17 @@ type Trajectory struct {
 	end   float64          // Start and end positions of the trajectory
 	state [8]internalState // States at each phase end (position, velocity, acceleration)
 	t0    time.Time        // Start time of the trajectory
+	clock Clock            // Clock the trajectory is evaluated against
 
 	tjStop1, taStop, tjStop2, tj, ta, tv float64
 
 	isStopping bool // Whether this trajectory is a stopping trajectory
+	fromState  bool // Whether this trajectory starts from a moving state, its phases are not symmetric
+
+	segments []*Trajectory // Consecutive segments of a multi-waypoint trajectory, state times are from t0
+	label    string        // Names a segment's start, a waypoint or a speed zone
+
+	limits TrajectoryLimits // Planner limits the trajectory was planned with
 }
 
 type TrajectoryType int
@@ -59,19 +92,72 @@ const (
 )
 
 // NewMovementPlanner creates a new MPC instance with the given parameters
-func NewMovementPlanner(max_jerk, max_acceleration, max_velocity float64) *MovementPlanner {
+func NewMovementPlanner(max_jerk, max_acceleration, max_velocity float64, clock Clock) *MovementPlanner {
 	return &MovementPlanner{
 		max_jerk:         max_jerk,
 		max_acceleration: max_acceleration,
+		max_deceleration: max_acceleration,
 		max_velocity:     max_velocity,
+		clock:            clock,
+	}
+}
+
+// symmetric reports whether braking mirrors accelerating everywhere on the track,
+// which the point to point and stopping calculations below rely on
+func (mpc *MovementPlanner) symmetric() bool {
+	return mpc.max_deceleration == mpc.max_acceleration && len(mpc.speedLimits) == 0
+}
+
+// limits returns the planner's limits, as recorded on the trajectories it plans
+func (mpc *MovementPlanner) limits() TrajectoryLimits {
+	return TrajectoryLimits{
+		Jerk:         mpc.max_jerk,
+		Acceleration: mpc.max_acceleration,
+		Deceleration: mpc.max_deceleration,
+		Velocity:     mpc.max_velocity,
+		SpeedLimits:  slices.Clone(mpc.speedLimits),
 	}
 }
 
+// speedLimitBetween is the velocity limit for travelling between two positions
+func (mpc *MovementPlanner) speedLimitBetween(a, b float64) float64 {
+	low, high := min(a, b), max(a, b)
+	limit := mpc.max_velocity
+	for _, zone := range mpc.speedLimits {
+		overlaps := zone.Start < high && zone.End > low
+		if low == high {
+			overlaps = zone.Start <= low && low <= zone.End
+		}
+		if overlaps {
+			limit = min(limit, zone.MaxVelocity)
+		}
+	}
+	return limit
+}
+
+// zoneBoundaries returns the speed zone boundaries strictly between from and to, in the order they are crossed
+func (mpc *MovementPlanner) zoneBoundaries(from, to float64) []float64 {
+	var boundaries []float64
+	for _, zone := range mpc.speedLimits {
+		for _, boundary := range []float64{zone.Start, zone.End} {
+			if min(from, to) < boundary && boundary < max(from, to) && !slices.Contains(boundaries, boundary) {
+				boundaries = append(boundaries, boundary)
+			}
+		}
+	}
+	slices.Sort(boundaries)
+	if to < from {
+		slices.Reverse(boundaries)
+	}
+	return boundaries
+}
+
 func (mpc *MovementPlanner) GetStationaryTrajectory(point float64) *Trajectory {
 	// Create a stationary trajectory at the given point
 	return &Trajectory{
-		end: point,
-		t0:  time.Now(),
+		end:   point,
+		t0:    mpc.clock.Now(),
+		clock: mpc.clock,
 		state: [8]internalState{
 			{t: 0, p: point, v: 0, a: 0, j: 0},
 			{t: 0, p: point, v: 0, a: 0, j: 0},
@@ -88,11 +174,18 @@ func (mpc *MovementPlanner) GetStationaryTrajectory(point float64) *Trajectory {
 		tj:      0,
 		ta:      0,
 		tv:      0,
+
+		limits: mpc.limits(),
 	}
 }
 
 func (mpc *MovementPlanner) CalculatePointToPointTrajectory(start float64, end float64) *Trajectory {
-	t0 := time.Now()
+	// Asymmetric limits and speed zones break the symmetric profile below
+	if !mpc.symmetric() {
+		return mpc.planRoute(internalState{p: start}, []Waypoint{{Position: end}})
+	}
+
+	t0 := mpc.clock.Now()
 
 	s := math.Abs(end - start)
 
@@ -171,8 +264,9 @@ func (mpc *MovementPlanner) CalculatePointToPointTrajectory(start float64, end f
 	afterDecreasingDeceleration.moveStateForward(0, 0)
 
 	tr := &Trajectory{
-		end: end,
-		t0:  t0,
+		end:   end,
+		t0:    t0,
+		clock: mpc.clock,
 		state: [8]internalState{
 			initialState,
 			afterIncreasingAcceleration,
@@ -186,10 +280,548 @@ func (mpc *MovementPlanner) CalculatePointToPointTrajectory(start float64, end f
 		tj: tj,
 		ta: ta,
 		tv: tv,
+
+		limits: mpc.limits(),
 	}
 	return tr
 }
+
+// jerkPhase is a stretch of constant jerk
+type jerkPhase struct {
+	dt float64
+	j  float64
+}
+
+// CalculateTrajectoryFromState plans a jerk-limited trajectory from an arbitrary
+// (p, v, a) state to rest at end, reversing direction if needed.
+func (mpc *MovementPlanner) CalculateTrajectoryFromState(initial internalState, end float64) *Trajectory {
+	// From standstill this is the ordinary point to point trajectory
+	if math.Abs(initial.v) < 1e-9 && math.Abs(initial.a) < 1e-9 {
+		return mpc.CalculatePointToPointTrajectory(initial.p, end)
+	}
+
+	return mpc.planRoute(initial, []Waypoint{{Position: end}})
+}
+
+// calculateSegment plans from an arbitrary (p, v, a) state to position end,
+// arriving there with velocity vEnd and zero acceleration, no faster than vmax.
+// State times continue from initial.t.
+//
+// The phases are the same as for point to point trajectories: three jerk phases
+// that take the initial velocity and acceleration to a peak velocity at zero
+// acceleration, a constant velocity phase and three jerk phases to vEnd.
+// The peak velocity is found from the distance travelled, see peakVelocity.
+func (mpc *MovementPlanner) calculateSegment(initial internalState, end, vEnd, vmax float64) *Trajectory {
+	s := end - initial.p
+
+	// distance travelled with peak velocity vp and no constant velocity phase
+	distance := func(vp float64) float64 {
+		state := internalState{v: initial.v, a: initial.a}
+		for _, phase := range mpc.velocityChangePhases(initial.v, initial.a, vp) {
+			state = state.moveStateForward(phase.dt, phase.j)
+		}
+		for _, phase := range mpc.velocityChangePhases(vp, 0, vEnd) {
+			state = state.moveStateForward(phase.dt, phase.j)
+		}
+		return state.p
+	}
+
+	var vp, tv float64
+	if reach := distance(vmax); s >= reach {
+		vp = vmax
+		tv = (s - reach) / vmax
+	} else if reach := distance(-vmax); s <= reach {
+		vp = -vmax
+		tv = (s - reach) / -vmax
+	} else {
+		vp = mpc.peakVelocity(initial, vEnd, vmax, s, distance)
+	}
+
+	accelerate := mpc.velocityChangePhases(initial.v, initial.a, vp)
+	decelerate := mpc.velocityChangePhases(vp, 0, vEnd)
+	phases := []jerkPhase{accelerate[0], accelerate[1], accelerate[2], {dt: tv}, decelerate[0], decelerate[1], decelerate[2]}
+
+	var states [8]internalState
+	states[0] = internalState{t: initial.t, p: initial.p, v: initial.v, a: initial.a}
+	for i, phase := range phases {
+		states[i+1] = states[i].moveStateForward(phase.dt, phase.j)
+	}
+
+	// Fix the final state's jerk to zero and remove the bisection's residue
+	states[7].moveStateForward(0, 0)
+	states[7].p = end
+	states[7].v = vEnd
+	states[7].a = 0
+
+	return &Trajectory{
+		end:       end,
+		clock:     mpc.clock,
+		state:     states,
+		tj:        accelerate[0].dt,
+		ta:        accelerate[1].dt,
+		tv:        tv,
+		fromState: true,
+
+		limits: mpc.limits(),
+	}
+}
+
+// peakVelocity finds the peak velocity whose profile without a constant velocity
+// phase travels s. The distance is not monotonic in the peak velocity between
+// and around the initial and end velocities, so every crossing on a grid is
+// bisected and the fastest profile is kept.
+func (mpc *MovementPlanner) peakVelocity(initial internalState, vEnd, vmax, s float64, distance func(float64) float64) float64 {
+	duration := func(vp float64) float64 {
+		total := 0.0
+		for _, phase := range mpc.velocityChangePhases(initial.v, initial.a, vp) {
+			total += phase.dt
+		}
+		for _, phase := range mpc.velocityChangePhases(vp, 0, vEnd) {
+			total += phase.dt
+		}
+		return total
+	}
+
+	const steps = 100
+	grid := []float64{max(-vmax, min(vmax, initial.v)), max(-vmax, min(vmax, vEnd))}
+	for k := 0; k <= steps; k++ {
+		grid = append(grid, -vmax+2*vmax*float64(k)/steps)
+	}
+	slices.Sort(grid)
+
+	const tolerance = 1e-6
+	best, bestTime, bestMiss := 0.0, math.Inf(1), math.Inf(1)
+	consider := func(vp float64) {
+		miss, time := math.Abs(distance(vp)-s), duration(vp)
+		if miss < bestMiss && bestMiss >= tolerance || miss < tolerance && time < bestTime {
+			best, bestTime, bestMiss = vp, time, miss
+		}
+	}
+	for i, vp := range grid {
+		consider(vp)
+		if i == 0 || (distance(grid[i-1]) < s) == (distance(vp) < s) {
+			continue
+		}
+		low, high := grid[i-1], vp
+		below := distance(low) < s
+		for j := 0; j < 60; j++ {
+			middle := (low + high) / 2
+			if (distance(middle) < s) == below {
+				low = middle
+			} else {
+				high = middle
+			}
+		}
+		consider((low + high) / 2)
+	}
+	return best
+}
+
+// Waypoint is a point on a multi-waypoint path
+type Waypoint struct {
+	Position float64  `json:"position"`
+	Velocity float64  `json:"velocity,omitempty"` // Speed to pass through with, zero stops at the waypoint
+	Dwell    Duration `json:"dwell,omitempty"`    // Time to stay at a stop waypoint
+}
+
+// validatePath checks a path's waypoints
+func validatePath(path []Waypoint) error {
+	if len(path) == 0 {
+		return fmt.Errorf("path has no waypoints")
+	}
+	for i, waypoint := range path {
+		if waypoint.Velocity < 0 || waypoint.Dwell < 0 {
+			return fmt.Errorf("waypoint %d: velocity and dwell must not be negative", i+1)
+		}
+		if waypoint.Velocity > 0 && waypoint.Dwell > 0 {
+			return fmt.Errorf("waypoint %d: a pass-through waypoint cannot dwell", i+1)
+		}
+	}
+	return nil
+}
+
+// pathExtent returns the leftmost and rightmost waypoint
+func pathExtent(path []Waypoint) (float64, float64) {
+	low, high := path[0].Position, path[0].Position
+	for _, waypoint := range path[1:] {
+		low = min(low, waypoint.Position)
+		high = max(high, waypoint.Position)
+	}
+	return low, high
+}
+
+// describePath formats a path for logs, pass-through waypoints as position@velocity
+// and dwells as position+dwell
+func describePath(path []Waypoint) string {
+	if len(path) == 1 {
+		return fmt.Sprintf("%.2f", path[0].Position)
+	}
+	parts := make([]string, len(path))
+	for i, waypoint := range path {
+		parts[i] = fmt.Sprintf("%.2f", waypoint.Position)
+		if waypoint.Velocity > 0 {
+			parts[i] += fmt.Sprintf("@%.0f", waypoint.Velocity)
+		} else if waypoint.Dwell > 0 {
+			parts[i] += "+" + time.Duration(waypoint.Dwell).String()
+		}
+	}
+	return strings.Join(parts, " -> ")
+}
+
+// CalculateWaypointTrajectory plans one continuous jerk-limited trajectory from an
+// arbitrary (p, v, a) state through the waypoints. Pass-through waypoints are
+// crossed with their velocity, lowered where the segments are too short to
+// reach it or where the path turns back; the last waypoint is always a stop.
+func (mpc *MovementPlanner) CalculateWaypointTrajectory(initial internalState, path []Waypoint) *Trajectory {
+	if len(path) == 1 {
+		return mpc.CalculateTrajectoryFromState(initial, path[0].Position)
+	}
+	return mpc.planRoute(initial, path)
+}
+
+// routePoint is a point the planner passes on its way through a path
+type routePoint struct {
+	position float64
+	velocity float64  // Signed velocity to pass with, zero stops
+	dwell    Duration // Time to stay at a stop
+	limit    float64  // Velocity limit on the way to this point
+	label    string   // Names the segment that starts here, for display
+}
+
+// planRoute plans from an arbitrary state through the waypoints. Speed zone
+// boundaries on the way become extra pass-through points, so that every
+// segment lies within one zone and keeps to its limit.
+func (mpc *MovementPlanner) planRoute(initial internalState, path []Waypoint) *Trajectory {
+	points := []routePoint{{position: initial.p, velocity: initial.v}}
+
+	// A cart that has to turn back for the first waypoint, or cannot stop before
+	// it, runs on past where it is. Where that could take it into a speed zone,
+	// it first comes to rest, so that no leg turns back within itself.
+	if len(mpc.speedLimits) > 0 && len(path) > 0 {
+		stop := initial
+		for _, phase := range mpc.velocityChangePhases(initial.v, initial.a, 0) {
+			stop = stop.moveStateForward(phase.dt, phase.j)
+		}
+		ahead, run := path[0].Position-initial.p, stop.p-initial.p
+		if ahead*run < 0 || math.Abs(run) > math.Abs(ahead) {
+			points = append(points, routePoint{position: stop.p, limit: mpc.speedLimitBetween(initial.p, stop.p)})
+		}
+	}
+
+	for i, waypoint := range path {
+		from := points[len(points)-1].position
+		for _, boundary := range mpc.zoneBoundaries(from, waypoint.Position) {
+			points = append(points, routePoint{
+				position: boundary,
+				velocity: math.Copysign(mpc.max_velocity, boundary-from),
+				limit:    mpc.speedLimitBetween(points[len(points)-1].position, boundary),
+				label:    "speed limit",
+			})
+		}
+
+		velocity := 0.0
+		if i < len(path)-1 && waypoint.Velocity > 0 {
+			in := math.Copysign(1, waypoint.Position-from)
+			out := math.Copysign(1, path[i+1].Position-waypoint.Position)
+			if in == out {
+				velocity = in * waypoint.Velocity
+			}
+		}
+		label := ""
+		if len(path) > 1 {
+			label = fmt.Sprintf("waypoint %d", i+1)
+		}
+		points = append(points, routePoint{
+			position: waypoint.Position,
+			velocity: velocity,
+			dwell:    waypoint.Dwell,
+			limit:    mpc.speedLimitBetween(points[len(points)-1].position, waypoint.Position),
+			label:    label,
+		})
+	}
+
+	// A point is passed no faster than the limits on either side of it
+	for i := 1; i < len(points)-1; i++ {
+		if points[i].label == "speed limit" {
+			points[i].label = fmt.Sprintf("speed limit %.0f", points[i+1].limit)
+		}
+		speed := min(math.Abs(points[i].velocity), points[i].limit, points[i+1].limit)
+		points[i].velocity = math.Copysign(speed, points[i].velocity)
+	}
+
+	// Lower velocities that cannot be braked down to the next one, then ones that cannot be reached from the previous one
+	for i := len(points) - 2; i >= 1; i-- {
+		points[i].velocity = mpc.reachableSpeed(points[i].velocity, points[i+1].velocity, math.Abs(points[i+1].position-points[i].position), true)
+	}
+	for i := 1; i < len(points)-1; i++ {
+		previous := points[i-1].velocity
+		if i == 1 && previous*points[i].velocity <= 0 {
+			previous = 0 // An initial velocity the other way is handled by the segment planner
+		}
+		points[i].velocity = mpc.reachableSpeed(points[i].velocity, previous, math.Abs(points[i].position-points[i-1].position), false)
+	}
+
+	t0 := mpc.clock.Now()
+	state := initial
+	state.t = 0
+	label := ""
+	var segments []*Trajectory
+	for i, point := range points[1:] {
+		segment := mpc.calculateSegment(state, point.position, point.velocity, point.limit)
+		segment.label = label
+		segments = append(segments, segment)
+		state = segment.state[7]
+		label = point.label
+
+		if point.dwell > 0 && point.velocity == 0 && i < len(points)-2 {
+			dwell := internalState{t: state.t + time.Duration(point.dwell).Seconds(), p: state.p}
+			segments = append(segments, &Trajectory{
+				end:       state.p,
+				clock:     mpc.clock,
+				state:     [8]internalState{state, dwell, dwell, dwell, dwell, dwell, dwell, dwell},
+				fromState: true,
+				label:     label,
+
+				limits: mpc.limits(),
+			})
+			state = dwell
+			label = ""
+		}
+	}
+	for _, segment := range segments {
+		segment.t0 = t0
+	}
+	if len(segments) == 1 {
+		return segments[0]
+	}
+
+	final := segments[len(segments)-1].state[7]
+	return &Trajectory{
+		end:       final.p,
+		t0:        t0,
+		clock:     mpc.clock,
+		state:     [8]internalState{segments[0].state[0], final, final, final, final, final, final, final},
+		segments:  segments,
+		fromState: true,
+
+		limits: mpc.limits(),
+	}
+}
+
+// reachableSpeed lowers the signed velocity v until it can be changed to the
+// signed velocity other, in the same direction or zero, over the given distance.
+// Braking from v to other is held to the deceleration limit, speeding up from
+// other to v to the acceleration limit.
+func (mpc *MovementPlanner) reachableSpeed(v, other, distance float64, braking bool) float64 {
+	speed, otherSpeed := math.Abs(v), math.Abs(other)
+	if speed <= otherSpeed {
+		return v
+	}
+	changeDistance := func(speed float64) float64 {
+		from, to := speed, otherSpeed
+		if !braking {
+			from, to = otherSpeed, speed
+		}
+		state := internalState{v: from}
+		for _, phase := range mpc.velocityChangePhases(from, 0, to) {
+			state = state.moveStateForward(phase.dt, phase.j)
+		}
+		return state.p
+	}
+	if changeDistance(speed) <= distance {
+		return v
+	}
+	low, high := otherSpeed, speed
+	for i := 0; i < 50; i++ {
+		middle := (low + high) / 2
+		if changeDistance(middle) <= distance {
+			low = middle
+		} else {
+			high = middle
+		}
+	}
+	return math.Copysign(low, v)
+}
+
+// velocityChangePhases returns the time-optimal jerk phases (increasing,
+// constant and decreasing acceleration) that take velocity v0 and
+// acceleration a0 to velocity v1 at zero acceleration
+func (mpc *MovementPlanner) velocityChangePhases(v0, a0, v1 float64) [3]jerkPhase {
+	jerk := mpc.max_jerk
+
+	// Speeding up is held to the acceleration limit, slowing down to the deceleration limit
+	amax := mpc.max_acceleration
+	if v0*v1 < 0 {
+		amax = min(mpc.max_acceleration, mpc.max_deceleration)
+	} else if math.Abs(v1) < math.Abs(v0) {
+		amax = mpc.max_deceleration
+	}
+
+	// Accelerate if bringing the acceleration to zero right away would stay below v1, otherwise decelerate
+	direction := 1.0
+	if v1 < v0+a0*math.Abs(a0)/(2*jerk) {
+		direction = -1.0
+	}
+
+	// Mirror the problem so that it always accelerates
+	v0, a0, v1 = direction*v0, direction*a0, direction*v1
+
+	// Peak acceleration without a constant acceleration phase, limited by amax
+	peak := math.Sqrt(math.Max(0, (2*jerk*(v1-v0)+a0*a0)/2))
+	peak = math.Min(peak, amax)
+
+	rise := math.Abs(peak-a0) / jerk
+	riseJerk := jerk
+	if peak < a0 {
+		riseJerk = -jerk
+	}
+	fall := peak / jerk
+
+	// Velocity gained by the jerk phases, the rest is made up at constant acceleration
+	gained := a0*rise + 0.5*riseJerk*rise*rise + peak*peak/(2*jerk)
+	var constant float64
+	if peak > 0 {
+		constant = math.Max(0, (v1-v0-gained)/peak)
+	}
+
+	return [3]jerkPhase{
+		{dt: rise, j: direction * riseJerk},
+		{dt: constant, j: 0},
+		{dt: fall, j: -direction * jerk},
+	}
+}
+
+// StoppingPosition returns where a cart in the given state comes to rest when it
+// brakes as hard as the limits allow
+func (mpc *MovementPlanner) StoppingPosition(state internalState) float64 {
+	for _, phase := range mpc.velocityChangePhases(state.v, state.a, 0) {
+		state = state.moveStateForward(phase.dt, phase.j)
+	}
+	return state.p
+}
+
+// calculateStoppingTrajectoryFromState brings a trajectory that started from a
+// moving state to rest, its phases cannot be reused like a point to point one's
+func (mpc *MovementPlanner) calculateStoppingTrajectoryFromState(previousTrajectory *Trajectory) *Trajectory {
+	initialState := previousTrajectory.GetCurrentState()
+	initialState.t = 0
+
+	stop := mpc.velocityChangePhases(initialState.v, initialState.a, 0)
+	afterFirstBrakingJerk := initialState.moveStateForward(stop[0].dt, stop[0].j)
+	afterConstantBrakingDeceleration := afterFirstBrakingJerk.moveStateForward(stop[1].dt, stop[1].j)
+	afterSecondBrakingJerk := afterConstantBrakingDeceleration.moveStateForward(stop[2].dt, stop[2].j)
+
+	// Fix the final state's jerk to zero
+	afterSecondBrakingJerk.moveStateForward(0, 0)
+
+	return &Trajectory{
+		end:   afterSecondBrakingJerk.p, // end position is the final position after stopping
+		t0:    mpc.clock.Now(),
+		clock: mpc.clock,
+		state: [8]internalState{
+			initialState,
+			afterFirstBrakingJerk,
+			afterConstantBrakingDeceleration,
+			afterSecondBrakingJerk,
+			afterSecondBrakingJerk,
+			afterSecondBrakingJerk,
+			afterSecondBrakingJerk,
+			afterSecondBrakingJerk,
+		},
+		tjStop1: stop[0].dt,
+		taStop:  stop[1].dt,
+		tjStop2: stop[2].dt,
+
+		isStopping: true,
+		fromState:  true,
+
+		limits: mpc.limits(),
+	}
+}
+
+// ErrDeadlineInfeasible is returned when a timed trajectory cannot arrive in time
+var ErrDeadlineInfeasible = errors.New("deadline cannot be met")
+
+// CalculateTimedTrajectory plans a trajectory from rest at start to rest at end
+// that takes exactly duration. The velocity, acceleration and deceleration limits
+// are scaled down by a common factor until the time-optimal profile takes that long; the
+// jerk limit is kept, so the phase structure and stopping stay the same.
+func (mpc *MovementPlanner) CalculateTimedTrajectory(start, end float64, duration time.Duration) (*Trajectory, error) {
+	fastest := mpc.CalculatePointToPointTrajectory(start, end)
+	seconds := duration.Seconds()
+	if start == end || fastest.state[7].t == seconds {
+		return fastest, nil
+	}
+	if fastest.state[7].t > seconds {
+		return nil, fmt.Errorf("%w: moving from %.2f to %.2f takes at least %v, not %v", ErrDeadlineInfeasible,
+			start, end, time.Duration(fastest.state[7].t*float64(time.Second)).Round(time.Millisecond), duration)
+	}
+
+	scaled := *mpc
+	scaled.speedLimits = slices.Clone(mpc.speedLimits)
+	plan := func(scale float64) *Trajectory {
+		scaled.max_velocity = mpc.max_velocity * scale
+		scaled.max_acceleration = mpc.max_acceleration * scale
+		scaled.max_deceleration = mpc.max_deceleration * scale
+		for i, zone := range mpc.speedLimits {
+			scaled.speedLimits[i].MaxVelocity = zone.MaxVelocity * scale
+		}
+		return scaled.CalculatePointToPointTrajectory(start, end)
+	}
+
+	low, high := 0.0, 1.0
+	for i := 0; i < 60; i++ {
+		scale := (low + high) / 2
+		if plan(scale).state[7].t > seconds {
+			low = scale
+		} else {
+			high = scale
+		}
+	}
+	return plan(high), nil
+}
+
+// CalculateTrajectoryArrivingAt plans a trajectory from rest at start that comes to rest at end at the given time
+func (mpc *MovementPlanner) CalculateTrajectoryArrivingAt(start, end float64, arrival time.Time) (*Trajectory, error) {
+	return mpc.CalculateTimedTrajectory(start, end, arrival.Sub(mpc.clock.Now()))
+}
+
+// TimeToReach returns the seconds since t0 at which the trajectory first reaches
+// position, or false if it never does
+func (trajectory Trajectory) TimeToReach(position float64) (float64, bool) {
+	const step = 0.005
+	end := trajectory.state[7].t
+	side := func(t float64) bool { return trajectory.calculateStateAtTime(t).p >= position }
+	initial := side(0)
+	for previous := 0.0; previous < end; previous += step {
+		t := min(previous+step, end)
+		if side(t) == initial {
+			continue
+		}
+		// Narrow the crossing down within the step
+		low, high := previous, t
+		for i := 0; i < 30; i++ {
+			middle := (low + high) / 2
+			if side(middle) == initial {
+				low = middle
+			} else {
+				high = middle
+			}
+		}
+		return high, true
+	}
+	return 0, false
+}
+
 func (mpc *MovementPlanner) CalculateStoppingTrajectory(previousTrajectory *Trajectory) *Trajectory {
+	// If the previous trajectory started from a moving state, or braking differs from
+	// accelerating, stop from its current state. Braking at the deceleration limit never
+	// speeds up, and a trajectory that keeps to the speed zones already slows down for
+	// them at that limit, so the stop keeps to them as well.
+	if previousTrajectory.fromState || !mpc.symmetric() {
+		return mpc.calculateStoppingTrajectoryFromState(previousTrajectory)
+	}
+
 	// If the previous trajectory is a stopping trajectory, calculate from it
 	if previousTrajectory.isStopping {
 		return mpc.calculateStoppingTrajectoryFromStoppingTrajectory(previousTrajectory)
@@ -200,11 +832,11 @@ func (mpc *MovementPlanner) CalculateStoppingTrajectory(previousTrajectory *Traj
 }
 
 func (mpc *MovementPlanner) calculateStoppingTrajectoryFromStoppingTrajectory(previousTrajectory *Trajectory) *Trajectory {
-	t0 := time.Now()
+	t0 := mpc.clock.Now()
 
 	// calculate the stopping times
 
-	previousTrajectoryTime := time.Since(previousTrajectory.t0).Seconds()
+	previousTrajectoryTime := previousTrajectory.clock.Since(previousTrajectory.t0).Seconds()
 	// tjStop1 is to bring us to maximum deceleration,
 	// tjStop2 is to bring acceleration and velocity both back to zero
 	var tjStop1, taStop, tjStop2 float64
@@ -254,8 +886,9 @@ func (mpc *MovementPlanner) calculateStoppingTrajectoryFromStoppingTrajectory(pr
 	afterSecondBrakingJerk.moveStateForward(0, 0)
 
 	tr := &Trajectory{
-		end: afterSecondBrakingJerk.p, // end position is the final position after stopping
-		t0:  t0,
+		end:   afterSecondBrakingJerk.p, // end position is the final position after stopping
+		t0:    t0,
+		clock: mpc.clock,
 		state: [8]internalState{
 			initialState,
 			afterFirstBrakingJerk,
@@ -267,19 +900,22 @@ func (mpc *MovementPlanner) calculateStoppingTrajectoryFromStoppingTrajectory(pr
 			afterSecondBrakingJerk,
 		},
 		tjStop1: tjStop1,
+		taStop:  taStop,
 		tjStop2: tjStop2,
 
 		isStopping: true,
+
+		limits: mpc.limits(),
 	}
 	return tr
 }
 
 func (mpc *MovementPlanner) calculateStoppingTrajectoryFromPointToPointTrajectory(previousTrajectory *Trajectory) *Trajectory {
-	t0 := time.Now()
+	t0 := mpc.clock.Now()
 
 	// calculate the stopping timesW
 
-	previousTrajectoryTime := time.Since(previousTrajectory.t0).Seconds()
+	previousTrajectoryTime := previousTrajectory.clock.Since(previousTrajectory.t0).Seconds()
 	// tjStop1 is to bring us to maximum deceleration,
 	// tjStop2 is to bring acceleration and velocity both back to zero
 	var tjStop1, taStop, tjStop2 float64
@@ -363,8 +999,9 @@ func (mpc *MovementPlanner) calculateStoppingTrajectoryFromPointToPointTrajector
 	afterSecondBrakingJerk.moveStateForward(0, 0)
 
 	tr := &Trajectory{
-		end: afterSecondBrakingJerk.p, // end position is the final position after stopping
-		t0:  t0,
+		end:   afterSecondBrakingJerk.p, // end position is the final position after stopping
+		t0:    t0,
+		clock: mpc.clock,
 		state: [8]internalState{
 			initialState,
 			afterFirstBrakingJerk,
@@ -376,9 +1013,12 @@ func (mpc *MovementPlanner) calculateStoppingTrajectoryFromPointToPointTrajector
 			afterSecondBrakingJerk,
 		},
 		tjStop1: tjStop1,
+		taStop:  taStop,
 		tjStop2: tjStop2,
 
 		isStopping: true,
+
+		limits: mpc.limits(),
 	}
 	return tr
 }
@@ -405,6 +1045,15 @@ func (initialState *internalState) moveStateForward(dt, jerk float64) internalSt
 }
 
 func (trajectory Trajectory) calculateStateAtTime(t float64) internalState {
+	// Multi-waypoint trajectories are evaluated in the segment that covers t
+	if len(trajectory.segments) > 0 && t > 0 {
+		for _, segment := range trajectory.segments {
+			if t <= segment.state[7].t {
+				return segment.calculateStateAtTime(t)
+			}
+		}
+	}
+
 	// Before the trajectory starts, return the initial state
 	if t <= 0 {
 		return trajectory.state[0]
@@ -428,10 +1077,15 @@ func (trajectory Trajectory) calculateStateAtTime(t float64) internalState {
 }
 
 func (trajectory Trajectory) GetCurrentState() internalState {
-	t := time.Since(trajectory.t0).Seconds()
+	t := trajectory.clock.Since(trajectory.t0).Seconds()
 	return trajectory.calculateStateAtTime(t)
 }
 
+// GetStateAt returns the planned state at time t, used to look ahead along the trajectory
+func (trajectory Trajectory) GetStateAt(t time.Time) internalState {
+	return trajectory.calculateStateAtTime(t.Sub(trajectory.t0).Seconds())
+}
+
 func (trajectory Trajectory) GetCurrentPosition() float64 {
 	return trajectory.GetCurrentState().p
 }
@@ -449,14 +1103,114 @@ func (trajectory Trajectory) GetCurrentJerk() float64 {
 }
 
 func (trajectory Trajectory) IsFinished() bool {
-	return time.Since(trajectory.t0).Seconds() >= trajectory.state[7].t
+	return trajectory.clock.Since(trajectory.t0).Seconds() >= trajectory.state[7].t
+}
+
+// TrajectoryPhase is a stretch of a trajectory with constant jerk, for display
+type TrajectoryPhase struct {
+	Start float64 // Seconds since the trajectory's t0
+	Name  string
+}
+
+// Phases lists the phases of a trajectory that starts from a moving state or
+// passes through waypoints. Their order is not fixed, so each phase is named
+// from its motion. The first phase of every segment names the waypoint or speed
+// zone it starts at.
+func (trajectory Trajectory) Phases() []TrajectoryPhase {
+	segments := trajectory.segments
+	if len(segments) == 0 {
+		segments = []*Trajectory{&trajectory}
+	}
+
+	var phases []TrajectoryPhase
+	for _, segment := range segments {
+		first := true
+		for phase := 1; phase <= 7; phase++ {
+			start := segment.state[phase-1].t
+			duration := segment.state[phase].t - start
+			if duration <= 1e-9 {
+				continue
+			}
+			name := segment.phaseName(phase, duration)
+			if first && segment.label != "" {
+				name = fmt.Sprintf("%s (%s)", name, segment.label)
+			}
+			first = false
+			phases = append(phases, TrajectoryPhase{Start: start, Name: name})
+		}
+	}
+	return phases
+}
+
+// phaseName describes the motion in a phase from its middle
+func (trajectory Trajectory) phaseName(phase int, duration float64) string {
+	middle := trajectory.calculateStateInPhase(phase, duration/2)
+	const epsilon = 1e-6
+	switch {
+	case middle.j == 0 && math.Abs(middle.a) < epsilon && math.Abs(middle.v) < epsilon:
+		return "Dwell"
+	case middle.j == 0 && math.Abs(middle.a) < epsilon:
+		return "Constant velocity"
+	}
+
+	kind := "acceleration"
+	if middle.a*middle.v < 0 {
+		kind = "deceleration"
+	}
+	switch {
+	case middle.j == 0:
+		return "Constant " + kind
+	case middle.j*middle.a > 0:
+		return "Increasing " + kind
+	default:
+		return "Decreasing " + kind
+	}
 }
 
+// GetBounds returns the smallest and largest position along the trajectory.
+// The extremes are at the ends or where the velocity crosses zero, which
+// a trajectory that reverses direction does in the middle of a phase.
 func (trajectory Trajectory) GetBounds() (float64, float64) {
-	start := trajectory.state[0].p
-	afterBraking := trajectory.state[3].p
-	end := trajectory.state[7].p
-	min := min(start, afterBraking, end)
-	max := max(start, afterBraking, end)
-	return min, max
+	if len(trajectory.segments) > 0 {
+		low, high := trajectory.segments[0].GetBounds()
+		for _, segment := range trajectory.segments[1:] {
+			segmentLow, segmentHigh := segment.GetBounds()
+			low = min(low, segmentLow)
+			high = max(high, segmentHigh)
+		}
+		return low, high
+	}
+
+	low := min(trajectory.state[0].p, trajectory.state[7].p)
+	high := max(trajectory.state[0].p, trajectory.state[7].p)
+	for phase := 1; phase <= 7; phase++ {
+		initialState := trajectory.state[phase-1]
+		duration := trajectory.state[phase].t - initialState.t
+		for _, dt := range velocityRoots(initialState.v, initialState.a, initialState.j) {
+			if dt > 0 && dt < duration {
+				p := trajectory.calculateStateInPhase(phase, dt).p
+				low = min(low, p)
+				high = max(high, p)
+			}
+		}
+		low = min(low, trajectory.state[phase].p)
+		high = max(high, trajectory.state[phase].p)
+	}
+	return low, high
+}
+
+// velocityRoots returns the times at which v + a*t + j*t²/2 is zero
+func velocityRoots(v, a, j float64) []float64 {
+	if j == 0 {
+		if a == 0 {
+			return nil
+		}
+		return []float64{-v / a}
+	}
+	discriminant := a*a - 2*j*v
+	if discriminant < 0 {
+		return nil
+	}
+	root := math.Sqrt(discriminant)
+	return []float64{(-a - root) / j, (-a + root) / j}
 }
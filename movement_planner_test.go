@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// plannerTestCount is how many trajectories of each kind the property test checks,
+// gocart check-planner checks many more
+const plannerTestCount = 500
+
+// TestPlannerProperties validates random trajectories of every kind from a fixed seed
+func TestPlannerProperties(t *testing.T) {
+	count := plannerTestCount
+	if testing.Short() {
+		count = 50
+	}
+	for _, check := range plannerCases() {
+		t.Run(check.Name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			clock := NewSimulatedClock()
+			invalid := 0
+			for i := 0; i < count; i++ {
+				mpc, trajectory, description := check.Generate(r, clock)
+				violations := validatePlannerCase(mpc, trajectory)
+				if len(violations) == 0 {
+					continue
+				}
+				invalid++
+				if invalid <= 3 {
+					t.Errorf("%s", description)
+					for _, violation := range violations {
+						t.Logf("  %s", violation)
+					}
+				}
+			}
+			if invalid > 0 {
+				t.Errorf("%d of %d trajectories invalid", invalid, count)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// =====================================================
+// NETWORK FAULT CONTROL
+// =====================================================
+
+// LinkNetwork is the network of one link between neighbouring carts. Link k
+// joins cart k and cart k+1.
+type LinkNetwork struct {
+	Link      int         `json:"link"`
+	LeftCart  int         `json:"leftCart"`
+	RightCart int         `json:"rightCart"`
+	Network   NetworkSpec `json:"network"`
+}
+
+// linkSimulators returns the simulators of one link, or of every link for link 0
+func (sm *ScenarioManager) linkSimulators(link int) ([]*NetworkDelaySimulator, error) {
+	sm.mu.RLock()
+	simulators := sm.networkSimulators
+	sm.mu.RUnlock()
+	if link == 0 {
+		return simulators, nil
+	}
+	if link < 1 || link > len(simulators) {
+		return nil, fmt.Errorf("link %d does not exist, there are %d", link, len(simulators))
+	}
+	return simulators[link-1 : link], nil
+}
+
+// LinkNetworks returns the network of every link
+func (sm *ScenarioManager) LinkNetworks() []LinkNetwork {
+	sm.mu.RLock()
+	simulators := sm.networkSimulators
+	controllers := sm.controllers
+	sm.mu.RUnlock()
+	links := []LinkNetwork{}
+	for i, networkSim := range simulators {
+		if i+1 >= len(controllers) {
+			break
+		}
+		links = append(links, LinkNetwork{
+			Link:      i + 1,
+			LeftCart:  controllers[i].Cart.Id,
+			RightCart: controllers[i+1].Cart.Id,
+			Network:   networkSpec(networkSim.Config()),
+		})
+	}
+	return links
+}
+
+// SetLinkNetwork changes the network of one running link. Link 0 changes every
+// link and the network of the carts set up later.
+func (sm *ScenarioManager) SetLinkNetwork(link int, config NetworkConfig) error {
+	simulators, err := sm.linkSimulators(link)
+	if err != nil {
+		return err
+	}
+	if link == 0 {
+		sm.setNetworkConfig(config)
+		sm.applyNetworkConfig()
+	} else {
+		simulators[0].setConfig(config)
+		log.Printf("[SCENARIO] Link %d network config updated: %s", link, config)
+	}
+	sm.notifyNetworkChange()
+	return nil
+}
+
+// PatchLinkNetwork changes some of a link's network settings, given in the
+// scenario file form. Setting one direction on its own starts from the shared settings.
+func (sm *ScenarioManager) PatchLinkNetwork(link int, patch []byte) (NetworkConfig, error) {
+	simulators, err := sm.linkSimulators(link)
+	if err != nil {
+		return NetworkConfig{}, err
+	}
+	config := sm.currentNetworkConfig
+	if link != 0 {
+		config = simulators[0].Config()
+	}
+	spec := networkSpec(config)
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return NetworkConfig{}, fmt.Errorf("invalid network settings: %w", err)
+	}
+	if _, ok := fields["leftToRight"]; ok && spec.LeftToRight == nil {
+		shared := spec.LinkSpec
+		spec.LeftToRight = &shared
+	}
+	if _, ok := fields["rightToLeft"]; ok && spec.RightToLeft == nil {
+		shared := spec.LinkSpec
+		spec.RightToLeft = &shared
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(patch)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return NetworkConfig{}, fmt.Errorf("invalid network settings: %w", err)
+	}
+	if err := spec.validate(); err != nil {
+		return NetworkConfig{}, err
+	}
+	config = spec.config()
+	return config, sm.SetLinkNetwork(link, config)
+}
+
+// ResetLinkNetwork returns a link, or every link for link 0, to the network the
+// carts were set up with
+func (sm *ScenarioManager) ResetLinkNetwork(link int) error {
+	return sm.SetLinkNetwork(link, sm.currentNetworkConfig)
+}
+
+// OnNetworkChange registers a function called with every link's network after a change
+func (sm *ScenarioManager) OnNetworkChange(observer func([]LinkNetwork)) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.networkObservers = append(sm.networkObservers, observer)
+}
+
+// notifyNetworkChange tells the observers about the links' networks
+func (sm *ScenarioManager) notifyNetworkChange() {
+	sm.mu.RLock()
+	observers := sm.networkObservers
+	sm.mu.RUnlock()
+	if len(observers) == 0 {
+		return
+	}
+	links := sm.LinkNetworks()
+	for _, observer := range observers {
+		observer(links)
+	}
+}
+
+// =====================================================
+// SCHEDULED NETWORK FAULTS
+// =====================================================
+
+// NetworkFault changes the network of one link, or of every link, for part of a scenario
+type NetworkFault struct {
+	Link    int         `json:"link,omitempty"`  // Link k joins cart k and cart k+1, 0 for every link
+	From    Duration    `json:"from"`            // Time the timeline's waits spent since it started
+	Until   Duration    `json:"until,omitempty"` // When the link returns to the scenario's network, zero to keep the fault
+	Network NetworkSpec `json:"network"`
+}
+
+// validate checks a fault against the number of carts and the time the
+// timeline waits, only waits move the schedule along
+func (f NetworkFault) validate(carts int, timeline time.Duration) error {
+	if f.Link < 0 || f.Link > carts-1 {
+		return fmt.Errorf("link %d does not exist, there are %d", f.Link, carts-1)
+	}
+	if f.From < 0 || f.Until != 0 && f.Until <= f.From {
+		return fmt.Errorf("fault must satisfy 0 <= from < until")
+	}
+	if time.Duration(f.From) > timeline {
+		return fmt.Errorf("fault starts at %v, after the timeline's waits end at %v", time.Duration(f.From), timeline)
+	}
+	if time.Duration(f.Until) > timeline {
+		return fmt.Errorf("fault ends at %v, after the timeline's waits end at %v", time.Duration(f.Until), timeline)
+	}
+	return f.Network.validate()
+}
+
+// networkEvent is a scheduled change of a link's network
+type networkEvent struct {
+	at     time.Duration
+	link   int
+	config *NetworkConfig // Nil returns the link to the scenario's network
+}
+
+// faultSchedule applies a scenario's network faults while its timeline waits
+type faultSchedule struct {
+	events  []networkEvent // In time order
+	elapsed time.Duration  // Time since the timeline started
+}
+
+func newFaultSchedule(faults []NetworkFault) *faultSchedule {
+	schedule := &faultSchedule{}
+	for _, fault := range faults {
+		config := fault.Network.config()
+		schedule.events = append(schedule.events, networkEvent{at: time.Duration(fault.From), link: fault.Link, config: &config})
+		if fault.Until > 0 {
+			schedule.events = append(schedule.events, networkEvent{at: time.Duration(fault.Until), link: fault.Link})
+		}
+	}
+	slices.SortStableFunc(schedule.events, func(a, b networkEvent) int {
+		return cmp.Compare(a.at, b.at)
+	})
+	return schedule
+}
+
+// wait sleeps for d, changing the links' networks as their faults start and end
+func (s *faultSchedule) wait(sm *ScenarioManager, d time.Duration) {
+	end := s.elapsed + d
+	for len(s.events) > 0 && s.events[0].at <= end {
+		event := s.events[0]
+		s.events = s.events[1:]
+		if event.at > s.elapsed {
+			sm.clock.Sleep(event.at - s.elapsed)
+			s.elapsed = event.at
+		}
+
+		// A fault on every link changes them one by one, the scenario's network stays what they return to
+		links := []int{event.link}
+		if event.link == 0 {
+			links = links[:0]
+			for link := range sm.networkSimulators {
+				links = append(links, link+1)
+			}
+		}
+		for _, link := range links {
+			var err error
+			if event.config == nil {
+				log.Printf("[SCENARIO] Network fault on link %d ends at %v", link, event.at)
+				err = sm.ResetLinkNetwork(link)
+			} else {
+				log.Printf("[SCENARIO] Network fault on link %d starts at %v", link, event.at)
+				err = sm.SetLinkNetwork(link, *event.config)
+			}
+			if err != nil {
+				log.Printf("[SCENARIO] Network fault not applied: %v", err)
+			}
+		}
+	}
+	if end > s.elapsed {
+		sm.clock.Sleep(end - s.elapsed)
+	}
+	s.elapsed = end
+}
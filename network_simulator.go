@@ -2,91 +2,407 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"math"
 	"math/rand/v2"
+	"strings"
+	"sync"
 	"time"
 )
 
-// NetworkDelaySimulator simulates network delays for requests and responses
+// Direction is the way a message travels over a link between neighbours
+type Direction int
+
+const (
+	LeftToRight Direction = iota // From the left cart to the right one
+	RightToLeft
+)
+
+func (d Direction) String() string {
+	if d == LeftToRight {
+		return "left to right"
+	}
+	return "right to left"
+}
+
+// DelayDistribution is how message delays spread between the minimum and maximum delay
+type DelayDistribution string
+
+const (
+	UniformDelay DelayDistribution = "uniform" // Any delay in the range is as likely
+	NormalDelay  DelayDistribution = "normal"  // Centred in the range, within it
+	ParetoDelay  DelayDistribution = "pareto"  // Half the delays below the middle of the range, a long tail far beyond it
+)
+
+// paretoShape is the tail index of ParetoDelay, low enough for the odd very late message
+const paretoShape = 1.5
+
+// BurstLoss is the Gilbert-Elliott loss model: before each message the link may
+// switch between a good and a bad state, and it loses messages with the
+// probability of the state it is in, so losses come in bursts
+type BurstLoss struct {
+	GoodToBad float64 `json:"goodToBad"` // Probability of turning bad before a message
+	BadToGood float64 `json:"badToGood"` // Probability of recovering before a message
+	GoodLoss  float64 `json:"goodLoss"`  // Loss probability while good, usually zero
+	BadLoss   float64 `json:"badLoss"`   // Loss probability while bad, usually close to one
+}
+
+// validate checks the probabilities
+func (b BurstLoss) validate() error {
+	names := []string{"goodToBad", "badToGood", "goodLoss", "badLoss"}
+	for i, p := range []float64{b.GoodToBad, b.BadToGood, b.GoodLoss, b.BadLoss} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("burst loss %s must be between 0 and 1", names[i])
+		}
+	}
+	return nil
+}
+
+// LinkConfig describes the faults of one direction of a link between neighbours
+type LinkConfig struct {
+	MinDelay             time.Duration
+	MaxDelay             time.Duration
+	DelayDistribution    DelayDistribution // Defaults to UniformDelay
+	LossProbability      float64           // Independent loss of each message
+	BurstLoss            *BurstLoss        // Losses in bursts, on top of the independent ones
+	DuplicateProbability float64           // Probability that a message arrives twice
+	ReorderProbability   float64           // Probability that a message is held back by ReorderDelay, so later ones overtake it
+	ReorderDelay         time.Duration
+	Bandwidth            float64 // Messages per second the link carries, zero for no limit
+	Partitioned          bool    // Every message is lost, as if the link were cut
+	Manual               bool    // Messages wait in the message queue until an operator delivers them
+}
+
+// NetworkConfig holds network simulation parameters for scenarios. The link
+// settings apply to both directions unless a direction has its own.
+type NetworkConfig struct {
+	LinkConfig
+	LeftToRight *LinkConfig // Replaces the shared settings for messages to the right
+	RightToLeft *LinkConfig // Replaces the shared settings for messages to the left
+}
+
+// link returns the settings for one direction
+func (c NetworkConfig) link(direction Direction) LinkConfig {
+	if direction == LeftToRight && c.LeftToRight != nil {
+		return *c.LeftToRight
+	}
+	if direction == RightToLeft && c.RightToLeft != nil {
+		return *c.RightToLeft
+	}
+	return c.LinkConfig
+}
+
+func (c LinkConfig) String() string {
+	description := fmt.Sprintf("delay %v-%v", c.MinDelay, c.MaxDelay)
+	if c.DelayDistribution != "" && c.DelayDistribution != UniformDelay {
+		description += fmt.Sprintf(" (%s)", c.DelayDistribution)
+	}
+	description += fmt.Sprintf(", loss %.3f", c.LossProbability)
+	if c.BurstLoss != nil {
+		description += fmt.Sprintf(", burst loss %+v", *c.BurstLoss)
+	}
+	if c.DuplicateProbability > 0 {
+		description += fmt.Sprintf(", duplicates %.3f", c.DuplicateProbability)
+	}
+	if c.ReorderProbability > 0 {
+		description += fmt.Sprintf(", reordering %.3f by %v", c.ReorderProbability, c.ReorderDelay)
+	}
+	if c.Bandwidth > 0 {
+		description += fmt.Sprintf(", %.0f messages/s", c.Bandwidth)
+	}
+	if c.Partitioned {
+		description += ", partitioned"
+	}
+	if c.Manual {
+		description += ", manual"
+	}
+	return description
+}
+
+func (c NetworkConfig) String() string {
+	if c.LeftToRight == nil && c.RightToLeft == nil {
+		return c.LinkConfig.String()
+	}
+	return fmt.Sprintf("left to right: %s; right to left: %s", c.link(LeftToRight), c.link(RightToLeft))
+}
+
+// NetworkStats counts what happened to the messages sent over a link
+type NetworkStats struct {
+	Sent       int `json:"sent"`
+	Delivered  int `json:"delivered"`  // Including duplicates
+	Lost       int `json:"lost"`       // Lost on the way, independently, in a burst or to a partition
+	Duplicated int `json:"duplicated"` // Sent ones that arrived twice
+	Reordered  int `json:"reordered"`  // Held back so that later ones could overtake them
+	Overflowed int `json:"overflowed"` // Arrived when the receiver's queue was full
+}
+
+// linkState is one direction of a simulated link
+type linkState struct {
+	config LinkConfig
+	bad    bool      // Gilbert-Elliott state
+	freeAt time.Time // When the link has carried the messages queued on it
+	stats  NetworkStats
+}
+
+// NetworkDelaySimulator simulates the link between two neighbouring controllers
 type NetworkDelaySimulator struct {
-	minDelay        time.Duration
-	maxDelay        time.Duration
-	lossProbability float64 // Probability of packet loss (0.0 to 1.0)
+	config NetworkConfig
+	links  [2]linkState // Indexed by Direction
+
+	queue *MessageQueue // Holds the messages of manual directions, nil to ignore Manual
+	link  int           // Number of the link in the queue
+
+	clock Clock      // Time source for delivery delays
+	rng   *rand.Rand // Seeded source for delays and losses, so runs are repeatable
+	mu    sync.Mutex // Guards the links and rng
+
+	done     chan struct{} // Closed by Stop, ends the relays
+	stopOnce sync.Once
 }
 
-// NewNetworkDelaySimulator creates a new network intermediary with specified delay range
-func NewNetworkDelaySimulator(minDelay, maxDelay time.Duration, lossProbability float64) *NetworkDelaySimulator {
-	return &NetworkDelaySimulator{
-		minDelay:        minDelay,
-		maxDelay:        maxDelay,
-		lossProbability: lossProbability,
+// NewNetworkDelaySimulator creates a new network intermediary with the given faults
+func NewNetworkDelaySimulator(config NetworkConfig, clock Clock, seed uint64) *NetworkDelaySimulator {
+	n := &NetworkDelaySimulator{
+		clock: clock,
+		rng:   rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15)),
+		done:  make(chan struct{}),
 	}
+	n.setConfig(config)
+	return n
 }
 
-// getRandomDelay returns a random delay within the configured range
-func (n *NetworkDelaySimulator) getRandomDelay() time.Duration {
-	if n.maxDelay <= n.minDelay {
-		return n.minDelay
+// Stop ends the relays, messages sent afterwards are never taken off the link
+func (n *NetworkDelaySimulator) Stop() {
+	n.stopOnce.Do(func() { close(n.done) })
+}
+
+// setConfig changes the faults of a running simulator. Messages held on a
+// direction that is no longer manual go on over the link.
+func (n *NetworkDelaySimulator) setConfig(config NetworkConfig) {
+	n.mu.Lock()
+	n.config = config
+	var released []*HeldMessage
+	for direction := range n.links {
+		n.links[direction].config = config.link(Direction(direction))
+		if n.queue != nil && !n.links[direction].config.Manual {
+			released = append(released, n.queue.release(n, Direction(direction))...)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, message := range released {
+		log.Printf("[MESSAGES] Releasing #%d: %s", message.Id, message.Summary)
+		message.forward()
 	}
-	delayRange := n.maxDelay - n.minDelay
-	randomDelay := time.Duration(rand.Int64N(int64(delayRange)))
-	return n.minDelay + randomDelay
 }
 
-// relayRequests relays requests from input to output with random delays
-func (n *NetworkDelaySimulator) relayRequests(input <-chan Request, output chan<- Request) {
-	go func() {
-		for request := range input {
-			delay := n.getRandomDelay()
-			lossProbability := n.lossProbability
-			go func(req Request, d time.Duration) {
-				time.Sleep(d)
-
-				// Simulate packet loss by randomly dropping requests
-				if rand.Float64() < lossProbability {
-					fmt.Print("Request dropped due to simulated packet loss\n")
-					return
-				}
-
-				select {
-				case output <- req:
-					// Successfully forwarded
-				default:
-					// Output channel full, drop the request
-				}
-			}(request, delay)
+// useQueue makes the simulator hold the messages of its manual directions in
+// queue. Called before it relays any message.
+func (n *NetworkDelaySimulator) useQueue(queue *MessageQueue, link int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.queue = queue
+	n.link = link
+}
+
+// Config returns the faults the simulator currently applies
+func (n *NetworkDelaySimulator) Config() NetworkConfig {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.config
+}
+
+// Stats returns the message counts of one direction
+func (n *NetworkDelaySimulator) Stats(direction Direction) NetworkStats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.links[direction].stats
+}
+
+// getRandomDelay returns a random delay from the link's distribution
+func (n *NetworkDelaySimulator) getRandomDelay(config LinkConfig) time.Duration {
+	if config.MaxDelay <= config.MinDelay {
+		return config.MinDelay
+	}
+	delayRange := float64(config.MaxDelay - config.MinDelay)
+	var offset float64
+	switch config.DelayDistribution {
+	case NormalDelay:
+		offset = math.Min(math.Max(delayRange/2+n.rng.NormFloat64()*delayRange/6, 0), delayRange)
+	case ParetoDelay:
+		// Scaled so that the median is the middle of the range, capped to keep the odd outlier finite
+		scale := delayRange / 2 / (math.Pow(2, 1/paretoShape) - 1)
+		offset = math.Min(scale*(math.Pow(1-n.rng.Float64(), -1/paretoShape)-1), 100*delayRange)
+	default:
+		offset = float64(n.rng.Int64N(int64(delayRange)))
+	}
+	return config.MinDelay + time.Duration(offset)
+}
+
+// plan decides, when a message is sent, what happens to it: the delays after which
+// its copies arrive, or none and why if it is lost. Deciding at send time keeps the
+// random sequence independent of delivery order.
+func (n *NetworkDelaySimulator) plan(direction Direction) ([]time.Duration, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	link := &n.links[direction]
+	config := link.config
+
+	// Messages wait for the ones ahead of them on a link with limited bandwidth
+	var queueing time.Duration
+	if config.Bandwidth > 0 {
+		now := n.clock.Now()
+		start := link.freeAt
+		if start.Before(now) {
+			start = now
 		}
-	}()
+		link.freeAt = start.Add(time.Duration(float64(time.Second) / config.Bandwidth))
+		queueing = link.freeAt.Sub(now)
+	}
+
+	if config.BurstLoss != nil {
+		if link.bad {
+			link.bad = n.rng.Float64() >= config.BurstLoss.BadToGood
+		} else {
+			link.bad = n.rng.Float64() < config.BurstLoss.GoodToBad
+		}
+	}
+	lost := ""
+	switch {
+	case config.Partitioned:
+		lost = "network partition"
+	case n.rng.Float64() < config.LossProbability:
+		lost = "simulated packet loss"
+	case config.BurstLoss != nil && link.bad && n.rng.Float64() < config.BurstLoss.BadLoss:
+		lost = "burst loss"
+	case config.BurstLoss != nil && !link.bad && n.rng.Float64() < config.BurstLoss.GoodLoss:
+		lost = "simulated packet loss"
+	}
+	if lost != "" {
+		link.stats.Lost++
+		return nil, lost
+	}
+
+	delay := queueing + n.getRandomDelay(config)
+	if config.ReorderProbability > 0 && n.rng.Float64() < config.ReorderProbability {
+		link.stats.Reordered++
+		delay += config.ReorderDelay
+	}
+	deliveries := []time.Duration{delay}
+	if config.DuplicateProbability > 0 && n.rng.Float64() < config.DuplicateProbability {
+		link.stats.Duplicated++
+		deliveries = append(deliveries, queueing+n.getRandomDelay(config))
+	}
+	return deliveries, ""
+}
+
+// sent counts a message sent over the link, and holds it in the message queue
+// if its direction is manual. It tells whether the message was held.
+func (n *NetworkDelaySimulator) sent(direction Direction, message *HeldMessage) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[direction].stats.Sent++
+	if n.queue == nil || !n.links[direction].config.Manual {
+		return false
+	}
+	message.Link = n.link
+	n.queue.hold(message)
+	return true
+}
+
+// delivered records how a copy of a message was handed to the receiver
+func (n *NetworkDelaySimulator) delivered(direction Direction, overflowed bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if overflowed {
+		n.links[direction].stats.Overflowed++
+	} else {
+		n.links[direction].stats.Delivered++
+	}
+}
+
+// lost records a message an operator dropped
+func (n *NetworkDelaySimulator) lost(direction Direction) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[direction].stats.Lost++
+}
+
+// duplicated records a message an operator duplicated
+func (n *NetworkDelaySimulator) duplicated(direction Direction) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.links[direction].stats.Duplicated++
 }
 
-// relayResponses relays responses from input to output with random delays
-func (n *NetworkDelaySimulator) relayResponses(input <-chan Response, output chan<- Response) {
+// relay forwards messages from input to output as the link's faults dictate,
+// or holds them for an operator while the direction is manual
+func relay[M fmt.Stringer](n *NetworkDelaySimulator, direction Direction, kind string, input <-chan M, output chan<- M) {
 	go func() {
-		for response := range input {
-			delay := n.getRandomDelay()
-			lossProbability := n.lossProbability
-			go func(resp Response, d time.Duration) {
-				time.Sleep(d)
-
-				// Simulate packet loss by randomly dropping responses
-				if rand.Float64() < lossProbability {
-					fmt.Print("Response dropped due to simulated packet loss\n")
-					return
-				}
-
-				select {
-				case output <- resp:
-					// Successfully forwarded
-				default:
-					// Output channel full, drop the response
-				}
-			}(response, delay)
+		for {
+			var message M
+			select {
+			case <-n.done:
+				return
+			case message = <-input:
+			}
+			held := &HeldMessage{
+				Direction: direction.String(),
+				Kind:      strings.ToLower(kind),
+				Summary:   message.String(),
+				Message:   message,
+				network:   n,
+				direction: direction,
+				deliver:   func() { deliver(n, direction, kind, message, output) },
+				forward:   func() { send(n, direction, kind, message, output) },
+			}
+			if !n.sent(direction, held) {
+				held.forward()
+			}
 		}
 	}()
 }
 
+// send passes a message over the link's faults
+func send[M any](n *NetworkDelaySimulator, direction Direction, kind string, message M, output chan<- M) {
+	deliveries, lost := n.plan(direction)
+	if lost != "" {
+		fmt.Printf("%s dropped due to %s\n", kind, lost)
+		return
+	}
+	for _, delay := range deliveries {
+		go func(d time.Duration) {
+			n.clock.Sleep(d)
+			deliver(n, direction, kind, message, output)
+		}(delay)
+	}
+}
+
+// deliver hands a copy of a message to the receiver
+func deliver[M any](n *NetworkDelaySimulator, direction Direction, kind string, message M, output chan<- M) {
+	select {
+	case output <- message:
+		n.delivered(direction, false)
+	default:
+		// The receiver is not keeping up, the message is lost like on a real link
+		n.delivered(direction, true)
+		fmt.Printf("%s dropped, the receiver's queue is full (%s)\n", kind, direction)
+	}
+}
+
+// relayRequests relays requests travelling in one direction
+func (n *NetworkDelaySimulator) relayRequests(direction Direction, input <-chan Request, output chan<- Request) {
+	relay(n, direction, "Request", input, output)
+}
+
+// relayResponses relays responses travelling in one direction
+func (n *NetworkDelaySimulator) relayResponses(direction Direction, input <-chan Response, output chan<- Response) {
+	relay(n, direction, "Response", input, output)
+}
+
 func connectControllers(leftController, rightController *Controller) {
-	// Create network intermediaries with 10-50ms delay range
-	networkSim := NewNetworkDelaySimulator(10*time.Millisecond, 15*time.Millisecond, 0)
+	// Create network intermediaries with 10-15ms delay range
+	networkSim := NewNetworkDelaySimulator(NetworkConfig{LinkConfig: LinkConfig{MinDelay: 10 * time.Millisecond, MaxDelay: 15 * time.Millisecond}}, leftController.clock, uint64(leftController.Cart.Id))
 
 	// Create intermediate channels for the network simulation
 	leftToRightRequestIntermediate := make(chan Request, 10)
@@ -112,8 +428,8 @@ func connectControllers(leftController, rightController *Controller) {
 	rightController.IncomingLeftResponse = leftToRightResponse
 
 	// Set up network intermediaries to relay with delays
-	networkSim.relayRequests(leftToRightRequestIntermediate, leftToRightRequest)
-	networkSim.relayRequests(rightToLeftRequestIntermediate, rightToLeftRequest)
-	networkSim.relayResponses(leftToRightResponseIntermediate, leftToRightResponse)
-	networkSim.relayResponses(rightToLeftResponseIntermediate, rightToLeftResponse)
+	networkSim.relayRequests(LeftToRight, leftToRightRequestIntermediate, leftToRightRequest)
+	networkSim.relayRequests(RightToLeft, rightToLeftRequestIntermediate, rightToLeftRequest)
+	networkSim.relayResponses(LeftToRight, leftToRightResponseIntermediate, leftToRightResponse)
+	networkSim.relayResponses(RightToLeft, rightToLeftResponseIntermediate, rightToLeftResponse)
 }
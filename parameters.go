@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ControllerParameters are a controller's tunable settings. They can be read
+// and changed while the controller runs, changes take effect at its next tick.
+// Planner limits only apply to trajectories planned after the change.
+type ControllerParameters struct {
+	ControlLaw      ControlLawParameters `json:"controlLaw"`
+	FeedForward     FeedForward          `json:"feedForward"`
+	MaxJerk         float64              `json:"maxJerk"`
+	MaxAcceleration float64              `json:"maxAcceleration"`
+	MaxDeceleration float64              `json:"maxDeceleration"` // Limit while braking, including emergency stops
+	MaxVelocity     float64              `json:"maxVelocity"`
+	SpeedLimits     []SpeedZone          `json:"speedLimits,omitempty"` // Lower velocity limits on parts of the track
+	SafetyMargin    float64              `json:"safetyMargin"`          // Distance kept from the borders when accepting goals
+	BusyDwell       Duration             `json:"busyDwell"`             // Time spent busy at a reached goal
+}
+
+// defaultControllerParameters are the settings every controller starts with
+func defaultControllerParameters() ControllerParameters {
+	return ControllerParameters{
+		ControlLaw:      resolveControlLaw(ControlLawParameters{}),
+		MaxJerk:         200,
+		MaxAcceleration: 100,
+		MaxDeceleration: 100,
+		MaxVelocity:     300,
+		SafetyMargin:    30,
+		BusyDwell:       Duration(5000 * time.Millisecond),
+	}
+}
+
+// validate checks the parameters
+func (p ControllerParameters) validate() error {
+	if err := p.ControlLaw.validate(); err != nil {
+		return err
+	}
+	if p.MaxJerk <= 0 || p.MaxAcceleration <= 0 || p.MaxDeceleration <= 0 || p.MaxVelocity <= 0 {
+		return fmt.Errorf("planner limits must be positive")
+	}
+	for _, zone := range p.SpeedLimits {
+		if err := zone.validate(); err != nil {
+			return err
+		}
+	}
+	if p.SafetyMargin < 0 {
+		return fmt.Errorf("safety margin must not be negative")
+	}
+	if p.BusyDwell < 0 {
+		return fmt.Errorf("busy dwell must not be negative")
+	}
+	return nil
+}
+
+// clone returns a deep copy, the control law's loops and the speed limits are shared otherwise
+func (p ControllerParameters) clone() ControllerParameters {
+	p.ControlLaw = p.ControlLaw.clone()
+	p.SpeedLimits = slices.Clone(p.SpeedLimits)
+	return p
+}
+
+// resolveControlLaw fills in every default, so that a patch changing one gain keeps the others
+func resolveControlLaw(params ControlLawParameters) ControlLawParameters {
+	params = params.withDefaults()
+	if params.Type == "pid" {
+		if params.PositionLoop == nil {
+			loop := defaultPositionLoop()
+			params.PositionLoop = &loop
+		}
+		if params.VelocityLoop == nil {
+			loop := defaultVelocityLoop()
+			params.VelocityLoop = &loop
+		}
+	}
+	return params
+}
+
+// =====================================================
+// CONTROLLER SIDE
+// =====================================================
+
+// Parameters returns the controller's settings, including a change still waiting for the next tick
+func (c *Controller) Parameters() ControllerParameters {
+	c.parametersMu.Lock()
+	defer c.parametersMu.Unlock()
+	if c.pendingParameters != nil {
+		return c.pendingParameters.clone()
+	}
+	return c.parameters.clone()
+}
+
+// UpdateParameters validates new settings and queues them for the controller's next tick
+func (c *Controller) UpdateParameters(params ControllerParameters) error {
+	params.ControlLaw = resolveControlLaw(params.ControlLaw)
+	if err := params.validate(); err != nil {
+		return err
+	}
+	c.parametersMu.Lock()
+	defer c.parametersMu.Unlock()
+	c.pendingParameters = &params
+	return nil
+}
+
+// PatchParameters applies a partial JSON object on top of the controller's settings
+func (c *Controller) PatchParameters(patch []byte) (ControllerParameters, error) {
+	params := c.Parameters()
+	decoder := json.NewDecoder(strings.NewReader(string(patch)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&params); err != nil {
+		return ControllerParameters{}, fmt.Errorf("invalid parameters: %w", err)
+	}
+	if err := c.UpdateParameters(params); err != nil {
+		return ControllerParameters{}, err
+	}
+	return c.Parameters(), nil
+}
+
+// SetControlLaw switches the controller to another control law at its next tick
+func (c *Controller) SetControlLaw(controlLaw ControlLawParameters) error {
+	params := c.Parameters()
+	params.ControlLaw = controlLaw
+	return c.UpdateParameters(params)
+}
+
+// applyPendingParameters takes over a queued change, called from the controller loop
+func (c *Controller) applyPendingParameters() {
+	c.parametersMu.Lock()
+	pending := c.pendingParameters
+	c.pendingParameters = nil
+	c.parametersMu.Unlock()
+	if pending != nil {
+		c.logInfo("Applying new parameters")
+		c.applyParameters(*pending)
+	}
+}
+
+// applyParameters puts settings into effect. The control law is only rebuilt
+// when its settings changed, so its integrators survive unrelated changes.
+func (c *Controller) applyParameters(params ControllerParameters) {
+	c.parametersMu.Lock()
+	previous := c.parameters
+	c.parameters = params
+	c.parametersMu.Unlock()
+
+	if c.ControlLaw == nil || !reflect.DeepEqual(previous.ControlLaw, params.ControlLaw) || previous.FeedForward != params.FeedForward {
+		c.ControlLaw = newControlLaw(params.ControlLaw, params.FeedForward, c.Cart.Mass)
+	}
+	c.MovementPlanner.max_jerk = params.MaxJerk
+	c.MovementPlanner.max_acceleration = params.MaxAcceleration
+	c.MovementPlanner.max_deceleration = params.MaxDeceleration
+	c.MovementPlanner.max_velocity = params.MaxVelocity
+	c.MovementPlanner.speedLimits = slices.Clone(params.SpeedLimits)
+	c.safetyMargin = params.SafetyMargin
+	c.busyDwell = time.Duration(params.BusyDwell)
+}
+
+// =====================================================
+// SCENARIO MANAGER SIDE
+// =====================================================
+
+// CartParameters pairs a cart with its controller's settings
+type CartParameters struct {
+	CartId     int                  `json:"cartId"`
+	Parameters ControllerParameters `json:"parameters"`
+}
+
+// ParameterSnapshot is every controller's settings at one time, for saving a configuration
+type ParameterSnapshot struct {
+	Time        string           `json:"time"`
+	Controllers []CartParameters `json:"controllers"`
+}
+
+// controller returns the controller of a 1-based cart number
+func (sm *ScenarioManager) controller(cart int) (*Controller, error) {
+	sm.mu.RLock()
+	controllers := sm.controllers
+	sm.mu.RUnlock()
+	if cart < 1 || cart > len(controllers) {
+		return nil, fmt.Errorf("cart %d does not exist", cart)
+	}
+	return controllers[cart-1], nil
+}
+
+// GetParameters returns one controller's settings
+func (sm *ScenarioManager) GetParameters(cart int) (ControllerParameters, error) {
+	controller, err := sm.controller(cart)
+	if err != nil {
+		return ControllerParameters{}, err
+	}
+	return controller.Parameters(), nil
+}
+
+// PatchParameters changes some of a controller's settings and tells every observer
+func (sm *ScenarioManager) PatchParameters(cart int, patch []byte) (ControllerParameters, error) {
+	controller, err := sm.controller(cart)
+	if err != nil {
+		return ControllerParameters{}, err
+	}
+	params, err := controller.PatchParameters(patch)
+	if err != nil {
+		return ControllerParameters{}, err
+	}
+	log.Printf("[PARAMETERS] Cart %d: %s", cart, patch)
+	sm.notifyParameterChange(cart, params)
+	return params, nil
+}
+
+// ParameterSnapshot returns the settings of every controller
+func (sm *ScenarioManager) ParameterSnapshot() ParameterSnapshot {
+	sm.mu.RLock()
+	controllers := sm.controllers
+	sm.mu.RUnlock()
+	snapshot := ParameterSnapshot{Time: sm.clock.Now().UTC().Format(time.RFC3339Nano)}
+	for _, controller := range controllers {
+		snapshot.Controllers = append(snapshot.Controllers, CartParameters{
+			CartId:     controller.Cart.Id,
+			Parameters: controller.Parameters(),
+		})
+	}
+	return snapshot
+}
+
+// OnParameterChange registers a function called after every parameter change
+func (sm *ScenarioManager) OnParameterChange(observer func(CartParameters)) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.parameterObservers = append(sm.parameterObservers, observer)
+}
+
+// notifyParameterChange tells the observers about a cart's new settings
+func (sm *ScenarioManager) notifyParameterChange(cart int, params ControllerParameters) {
+	sm.mu.RLock()
+	observers := sm.parameterObservers
+	sm.mu.RUnlock()
+	for _, observer := range observers {
+		observer(CartParameters{CartId: cart, Parameters: params})
+	}
+}
+
+// parameterPatch turns a dotted path and a value into a JSON patch, so that
+// "controlLaw.velocityLoop.kp" and "120" become {"controlLaw":{"velocityLoop":{"kp":120}}}.
+// Values that are not valid JSON are taken as strings.
+func parameterPatch(path, value string) ([]byte, error) {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+		parsed = value
+	}
+	keys := strings.Split(path, ".")
+	for i := len(keys) - 1; i >= 0; i-- {
+		if keys[i] == "" {
+			return nil, fmt.Errorf("invalid parameter path %q", path)
+		}
+		parsed = map[string]interface{}{keys[i]: parsed}
+	}
+	return json.Marshal(parsed)
+}
@@ -1,70 +1,212 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"slices"
 	"time"
 )
 
 // FPS is the frames per second for the physics loop
 const PHYSICS_FPS = 1000
 
-func physics_loop(scenarioManager *ScenarioManager, exit_channel chan struct{}) {
+// maxPhysicsLag is the most simulation time the loop catches up on after a late tick
+const maxPhysicsLag = 100 * time.Millisecond
 
-	ticker := time.NewTicker(time.Second / PHYSICS_FPS)
+// PhysicsConfig selects how cart motion is integrated. It is chosen at startup.
+type PhysicsConfig struct {
+	Integrator string        // Name of the integration method, see integrators
+	Timestep   time.Duration // Fixed simulation step
+	Substeps   int           // Integration steps per timestep
+}
+
+// defaultPhysicsConfig integrates with RK4 at PHYSICS_FPS without substepping
+func defaultPhysicsConfig() PhysicsConfig {
+	return PhysicsConfig{
+		Integrator: "rk4",
+		Timestep:   time.Second / PHYSICS_FPS,
+		Substeps:   1,
+	}
+}
+
+// addPhysicsFlags registers the physics settings on a flag set, filling config when parsed
+func addPhysicsFlags(flags *flag.FlagSet, config *PhysicsConfig) {
+	flags.StringVar(&config.Integrator, "integrator", config.Integrator, fmt.Sprintf("integration method: %v", integratorNames()))
+	flags.DurationVar(&config.Timestep, "timestep", config.Timestep, "fixed physics timestep")
+	flags.IntVar(&config.Substeps, "substeps", config.Substeps, "integration substeps per physics timestep")
+}
+
+// validate checks the configuration
+func (c PhysicsConfig) validate() error {
+	if _, err := getIntegrator(c.Integrator); err != nil {
+		return err
+	}
+	if c.Timestep <= 0 {
+		return fmt.Errorf("physics timestep must be positive")
+	}
+	if c.Substeps < 1 {
+		return fmt.Errorf("physics substeps must be at least 1")
+	}
+	return nil
+}
+
+// SimulationConfig selects the models of carts and controllers whose scenario
+// does not set them. The presets are named on the command line and loaded once parsed.
+type SimulationConfig struct {
+	DrivePreset     string
+	SensorPreset    string
+	EstimatorPreset string
+	ControlPreset   string // A preset or a control law JSON file
+	FeedForward     FeedForward
+
+	// Loaded from the presets
+	Drive      DriveParameters
+	Sensor     SensorParameters
+	Estimator  EstimatorParameters
+	ControlLaw ControlLawParameters
+}
+
+// defaultSimulationConfig uses ideal carts with PID control and no estimator
+func defaultSimulationConfig() SimulationConfig {
+	return SimulationConfig{DrivePreset: "ideal", SensorPreset: "ideal", EstimatorPreset: "none", ControlPreset: "pid"}
+}
+
+// addSimulationFlags registers the model settings on a flag set, filling config when parsed
+func addSimulationFlags(flags *flag.FlagSet, config *SimulationConfig) {
+	flags.StringVar(&config.DrivePreset, "drive", config.DrivePreset, "drive model of carts whose scenario does not set one: ideal or realistic")
+	flags.StringVar(&config.SensorPreset, "sensor", config.SensorPreset, "sensor model of carts whose scenario does not set one: ideal or encoder")
+	flags.StringVar(&config.EstimatorPreset, "estimator", config.EstimatorPreset, "state estimator of controllers whose scenario does not set one: none, kalman or alpha-beta")
+	flags.Float64Var(&config.FeedForward.VelocityGain, "ff-velocity", config.FeedForward.VelocityGain, "velocity feed-forward gain of controllers whose scenario does not set one")
+	flags.Float64Var(&config.FeedForward.AccelerationGain, "ff-acceleration", config.FeedForward.AccelerationGain, "acceleration feed-forward gain of controllers whose scenario does not set one")
+	flags.StringVar(&config.ControlPreset, "control", config.ControlPreset, "control law of controllers whose scenario does not set one: pid, lqr, mpc or a control law JSON file")
+}
+
+// load reads the presets the flags named
+func (c *SimulationConfig) load() error {
+	var err error
+	if c.Drive, err = getDrivePreset(c.DrivePreset); err != nil {
+		return err
+	}
+	if c.Sensor, err = getSensorPreset(c.SensorPreset); err != nil {
+		return err
+	}
+	if c.Estimator, err = getEstimatorPreset(c.EstimatorPreset); err != nil {
+		return err
+	}
+	if c.ControlLaw, err = loadControlLaw(c.ControlPreset); err != nil {
+		return err
+	}
+	return nil
+}
+
+// apply makes the loaded models the scenario manager's defaults
+func (c SimulationConfig) apply(sm *ScenarioManager) {
+	sm.drive = c.Drive
+	sm.sensor = c.Sensor
+	sm.estimator = c.Estimator
+	sm.feedForward = c.FeedForward
+	sm.controlLaw = c.ControlLaw
+}
+
+func physics_loop(scenarioManager *ScenarioManager, config PhysicsConfig) {
+
+	integrator, err := getIntegrator(config.Integrator)
+	if err != nil {
+		panic(err)
+	}
+	h := config.Timestep.Seconds() / float64(config.Substeps)
+
+	ticker := scenarioManager.clock.NewTicker(config.Timestep)
 	defer ticker.Stop()
 
-	previousTime := time.Now()
+	// Safety is checked apart from the physics, after every tick that moved the carts
+	safetyTicks := make(chan physicsTick, safetyTickBuffer)
+	go scenarioManager.monitorSafety(safetyTicks)
 
-	for t := range ticker.C {
+	previousTime := scenarioManager.clock.Now()
 
-		// Calculate delta time
-		deltaTime := t.Sub(previousTime).Seconds()
+	// Simulation time in seconds, advanced in fixed steps
+	simulationTime := 0.0
+	// Elapsed time not yet simulated
+	var lag time.Duration
+
+	for {
+		var t time.Time
+		select {
+		case <-scenarioManager.physicsExitChannel:
+			return
+		case t = <-ticker.C:
+		}
+
+		// Accumulate elapsed time, so late ticks are made up with extra fixed steps
+		lag += t.Sub(previousTime)
 		previousTime = t
+		if lag > maxPhysicsLag {
+			lag = maxPhysicsLag
+		}
 
 		// Get current carts from scenario manager
 		carts := scenarioManager.carts
 		if len(carts) == 0 {
+			lag = 0
 			continue // No carts to process
 		}
 
-		// Update the physics of each cart
-		for i := range carts {
-			cart := &carts[i]
-
-			// Update using Newton's method (Euler's method)
-			// Position derivative is velocity
-			cart.Position = rk4_step(func(t, pos float64) float64 {
-				return cart.Velocity
-			}, float64(t.Unix()), cart.Position, deltaTime)
+		// A collision with the halt policy freezes the carts until the next reset
+		if scenarioManager.IsHalted() {
+			lag = 0
+			continue
+		}
 
-			// Velocity derivative is acceleration
-			cart.Velocity = rk4_step(func(t, vel float64) float64 {
-				return cart.Acceleration
-			}, float64(t.Unix()), cart.Velocity, deltaTime)
+		for ; lag >= config.Timestep; lag -= config.Timestep {
+			// The time this step simulates up to, steps that make up for lag are in the past
+			now := t.Add(config.Timestep - lag)
+			for substep := 0; substep < config.Substeps; substep++ {
+				integrateCarts(carts, integrator, simulationTime, h)
+				simulationTime += h
+			}
 
-			// Acceleration is force divided by mass
-			cart.Acceleration = cart.Force / cart.Mass
-		}
+			// Check for collisions and resolve them according to the collision policy
+			scenarioManager.handleCollisions(carts, now)
 
-		// Check for collisions
-		for i := 0; i < len(carts); i++ {
-			for j := i + 1; j < len(carts); j++ {
-				cartA := &carts[i]
-				cartB := &carts[j]
+			// Let the sensors see the new state
+			for i := range carts {
+				if carts[i].Sensor != nil {
+					carts[i].Sensor.Sample(now, PhysicsState{Position: carts[i].Position, Velocity: carts[i].Velocity})
+				}
+			}
 
-				// Check for collision
-				if cartA.Position+cartA.Width/2 > cartB.Position-cartB.Width/2 && cartA.Position-cartA.Width/2 < cartB.Position+cartB.Width/2 {
-					// Handle collision (assumes perfectly elastic collision between carts of equal mass)
-					// Swap velocities
-					// This is a simple example; in a real-world scenario, you would need to consider the masses and velocities of both carts
-					cartA.Velocity, cartB.Velocity = cartB.Velocity, cartA.Velocity
+			// The physics never waits for the monitor, a monitor that fell this far behind misses the tick
+			select {
+			case safetyTicks <- physicsTick{time: now, carts: slices.Clone(carts)}:
+			default:
+				scenarioManager.skipSafetyTick(now)
+			}
+		}
+	}
+}
 
-					fmt.Printf("Collision detected between cart %d and cart %d\n", i+1, j+1)
+// integrateCarts advances every cart by one integration step of length h
+func integrateCarts(carts []Cart, integrator Integrator, t, h float64) {
+	for i := range carts {
+		cart := &carts[i]
 
-					// End the simulation if a collision occurs
-					exit_channel <- struct{}{}
-				}
+		// The commanded force passes through the drive, the motor force is held constant over the step
+		var acceleration AccelerationFunc
+		if cart.Drive == nil {
+			acceleration = func(t float64, state PhysicsState) float64 {
+				return cart.Force / cart.Mass
+			}
+		} else {
+			motorForce := cart.Drive.Update(cart.Force, h)
+			acceleration = func(t float64, state PhysicsState) float64 {
+				return cart.Drive.Force(motorForce, state) / cart.Mass
 			}
 		}
+
+		state := integrator.Step(acceleration, t, PhysicsState{Position: cart.Position, Velocity: cart.Velocity}, h)
+		cart.Position = state.Position
+		cart.Velocity = state.Velocity
+		cart.Acceleration = acceleration(t+h, state)
 	}
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// =====================================================
+// PLANNER PROPERTY CHECKS
+// =====================================================
+
+// plannerCase generates one kind of trajectory from random limits and moves,
+// returning the planner that made it and a description to reproduce it. A nil
+// trajectory means the planner failed to make one, the description says why.
+type plannerCase struct {
+	Name     string
+	Generate func(r *rand.Rand, clock *SimulatedClock) (*MovementPlanner, *Trajectory, string)
+}
+
+// plannerCases cover every point to point profile type, both stopping
+// variants and the planners built on top of them
+func plannerCases() []plannerCase {
+	return []plannerCase{
+		{"point to point", func(r *rand.Rand, clock *SimulatedClock) (*MovementPlanner, *Trajectory, string) {
+			mpc := randomPlanner(r, clock)
+			start, end := randomMove(r, 1e-3, 5000)
+			return mpc, mpc.CalculatePointToPointTrajectory(start, end), describeMove(mpc, start, end)
+		}},
+		{"short move", func(r *rand.Rand, clock *SimulatedClock) (*MovementPlanner, *Trajectory, string) {
+			mpc := randomPlanner(r, clock)
+			start, end := randomMove(r, 1e-9, 1e-2)
+			return mpc, mpc.CalculatePointToPointTrajectory(start, end), describeMove(mpc, start, end)
+		}},
+		{"stop from point to point", func(r *rand.Rand, clock *SimulatedClock) (*MovementPlanner, *Trajectory, string) {
+			mpc := randomPlanner(r, clock)
+			start, end := randomMove(r, 1e-3, 5000)
+			moving := mpc.CalculatePointToPointTrajectory(start, end)
+			after := advanceInto(r, moving)
+			return mpc, mpc.CalculateStoppingTrajectory(moving), fmt.Sprintf("%s, stop after %v", describeMove(mpc, start, end), after)
+		}},
+		{"stop from stopping", func(r *rand.Rand, clock *SimulatedClock) (*MovementPlanner, *Trajectory, string) {
+			mpc := randomPlanner(r, clock)
+			start, end := randomMove(r, 1e-3, 5000)
+			moving := mpc.CalculatePointToPointTrajectory(start, end)
+			first := advanceInto(r, moving)
+			stopping := mpc.CalculateStoppingTrajectory(moving)
+			second := advanceInto(r, stopping)
+			return mpc, mpc.CalculateStoppingTrajectory(stopping), fmt.Sprintf("%s, stop after %v and again after %v", describeMove(mpc, start, end), first, second)
+		}},
+		{"from moving state", func(r *rand.Rand, clock *SimulatedClock) (*MovementPlanner, *Trajectory, string) {
+			mpc := randomPlanner(r, clock)
+			initial := randomState(r, mpc)
+			_, end := randomMove(r, 1e-3, 5000)
+			return mpc, mpc.CalculateTrajectoryFromState(initial, end), fmt.Sprintf("%s, from %s to %.6g", describeLimits(mpc), describeState(initial), end)
+		}},
+		{"stop from moving state", func(r *rand.Rand, clock *SimulatedClock) (*MovementPlanner, *Trajectory, string) {
+			mpc := randomPlanner(r, clock)
+			initial := randomState(r, mpc)
+			_, end := randomMove(r, 1e-3, 5000)
+			moving := mpc.CalculateTrajectoryFromState(initial, end)
+			after := advanceInto(r, moving)
+			return mpc, mpc.CalculateStoppingTrajectory(moving), fmt.Sprintf("%s, from %s to %.6g, stop after %v", describeLimits(mpc), describeState(initial), end, after)
+		}},
+		{"waypoints", func(r *rand.Rand, clock *SimulatedClock) (*MovementPlanner, *Trajectory, string) {
+			mpc := randomPlanner(r, clock)
+			initial := randomState(r, mpc)
+			path := randomPath(r, mpc)
+			return mpc, mpc.CalculateWaypointTrajectory(initial, path), fmt.Sprintf("%s, from %s through %s", describeLimits(mpc), describeState(initial), describePath(path))
+		}},
+		{"timed", func(r *rand.Rand, clock *SimulatedClock) (*MovementPlanner, *Trajectory, string) {
+			mpc := randomPlanner(r, clock)
+			start, end := randomMove(r, 1e-3, 5000)
+			fastest := mpc.CalculatePointToPointTrajectory(start, end).state[7].t
+			duration := time.Duration(fastest * (1 + 3*r.Float64()) * float64(time.Second))
+			// Every duration is at least the fastest time, so the planner must manage it
+			trajectory, err := mpc.CalculateTimedTrajectory(start, end, duration)
+			if err != nil {
+				return mpc, nil, fmt.Sprintf("%s, in %v: %v", describeMove(mpc, start, end), duration, err)
+			}
+			return mpc, trajectory, fmt.Sprintf("%s, in %v", describeMove(mpc, start, end), duration)
+		}},
+		{"asymmetric limits", func(r *rand.Rand, clock *SimulatedClock) (*MovementPlanner, *Trajectory, string) {
+			mpc := randomPlanner(r, clock)
+			mpc.max_deceleration = mpc.max_acceleration * math.Exp(r.Float64()*2.4-1.2)
+			start, end := randomMove(r, 1e-3, 5000)
+			moving := mpc.CalculatePointToPointTrajectory(start, end)
+			if r.Intn(2) == 0 {
+				return mpc, moving, describeMove(mpc, start, end)
+			}
+			after := advanceInto(r, moving)
+			return mpc, mpc.CalculateStoppingTrajectory(moving), fmt.Sprintf("%s, stop after %v", describeMove(mpc, start, end), after)
+		}},
+		{"speed zones", func(r *rand.Rand, clock *SimulatedClock) (*MovementPlanner, *Trajectory, string) {
+			mpc := randomPlanner(r, clock)
+			for i := r.Intn(3) + 1; i > 0; i-- {
+				zoneStart := r.Float64()*6000 - 3000
+				mpc.speedLimits = append(mpc.speedLimits, SpeedZone{
+					Start:       zoneStart,
+					End:         zoneStart + 10 + r.Float64()*1000,
+					MaxVelocity: mpc.max_velocity * (0.05 + 0.9*r.Float64()),
+				})
+			}
+			// Replan partway along a first path, from a state that keeps to the zones
+			start := r.Float64()*2000 - 1000
+			first := randomPath(r, mpc)
+			moving := mpc.CalculateWaypointTrajectory(internalState{p: start}, first)
+			after := advanceInto(r, moving)
+			path := randomPath(r, mpc)
+			return mpc, mpc.CalculateWaypointTrajectory(moving.GetCurrentState(), path), fmt.Sprintf("%s, zones %+v, from %.6g through %s, after %v through %s",
+				describeLimits(mpc), mpc.speedLimits, start, describePath(first), after, describePath(path))
+		}},
+	}
+}
+
+// randomPlanner returns a planner with limits spread over several orders of magnitude,
+// so that every point to point profile type comes up
+func randomPlanner(r *rand.Rand, clock *SimulatedClock) *MovementPlanner {
+	logUniform := func(low, high float64) float64 {
+		return low * math.Pow(high/low, r.Float64())
+	}
+	return NewMovementPlanner(logUniform(10, 10000), logUniform(1, 1000), logUniform(1, 2000), clock)
+}
+
+// randomMove returns a start and end position a log-uniform distance apart in either direction
+func randomMove(r *rand.Rand, shortest, longest float64) (float64, float64) {
+	start := r.Float64()*2000 - 1000
+	distance := shortest * math.Pow(longest/shortest, r.Float64())
+	if r.Intn(2) == 0 {
+		distance = -distance
+	}
+	return start, start + distance
+}
+
+// randomState returns a moving state within the planner's limits, with no more
+// acceleration than the jerk limit could build up within the velocity limit
+func randomState(r *rand.Rand, mpc *MovementPlanner) internalState {
+	return internalState{
+		p: r.Float64()*2000 - 1000,
+		v: (2*r.Float64() - 1) * mpc.max_velocity,
+		a: (2*r.Float64() - 1) * min(mpc.max_acceleration, math.Sqrt(mpc.max_jerk*mpc.max_velocity)),
+	}
+}
+
+// randomPath returns two to four waypoints, some passed through
+func randomPath(r *rand.Rand, mpc *MovementPlanner) []Waypoint {
+	path := make([]Waypoint, r.Intn(3)+2)
+	for i := range path {
+		path[i].Position = r.Float64()*4000 - 2000
+		if r.Intn(2) == 0 {
+			path[i].Velocity = r.Float64() * mpc.max_velocity
+		}
+	}
+	return path
+}
+
+// advanceInto moves the trajectory's start back, so that the clock is at a random
+// time during it or just after it
+func advanceInto(r *rand.Rand, trajectory *Trajectory) time.Duration {
+	after := time.Duration(r.Float64() * 1.1 * trajectory.state[7].t * float64(time.Second))
+	trajectory.t0 = trajectory.t0.Add(-after)
+	for _, segment := range trajectory.segments {
+		segment.t0 = trajectory.t0
+	}
+	return after
+}
+
+func describeLimits(mpc *MovementPlanner) string {
+	return fmt.Sprintf("jerk %.6g, acceleration %.6g, deceleration %.6g, velocity %.6g", mpc.max_jerk, mpc.max_acceleration, mpc.max_deceleration, mpc.max_velocity)
+}
+
+func describeMove(mpc *MovementPlanner, start, end float64) string {
+	return fmt.Sprintf("%s, from %.9g to %.9g", describeLimits(mpc), start, end)
+}
+
+// validatePlannerCase returns the violations of a generated trajectory, a missing
+// trajectory is one itself
+func validatePlannerCase(mpc *MovementPlanner, trajectory *Trajectory) []TrajectoryViolation {
+	if trajectory == nil {
+		return []TrajectoryViolation{{Property: "planning", Detail: "the planner returned an error"}}
+	}
+	return mpc.ValidateTrajectory(trajectory)
+}
+
+// runPlannerCheck validates random trajectories of every kind: gocart check-planner [flags]
+func runPlannerCheck(args []string) int {
+	flags := flag.NewFlagSet("check-planner", flag.ContinueOnError)
+	count := flags.Int("n", 10000, "trajectories to check of each kind")
+	seed := flags.Int64("seed", 1, "seed for the random limits and moves")
+	examples := flags.Int("examples", 3, "invalid trajectories to print of each kind")
+	kind := flags.String("kind", "", "check only this kind of trajectory, e.g. \"stop from stopping\"")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gocart check-planner [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	r := rand.New(rand.NewSource(*seed))
+	clock := NewSimulatedClock()
+	failed := false
+	fmt.Printf("Checking %d trajectories of each kind (seed %d)\n", *count, *seed)
+	for _, check := range plannerCases() {
+		if *kind != "" && check.Name != *kind {
+			continue
+		}
+		invalid := 0
+		types := map[TrajectoryType]int{}
+		for i := 0; i < *count; i++ {
+			mpc, trajectory, description := check.Generate(r, clock)
+			violations := validatePlannerCase(mpc, trajectory)
+			if trajectory != nil && !trajectory.fromState && !trajectory.isStopping && len(trajectory.segments) == 0 {
+				types[pointToPointType(trajectory)]++
+			}
+			if len(violations) == 0 {
+				continue
+			}
+			invalid++
+			if invalid <= *examples {
+				fmt.Printf("  %s: %s\n", check.Name, description)
+				for _, violation := range violations {
+					fmt.Printf("    %s\n", violation)
+				}
+			}
+		}
+
+		status := "PASSED"
+		if invalid > 0 {
+			status = "FAILED"
+			failed = true
+		}
+		fmt.Printf("%-8s  %-26s %6d invalid\n", status, check.Name, invalid)
+		for trajectoryType := VelocityLimited; trajectoryType <= AccelerationLimitedWithoutMaxVelocity; trajectoryType++ {
+			if types[trajectoryType] > 0 {
+				fmt.Printf("          %-26s   %6d %s\n", "", types[trajectoryType], trajectoryTypeNames[trajectoryType])
+			}
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
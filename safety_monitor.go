@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// =====================================================
+// RUNTIME SAFETY MONITOR
+// =====================================================
+
+// SafetyInvariant names a condition the safety monitor checks on every physics tick
+type SafetyInvariant string
+
+const (
+	// InvariantContainment holds while every cart's body lies between its borders
+	InvariantContainment SafetyInvariant = "containment"
+	// InvariantBorderOverlap holds while every cart's right border is left of its right neighbour's left border
+	InvariantBorderOverlap SafetyInvariant = "border_overlap"
+	// InvariantStoppingPoint holds while every cart would come to rest between its borders if it braked now
+	InvariantStoppingPoint SafetyInvariant = "stopping_point"
+)
+
+// safetyTolerance allows for tracking error and rounding before an invariant counts as violated
+const safetyTolerance = 1.0
+
+// maxSafetyAlarms bounds how many alarms are kept per scenario
+const maxSafetyAlarms = 100
+
+// safetyTickBuffer is how many physics ticks may wait for the safety monitor.
+// Ticks beyond it are not checked, they are counted instead.
+const safetyTickBuffer = 100
+
+// SafetyAlarm records an invariant that stopped holding. A violation that lasts
+// raises one alarm, another one is raised only after it held again.
+type SafetyAlarm struct {
+	Time        time.Time            `json:"time"`
+	Invariant   SafetyInvariant      `json:"invariant"`
+	Carts       []int                `json:"carts"` // Ids of the carts involved
+	Message     string               `json:"message"`
+	Controllers []ControllerSnapshot `json:"controllers"` // The carts on both sides of the border concerned
+}
+
+func (a SafetyAlarm) String() string {
+	return fmt.Sprintf("%s: %s", a.Invariant, a.Message)
+}
+
+// publishedState is what a controller's main loop publishes after every event it
+// handles, for goroutines that must not read the controller while it runs.
+// Trajectories are never changed once planned, so sharing them is safe.
+type publishedState struct {
+	state                State
+	left, right, current *Trajectory
+	planner              MovementPlanner // A copy, parameter changes update the controller's
+	setpoint             float64
+}
+
+// publishState shares the controller's state with the other goroutines
+func (c *Controller) publishState() {
+	state := publishedState{
+		state:    c.State,
+		left:     c.LeftBorderTrajectory,
+		right:    c.RightBorderTrajectory,
+		current:  c.CurrentTrajectory,
+		planner:  *c.MovementPlanner,
+		setpoint: c.ControlLaw.Setpoint(),
+	}
+	c.publishedMu.Lock()
+	c.published = state
+	c.publishedMu.Unlock()
+}
+
+// publishedState returns the state the controller last published
+func (c *Controller) publishedState() publishedState {
+	c.publishedMu.Lock()
+	defer c.publishedMu.Unlock()
+	return c.published
+}
+
+// physicsTick is the carts' state after a physics tick, handed to the safety monitor
+type physicsTick struct {
+	time  time.Time
+	carts []Cart // A copy, the physics loop moves on
+}
+
+// safetyViolation is an invariant violated at one tick, between the controllers at left and right
+type safetyViolation struct {
+	invariant   SafetyInvariant
+	left, right int // Controller indices on both sides of the border concerned, -1 at the ends of the track
+	message     string
+}
+
+// key identifies a violation across ticks
+func (v safetyViolation) key() string {
+	return fmt.Sprintf("%s/%d/%d", v.invariant, v.left, v.right)
+}
+
+// checkSafetyInvariants returns every invariant violated at a tick, given the
+// state each cart's controller published. Carts without one are skipped.
+func checkSafetyInvariants(tick physicsTick, states []publishedState) []safetyViolation {
+	var violations []safetyViolation
+	count := min(len(tick.carts), len(states))
+	for i := 0; i < count; i++ {
+		state := states[i]
+		if state.left == nil || state.right == nil {
+			continue
+		}
+		cart := tick.carts[i]
+		left := state.left.GetStateAt(tick.time).p
+		right := state.right.GetStateAt(tick.time).p
+
+		// The neighbour across the border a violation concerns, if there is one
+		leftNeighbour, rightNeighbour := i-1, i+1
+		if rightNeighbour == count {
+			rightNeighbour = -1
+		}
+
+		if body := cart.Position - cart.Width/2; body < left-safetyTolerance {
+			violations = append(violations, safetyViolation{InvariantContainment, leftNeighbour, i,
+				fmt.Sprintf("cart %d reaches %.2f, past its left border %.2f", cart.Id, body, left)})
+		}
+		if body := cart.Position + cart.Width/2; body > right+safetyTolerance {
+			violations = append(violations, safetyViolation{InvariantContainment, i, rightNeighbour,
+				fmt.Sprintf("cart %d reaches %.2f, past its right border %.2f", cart.Id, body, right)})
+		}
+
+		// A border that is still moving allows a stop anywhere up to where it is going
+		if state.current != nil {
+			stop := state.planner.StoppingPosition(state.current.GetStateAt(tick.time))
+			if limit := math.Min(left, state.left.end); stop < limit-safetyTolerance {
+				violations = append(violations, safetyViolation{InvariantStoppingPoint, leftNeighbour, i,
+					fmt.Sprintf("cart %d would stop at %.2f, past its left border %.2f", cart.Id, stop, limit)})
+			}
+			if limit := math.Max(right, state.right.end); stop > limit+safetyTolerance {
+				violations = append(violations, safetyViolation{InvariantStoppingPoint, i, rightNeighbour,
+					fmt.Sprintf("cart %d would stop at %.2f, past its right border %.2f", cart.Id, stop, limit)})
+			}
+		}
+
+		if rightNeighbour >= 0 && states[rightNeighbour].left != nil {
+			neighbourLeft := states[rightNeighbour].left.GetStateAt(tick.time).p
+			if right > neighbourLeft+borderOverlapTolerance {
+				violations = append(violations, safetyViolation{InvariantBorderOverlap, i, rightNeighbour,
+					fmt.Sprintf("cart %d right border %.2f is past cart %d left border %.2f", cart.Id, right, tick.carts[rightNeighbour].Id, neighbourLeft)})
+			}
+		}
+	}
+	return violations
+}
+
+// monitorSafety checks the invariants after every physics tick until the physics loop stops
+func (sm *ScenarioManager) monitorSafety(ticks <-chan physicsTick) {
+	for {
+		select {
+		case <-sm.physicsExitChannel:
+			return
+		case tick := <-ticks:
+			sm.mu.RLock()
+			controllers := sm.controllers
+			sm.mu.RUnlock()
+			states := make([]publishedState, len(controllers))
+			for i, controller := range controllers {
+				if controller != nil {
+					states[i] = controller.publishedState()
+				}
+			}
+			sm.raiseSafetyAlarms(tick, states, checkSafetyInvariants(tick, states))
+		}
+	}
+}
+
+// raiseSafetyAlarms records the violations that just started as alarms, and
+// forgets the ones that ended so that they raise a new alarm if they return
+func (sm *ScenarioManager) raiseSafetyAlarms(tick physicsTick, states []publishedState, violations []safetyViolation) {
+	sm.mu.Lock()
+	active := make(map[string]bool, len(violations))
+	var raised []SafetyAlarm
+	for _, violation := range violations {
+		key := violation.key()
+		active[key] = true
+		if sm.activeViolations[key] {
+			continue
+		}
+		alarm := SafetyAlarm{Time: tick.time, Invariant: violation.invariant, Message: violation.message}
+		for _, index := range []int{violation.left, violation.right} {
+			if index >= 0 {
+				alarm.Carts = append(alarm.Carts, tick.carts[index].Id)
+				alarm.Controllers = append(alarm.Controllers, snapshotState(tick.carts[index], states[index], tick.time))
+			}
+		}
+		if len(sm.safetyAlarms) < maxSafetyAlarms {
+			sm.safetyAlarms = append(sm.safetyAlarms, alarm)
+		}
+		raised = append(raised, alarm)
+	}
+	sm.activeViolations = active
+	observers := sm.safetyObservers
+	sm.mu.Unlock()
+
+	for _, alarm := range raised {
+		log.Printf("[SAFETY] Alarm: %s", alarm)
+		for _, observer := range observers {
+			observer(alarm)
+		}
+	}
+}
+
+// skipSafetyTick counts a physics tick the monitor fell too far behind to check
+func (sm *ScenarioManager) skipSafetyTick(now time.Time) {
+	sm.mu.Lock()
+	sm.skippedSafetyTicks++
+	first := sm.skippedSafetyTicks == 1
+	sm.mu.Unlock()
+	if first {
+		log.Printf("[SAFETY] Monitor fell %d ticks behind at %s, skipping ticks until it catches up", safetyTickBuffer, now.Format("15:04:05.000"))
+	}
+}
+
+// SkippedSafetyTicks returns how many physics ticks went unchecked since the carts were last reset
+func (sm *ScenarioManager) SkippedSafetyTicks() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.skippedSafetyTicks
+}
+
+// GetSafetyAlarms returns the alarms raised since the carts were last reset
+func (sm *ScenarioManager) GetSafetyAlarms() []SafetyAlarm {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	result := make([]SafetyAlarm, len(sm.safetyAlarms))
+	copy(result, sm.safetyAlarms)
+	return result
+}
+
+// resetSafetyAlarms clears the alarms and skipped ticks of the previous carts
+func (sm *ScenarioManager) resetSafetyAlarms() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.safetyAlarms = nil
+	sm.activeViolations = nil
+	sm.skippedSafetyTicks = 0
+}
+
+// OnSafetyAlarm registers a function called with every alarm as it is raised
+func (sm *ScenarioManager) OnSafetyAlarm(observer func(SafetyAlarm)) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.safetyObservers = append(sm.safetyObservers, observer)
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// builtinScenarios holds the scenario files shipped with the binary
+//
+//go:embed scenarios/*.json
+var builtinScenarios embed.FS
+
+// defaultScenarioDirectory is where user scenario files are loaded from at startup
+const defaultScenarioDirectory = "scenarios"
+
+// Duration is a time.Duration that reads from JSON as a string ("500ms", "2s") or as milliseconds
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		parsed, err := time.ParseDuration(text)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+	var milliseconds float64
+	if err := json.Unmarshal(data, &milliseconds); err != nil {
+		return fmt.Errorf("duration must be a string like \"500ms\" or a number of milliseconds")
+	}
+	*d = Duration(milliseconds * float64(time.Millisecond))
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ScenarioDefinition is a coordination scenario as described in a scenario file
+type ScenarioDefinition struct {
+	Name         string                    `json:"name"`
+	Description  string                    `json:"description"`
+	Category     string                    `json:"category"`
+	Carts        []ScenarioCart            `json:"carts"`
+	Network      *NetworkSpec              `json:"network,omitempty"`     // Defaults to defaultNetworkConfig
+	Drive        *DriveParameters          `json:"drive,omitempty"`       // Drive of every cart, defaults to the manager's drive
+	Sensor       *SensorParameters         `json:"sensor,omitempty"`      // Sensor of every cart, defaults to the manager's sensor
+	Estimator    *EstimatorParameters      `json:"estimator,omitempty"`   // State estimator of every controller, defaults to the manager's
+	ControlLaw   *ControlLawParameters     `json:"controlLaw,omitempty"`  // Control law of every controller, defaults to the manager's
+	FeedForward  *FeedForward              `json:"feedForward,omitempty"` // Feed-forward gains of every controller, defaults to the manager's
+	Track        *TrackSpec                `json:"track,omitempty"`       // Braking limit and speed zones of every controller's planner
+	Faults       []NetworkFault            `json:"faults,omitempty"`      // Link network changes scheduled alongside the timeline
+	Timeline     []ScenarioAction          `json:"timeline"`
+	Expectations []ScenarioExpectationSpec `json:"expectations"`
+
+	source string // File the definition was loaded from
+}
+
+// ScenarioCart sets a cart's initial position and territory
+type ScenarioCart struct {
+	Position   float64               `json:"position"`
+	Territory  [2]float64            `json:"territory"`            // Initial left and right border
+	Drive      *DriveParameters      `json:"drive,omitempty"`      // Overrides the scenario's drive for this cart
+	Sensor     *SensorParameters     `json:"sensor,omitempty"`     // Overrides the scenario's sensor for this cart
+	Estimator  *EstimatorParameters  `json:"estimator,omitempty"`  // Overrides the scenario's estimator for this cart's controller
+	ControlLaw *ControlLawParameters `json:"controlLaw,omitempty"` // Overrides the scenario's control law for this cart's controller
+}
+
+// LinkSpec is the file form of LinkConfig
+type LinkSpec struct {
+	MinDelay             Duration          `json:"minDelay"`
+	MaxDelay             Duration          `json:"maxDelay"`
+	DelayDistribution    DelayDistribution `json:"delayDistribution,omitempty"` // "uniform" (default), "normal" or "pareto"
+	LossProbability      float64           `json:"lossProbability"`
+	BurstLoss            *BurstLoss        `json:"burstLoss,omitempty"`
+	DuplicateProbability float64           `json:"duplicateProbability,omitempty"`
+	ReorderProbability   float64           `json:"reorderProbability,omitempty"`
+	ReorderDelay         Duration          `json:"reorderDelay,omitempty"`
+	Bandwidth            float64           `json:"bandwidth,omitempty"` // Messages per second
+	Partitioned          bool              `json:"partitioned,omitempty"`
+	Manual               bool              `json:"manual,omitempty"` // Messages wait for an operator, see MessageQueue
+}
+
+func (l LinkSpec) config() LinkConfig {
+	return LinkConfig{
+		MinDelay:             time.Duration(l.MinDelay),
+		MaxDelay:             time.Duration(l.MaxDelay),
+		DelayDistribution:    l.DelayDistribution,
+		LossProbability:      l.LossProbability,
+		BurstLoss:            l.BurstLoss,
+		DuplicateProbability: l.DuplicateProbability,
+		ReorderProbability:   l.ReorderProbability,
+		ReorderDelay:         time.Duration(l.ReorderDelay),
+		Bandwidth:            l.Bandwidth,
+		Partitioned:          l.Partitioned,
+		Manual:               l.Manual,
+	}
+}
+
+// linkSpec is the file form of a LinkConfig
+func linkSpec(l LinkConfig) LinkSpec {
+	return LinkSpec{
+		MinDelay:             Duration(l.MinDelay),
+		MaxDelay:             Duration(l.MaxDelay),
+		DelayDistribution:    l.DelayDistribution,
+		LossProbability:      l.LossProbability,
+		BurstLoss:            l.BurstLoss,
+		DuplicateProbability: l.DuplicateProbability,
+		ReorderProbability:   l.ReorderProbability,
+		ReorderDelay:         Duration(l.ReorderDelay),
+		Bandwidth:            l.Bandwidth,
+		Partitioned:          l.Partitioned,
+		Manual:               l.Manual,
+	}
+}
+
+// validate checks the link settings
+func (l LinkSpec) validate() error {
+	if l.MinDelay < 0 || l.MaxDelay < l.MinDelay {
+		return fmt.Errorf("network delays must satisfy 0 <= minDelay <= maxDelay")
+	}
+	switch l.DelayDistribution {
+	case "", UniformDelay, NormalDelay, ParetoDelay:
+	default:
+		return fmt.Errorf("unknown delay distribution %q", l.DelayDistribution)
+	}
+	names := []string{"lossProbability", "duplicateProbability", "reorderProbability"}
+	for i, p := range []float64{l.LossProbability, l.DuplicateProbability, l.ReorderProbability} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("network %s must be between 0 and 1", names[i])
+		}
+	}
+	if l.BurstLoss != nil {
+		if err := l.BurstLoss.validate(); err != nil {
+			return err
+		}
+	}
+	if l.ReorderDelay < 0 || l.Bandwidth < 0 {
+		return fmt.Errorf("network reorderDelay and bandwidth must not be negative")
+	}
+	return nil
+}
+
+// NetworkSpec is the file form of NetworkConfig. A direction's own settings
+// replace the shared ones as a whole.
+type NetworkSpec struct {
+	LinkSpec
+	LeftToRight *LinkSpec `json:"leftToRight,omitempty"`
+	RightToLeft *LinkSpec `json:"rightToLeft,omitempty"`
+}
+
+func (n NetworkSpec) config() NetworkConfig {
+	config := NetworkConfig{LinkConfig: n.LinkSpec.config()}
+	if n.LeftToRight != nil {
+		link := n.LeftToRight.config()
+		config.LeftToRight = &link
+	}
+	if n.RightToLeft != nil {
+		link := n.RightToLeft.config()
+		config.RightToLeft = &link
+	}
+	return config
+}
+
+// networkSpec is the file form of a NetworkConfig
+func networkSpec(c NetworkConfig) NetworkSpec {
+	spec := NetworkSpec{LinkSpec: linkSpec(c.LinkConfig)}
+	if c.LeftToRight != nil {
+		link := linkSpec(*c.LeftToRight)
+		spec.LeftToRight = &link
+	}
+	if c.RightToLeft != nil {
+		link := linkSpec(*c.RightToLeft)
+		spec.RightToLeft = &link
+	}
+	return spec
+}
+
+// validate checks the shared and per-direction settings
+func (n NetworkSpec) validate() error {
+	if err := n.LinkSpec.validate(); err != nil {
+		return err
+	}
+	for _, link := range []*LinkSpec{n.LeftToRight, n.RightToLeft} {
+		if link == nil {
+			continue
+		}
+		if err := link.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TrackSpec sets the motion limits that depend on the track rather than the cart
+type TrackSpec struct {
+	MaxDeceleration float64     `json:"maxDeceleration,omitempty"` // Defaults to the acceleration limit
+	SpeedLimits     []SpeedZone `json:"speedLimits,omitempty"`
+}
+
+// validate checks the track limits
+func (t TrackSpec) validate() error {
+	if t.MaxDeceleration < 0 {
+		return fmt.Errorf("track deceleration limit must not be negative")
+	}
+	for _, zone := range t.SpeedLimits {
+		if err := zone.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScenarioAction is one step of a scenario timeline. Actions run in order and
+// only "wait" advances time, so consecutive goals are sent at the same instant.
+type ScenarioAction struct {
+	Action    string       `json:"action"`              // "goal", "path", "emergency_stop", "network", "message" or "wait"
+	Cart      int          `json:"cart,omitempty"`      // 1-based cart number for "goal", "path" and "emergency_stop"
+	Position  float64      `json:"position,omitempty"`  // Goal position for "goal"
+	Waypoints []Waypoint   `json:"waypoints,omitempty"` // Waypoints for "path"
+	Duration  Duration     `json:"duration,omitempty"`  // Length of a "wait", or of a "message" delay
+	Network   *NetworkSpec `json:"network,omitempty"`   // New configuration for "network"
+	Link      int          `json:"link,omitempty"`      // Link k joins cart k and cart k+1, "network" changes every link and "message" looks on every link if zero
+	Operation string       `json:"operation,omitempty"` // What "message" does to the oldest held message: "deliver", "drop", "duplicate" or "delay"
+	Kind      string       `json:"kind,omitempty"`      // "request" or "response" for "message", any kind if empty
+}
+
+// ScenarioExpectationSpec is the file form of an Expectation
+type ScenarioExpectationSpec struct {
+	Type      string   `json:"type"`           // "no_collision", "no_border_overlap", "final_position", "final_position_between", "goal_accepted", "goal_rejected", "max_tracking_error", "max_negotiation_time", "valid_trajectories"
+	Cart      int      `json:"cart,omitempty"` // 1-based cart number
+	Position  float64  `json:"position,omitempty"`
+	Goal      float64  `json:"goal,omitempty"`
+	Min       float64  `json:"min,omitempty"`
+	Max       float64  `json:"max,omitempty"`
+	Tolerance *float64 `json:"tolerance,omitempty"`
+	Duration  Duration `json:"duration,omitempty"`
+}
+
+// defaultNetworkConfig is the low latency, lossless network used unless a scenario says otherwise
+func defaultNetworkConfig() NetworkConfig {
+	return NetworkConfig{LinkConfig: LinkConfig{
+		MinDelay:        10 * time.Millisecond,
+		MaxDelay:        20 * time.Millisecond,
+		LossProbability: 0.0,
+	}}
+}
+
+// validate checks a definition for mistakes that would only surface while running it
+func (d *ScenarioDefinition) validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("scenario has no name")
+	}
+	if len(d.Carts) == 0 {
+		return fmt.Errorf("scenario has no carts")
+	}
+	if d.Drive != nil {
+		if err := d.Drive.validate(); err != nil {
+			return err
+		}
+	}
+	if d.Sensor != nil {
+		if err := d.Sensor.validate(); err != nil {
+			return err
+		}
+	}
+	if d.Estimator != nil {
+		if err := d.Estimator.validate(); err != nil {
+			return err
+		}
+	}
+	if d.ControlLaw != nil {
+		if err := d.ControlLaw.validate(); err != nil {
+			return err
+		}
+	}
+	if d.Track != nil {
+		if err := d.Track.validate(); err != nil {
+			return err
+		}
+	}
+	if d.Network != nil {
+		if err := d.Network.validate(); err != nil {
+			return err
+		}
+	}
+	for i, cart := range d.Carts {
+		if cart.Territory[0] >= cart.Territory[1] {
+			return fmt.Errorf("cart %d territory [%.2f, %.2f] is empty", i+1, cart.Territory[0], cart.Territory[1])
+		}
+		if cart.Position < cart.Territory[0] || cart.Position > cart.Territory[1] {
+			return fmt.Errorf("cart %d starts at %.2f, outside its territory [%.2f, %.2f]", i+1, cart.Position, cart.Territory[0], cart.Territory[1])
+		}
+		if i > 0 && cart.Territory[0] < d.Carts[i-1].Territory[1] {
+			return fmt.Errorf("cart %d territory [%.2f, %.2f] overlaps cart %d territory [%.2f, %.2f]",
+				i+1, cart.Territory[0], cart.Territory[1], i, d.Carts[i-1].Territory[0], d.Carts[i-1].Territory[1])
+		}
+		if i > 0 && cart.Position <= d.Carts[i-1].Position {
+			return fmt.Errorf("cart %d must start to the right of cart %d", i+1, i)
+		}
+		if cart.Drive != nil {
+			if err := cart.Drive.validate(); err != nil {
+				return fmt.Errorf("cart %d: %w", i+1, err)
+			}
+		}
+		if cart.Sensor != nil {
+			if err := cart.Sensor.validate(); err != nil {
+				return fmt.Errorf("cart %d: %w", i+1, err)
+			}
+		}
+		if cart.Estimator != nil {
+			if err := cart.Estimator.validate(); err != nil {
+				return fmt.Errorf("cart %d: %w", i+1, err)
+			}
+		}
+		if cart.ControlLaw != nil {
+			if err := cart.ControlLaw.validate(); err != nil {
+				return fmt.Errorf("cart %d: %w", i+1, err)
+			}
+		}
+	}
+	checkCart := func(cart int) error {
+		if cart < 1 || cart > len(d.Carts) {
+			return fmt.Errorf("cart %d does not exist", cart)
+		}
+		return nil
+	}
+
+	for i, fault := range d.Faults {
+		if err := fault.validate(len(d.Carts), d.timelineDuration()); err != nil {
+			return fmt.Errorf("fault %d: %w", i+1, err)
+		}
+	}
+
+	for i, action := range d.Timeline {
+		switch action.Action {
+		case "goal", "emergency_stop":
+			if err := checkCart(action.Cart); err != nil {
+				return fmt.Errorf("timeline step %d: %w", i+1, err)
+			}
+		case "path":
+			if err := checkCart(action.Cart); err != nil {
+				return fmt.Errorf("timeline step %d: %w", i+1, err)
+			}
+			if err := validatePath(action.Waypoints); err != nil {
+				return fmt.Errorf("timeline step %d: %w", i+1, err)
+			}
+		case "network":
+			if action.Network == nil {
+				return fmt.Errorf("timeline step %d: network action without network settings", i+1)
+			}
+			if err := action.Network.validate(); err != nil {
+				return fmt.Errorf("timeline step %d: %w", i+1, err)
+			}
+			if action.Link < 0 || action.Link > len(d.Carts)-1 {
+				return fmt.Errorf("timeline step %d: link %d does not exist", i+1, action.Link)
+			}
+		case "message":
+			switch action.Operation {
+			case "deliver", "drop", "duplicate":
+			case "delay":
+				if action.Duration <= 0 {
+					return fmt.Errorf("timeline step %d: delay needs a positive duration", i+1)
+				}
+			default:
+				return fmt.Errorf("timeline step %d: unknown message operation %q", i+1, action.Operation)
+			}
+			if action.Kind != "" && action.Kind != "request" && action.Kind != "response" {
+				return fmt.Errorf("timeline step %d: unknown message kind %q", i+1, action.Kind)
+			}
+			if action.Link < 0 || action.Link > len(d.Carts)-1 {
+				return fmt.Errorf("timeline step %d: link %d does not exist", i+1, action.Link)
+			}
+		case "wait":
+			if action.Duration <= 0 {
+				return fmt.Errorf("timeline step %d: wait needs a positive duration", i+1)
+			}
+		default:
+			return fmt.Errorf("timeline step %d: unknown action %q", i+1, action.Action)
+		}
+	}
+
+	for i, spec := range d.Expectations {
+		if _, err := spec.expectation(); err != nil {
+			return fmt.Errorf("expectation %d: %w", i+1, err)
+		}
+		if spec.Type != "no_collision" && spec.Type != "no_border_overlap" && spec.Type != "valid_trajectories" {
+			if err := checkCart(spec.Cart); err != nil {
+				return fmt.Errorf("expectation %d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// timelineDuration is how long the timeline's waits take, the other steps take no time
+func (d *ScenarioDefinition) timelineDuration() time.Duration {
+	var total time.Duration
+	for _, action := range d.Timeline {
+		if action.Action == "wait" {
+			total += time.Duration(action.Duration)
+		}
+	}
+	return total
+}
+
+// expectation converts the spec to an Expectation
+func (spec ScenarioExpectationSpec) expectation() (Expectation, error) {
+	tolerance := func(fallback float64) float64 {
+		if spec.Tolerance != nil {
+			return *spec.Tolerance
+		}
+		return fallback
+	}
+	cart := spec.Cart - 1
+
+	switch spec.Type {
+	case "no_collision":
+		return ExpectNoCollision(), nil
+	case "no_border_overlap":
+		return ExpectNoBorderOverlap(tolerance(borderOverlapTolerance)), nil
+	case "final_position":
+		return ExpectFinalPosition(cart, spec.Position, tolerance(finalPositionTolerance)), nil
+	case "final_position_between":
+		return ExpectFinalPositionBetween(cart, spec.Min, spec.Max), nil
+	case "goal_accepted":
+		return ExpectGoalAccepted(cart, spec.Goal), nil
+	case "goal_rejected":
+		return ExpectGoalRejected(cart, spec.Goal), nil
+	case "max_tracking_error":
+		return ExpectMaxTrackingError(cart, spec.Max), nil
+	case "max_negotiation_time":
+		return ExpectMaxNegotiationTime(cart, time.Duration(spec.Duration)), nil
+	case "valid_trajectories":
+		return ExpectValidTrajectories(), nil
+	default:
+		return Expectation{}, fmt.Errorf("unknown expectation type %q", spec.Type)
+	}
+}
+
+// parseScenarioDefinition decodes and validates a scenario file
+func parseScenarioDefinition(data []byte, source string) (*ScenarioDefinition, error) {
+	var definition ScenarioDefinition
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&definition); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	if err := definition.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	definition.source = source
+	return &definition, nil
+}
+
+// loadScenarioFiles reads every *.json scenario in a file system, sorted by file name
+func loadScenarioFiles(fsys fs.FS, dir string) ([]*ScenarioDefinition, []error) {
+	paths, err := fs.Glob(fsys, filepath.ToSlash(filepath.Join(dir, "*.json")))
+	if err != nil {
+		return nil, []error{err}
+	}
+	sort.Strings(paths)
+
+	var definitions []*ScenarioDefinition
+	var errs []error
+	for _, path := range paths {
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		definition, err := parseScenarioDefinition(data, path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, errs
+}
+
+// addScenarioDefinition registers a definition, replacing one with the same name
+func (sm *ScenarioManager) addScenarioDefinition(definition *ScenarioDefinition) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	scenario := CoordinationScenario{
+		Name:        definition.Name,
+		Description: definition.Description,
+		Status:      "idle",
+		Category:    definition.Category,
+	}
+	if _, exists := sm.definitions[definition.Name]; exists {
+		for i := range sm.scenarios {
+			if sm.scenarios[i].Name == definition.Name {
+				sm.scenarios[i] = scenario
+			}
+		}
+	} else {
+		sm.scenarios = append(sm.scenarios, scenario)
+	}
+	sm.definitions[definition.Name] = definition
+}
+
+// loadBuiltinScenarios registers the scenarios embedded in the binary
+func (sm *ScenarioManager) loadBuiltinScenarios() {
+	definitions, errs := loadScenarioFiles(builtinScenarios, "scenarios")
+	for _, err := range errs {
+		log.Printf("[SCENARIO] Invalid built-in scenario: %v", err)
+	}
+	for _, definition := range definitions {
+		sm.addScenarioDefinition(definition)
+	}
+}
+
+// LoadScenarioDirectory registers every scenario file in dir. Files with the
+// name of an existing scenario replace it. Invalid files are skipped and reported.
+func (sm *ScenarioManager) LoadScenarioDirectory(dir string) error {
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	definitions, errs := loadScenarioFiles(os.DirFS(dir), ".")
+	for _, definition := range definitions {
+		definition.source = filepath.Join(dir, definition.source)
+		sm.addScenarioDefinition(definition)
+		log.Printf("[SCENARIO] Loaded scenario %q from %s", definition.Name, definition.source)
+	}
+	if len(errs) > 0 {
+		messages := make([]string, len(errs))
+		for i, err := range errs {
+			messages[i] = err.Error()
+		}
+		return fmt.Errorf("invalid scenario files: %s", strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// runDefinition executes a scenario definition's setup and timeline
+func (sm *ScenarioManager) runDefinition(definition *ScenarioDefinition) error {
+	log.Printf("[SCENARIO] %s: %s", definition.Name, definition.Description)
+
+	if definition.Network != nil {
+		sm.setNetworkConfig(definition.Network.config())
+		// Restore the default network for whatever runs next
+		defer sm.setNetworkConfig(defaultNetworkConfig())
+	}
+
+	// Carts without their own drive, sensor, estimator or control law get the scenario's
+	layout := make([]ScenarioCart, len(definition.Carts))
+	copy(layout, definition.Carts)
+	for i := range layout {
+		if layout[i].Drive == nil {
+			layout[i].Drive = definition.Drive
+		}
+		if layout[i].Sensor == nil {
+			layout[i].Sensor = definition.Sensor
+		}
+		if layout[i].Estimator == nil {
+			layout[i].Estimator = definition.Estimator
+		}
+		if layout[i].ControlLaw == nil {
+			layout[i].ControlLaw = definition.ControlLaw
+		}
+	}
+	feedForward := sm.feedForward
+	if definition.FeedForward != nil {
+		feedForward = *definition.FeedForward
+	}
+	sm.resetCarts(layout, feedForward, definition.Track)
+
+	for _, spec := range definition.Expectations {
+		expectation, err := spec.expectation()
+		if err != nil {
+			return err
+		}
+		sm.expect(expectation)
+	}
+
+	// Faults scheduled from the start apply before the first action
+	schedule := newFaultSchedule(definition.Faults)
+	schedule.wait(sm, 0)
+	for _, action := range definition.Timeline {
+		if err := sm.runAction(action, schedule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runAction executes one timeline step, waits apply the scheduled faults
+func (sm *ScenarioManager) runAction(action ScenarioAction, schedule *faultSchedule) error {
+	switch action.Action {
+	case "goal":
+		select {
+		case sm.goalChannels[action.Cart-1] <- action.Position:
+			log.Printf("[SCENARIO] Cart %d goal sent to position %.0f", action.Cart, action.Position)
+		case <-sm.clock.After(1 * time.Second):
+			return fmt.Errorf("timeout sending goal to Cart %d", action.Cart)
+		}
+
+	case "path":
+		return sm.SendPath(action.Cart, action.Waypoints)
+
+	case "emergency_stop":
+		select {
+		case sm.emergencyStops[action.Cart-1] <- true:
+			log.Printf("[SCENARIO] Emergency stop sent to Cart %d", action.Cart)
+		case <-sm.clock.After(100 * time.Millisecond):
+			return fmt.Errorf("timeout sending emergency stop to Cart %d", action.Cart)
+		}
+
+	case "network":
+		return sm.SetLinkNetwork(action.Link, action.Network.config())
+
+	case "message":
+		id, err := sm.messageQueue.Find(action.Link, action.Kind)
+		if err != nil {
+			return err
+		}
+		return sm.messageQueue.apply(action.Operation, id, time.Duration(action.Duration))
+
+	case "wait":
+		schedule.wait(sm, time.Duration(action.Duration))
+
+	default:
+		return fmt.Errorf("unknown action %q", action.Action)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"sync"
 	"time"
@@ -15,13 +16,6 @@ type CoordinationScenario struct {
 	Category    string `json:"category"` // "single", "two_agent", "three_agent"
 }
 
-// NetworkConfig holds network simulation parameters for scenarios
-type NetworkConfig struct {
-	MinDelay        time.Duration
-	MaxDelay        time.Duration
-	LossProbability float64
-}
-
 // ScenarioManager manages and executes coordination scenarios
 type ScenarioManager struct {
 	originalControllers    []*Controller    // Store original 4-cart setup
@@ -32,8 +26,10 @@ type ScenarioManager struct {
 	controllers       []*Controller
 	carts             []Cart
 	goalChannels      []chan<- float64
+	pathChannels      []chan<- []Waypoint
 	emergencyStops    []chan<- bool
 	scenarios         []CoordinationScenario
+	definitions       map[string]*ScenarioDefinition // Scenario definitions by name
 	currentStatus     map[string]string
 	activeCartCount   int
 	originalCartCount int
@@ -41,6 +37,7 @@ type ScenarioManager struct {
 	// Network simulation
 	currentNetworkConfig NetworkConfig
 	networkSimulators    []*NetworkDelaySimulator
+	messageQueue         *MessageQueue // Messages held by manual links
 
 	// Goal manager integration
 	goalManager                  *GoalManager
@@ -53,37 +50,50 @@ type ScenarioManager struct {
 	controllerStops    []chan struct{}
 	isRunning          bool
 
+	// Time source shared by physics, controllers, network and scenarios
+	clock Clock
+	// Seed for the network simulators' random sources
+	seed uint64
+	// Destination for controller logs (nil keeps the controllers' default output)
+	logOutput io.Writer
+
+	// Expectations declared by the running scenario and the failures found so far
+	expectations        []Expectation
+	expectationFailures map[int]string
+
+	// Collision handling and the collisions since the carts were last reset
+	collisionPolicy CollisionPolicy
+	restitution     float64
+	collisions      []CollisionEvent
+	contacts        map[[2]int]bool // Cart pairs currently in contact
+	halted          bool
+
+	// Safety alarms since the carts were last reset, the violations still going on
+	// and the physics ticks the monitor had to skip
+	safetyAlarms       []SafetyAlarm
+	activeViolations   map[string]bool
+	safetyObservers    []func(SafetyAlarm)
+	skippedSafetyTicks int
+
+	// Drive, sensor and estimator of carts whose scenario does not set them
+	drive     DriveParameters
+	sensor    SensorParameters
+	estimator EstimatorParameters
+
+	// Feed-forward gains and control law of controllers whose scenario does not set them
+	feedForward FeedForward
+	controlLaw  ControlLawParameters
+
+	// Called after every change of a controller's parameters
+	parameterObservers []func(CartParameters)
+	// Called after every change of a link's network
+	networkObservers []func([]LinkNetwork)
+
 	mu sync.RWMutex
 }
 
 // NewScenarioManager creates a new scenario manager
-func NewScenarioManager(controllers []*Controller, goalChannels []chan<- float64, emergencyStops []chan<- bool, carts []Cart, randomControlChannel chan ControlMessage, controllerCompletionChannels []<-chan bool) *ScenarioManager {
-	scenarios := []CoordinationScenario{
-		// Default scenario (original 4-cart setup)
-		{Name: "Privzeti scenarij", Description: "Default 4-cart configuration for general testing", Status: "idle", Category: "multi_agent"},
-
-		// Single Agent Scenarios
-		{Name: "Preprost premik", Description: "Agent receives a goal within its borders and moves to it", Status: "idle", Category: "single"},
-		{Name: "Zavrnjen cilj", Description: "Agent receives a goal outside its borders (no neighbor present) and rejects it", Status: "idle", Category: "single"},
-		{Name: "Ustavitev gibanja", Description: "While moving towards a valid goal, the agent receives a stop request and halts as quickly as possible", Status: "idle", Category: "single"},
-		{Name: "Sprememba cilja med gibanjem", Description: "Agent starts moving towards one goal, then receives a new goal mid movement", Status: "idle", Category: "single"},
-
-		// Two Agent Scenarios
-		{Name: "Premik meje", Description: "Agent requests a goal that requires the neighbor to shift its border but not vacate", Status: "idle", Category: "two_agent"},
-		{Name: "Umik soseda", Description: "Agent requests a goal requiring the neighbor to both move the border and relocate itself", Status: "idle", Category: "two_agent"},
-		{Name: "Odložena zahteva", Description: "Agent requests a goal while the neighbor is busy and must wait", Status: "idle", Category: "two_agent"},
-		{Name: "Navzkrižni cilji", Description: "Both agents simultaneously request goals requiring the other to move", Status: "idle", Category: "two_agent"},
-		{Name: "Prekinjen cilj", Description: "While moving, an agent receives a neighbor's request to vacate space", Status: "idle", Category: "two_agent"},
-		{Name: "Prekinjeno umikanje", Description: "Neighbor changes to a new goal mid-avoidance, requiring further coordination", Status: "idle", Category: "two_agent"},
-
-		// Three Agent Scenarios
-		{Name: "Verižne zahteve", Description: "Agent requests a goal in the third agent's territory, requiring multi-hop negotiation", Status: "idle", Category: "three_agent"},
-		{Name: "Nedosegljiv cilj", Description: "Agent requests a goal beyond the collective reachable space, and the farthest agent rejects it", Status: "idle", Category: "three_agent"},
-		{Name: "Nezanesljivo omrežje", Description: "Chained requests with packet loss - system must converge without collision", Status: "idle", Category: "three_agent"},
-		{Name: "Počasno omrežje", Description: "Chained requests with high latency - agents must handle delayed responses safely", Status: "idle", Category: "three_agent"},
-		{Name: "Navzkrižni cilji z vmesnim agentom", Description: "Two agents simultaneously initiate requests requiring the middle agent to cooperate", Status: "idle", Category: "three_agent"},
-	}
-
+func NewScenarioManager(controllers []*Controller, goalChannels []chan<- float64, emergencyStops []chan<- bool, carts []Cart, randomControlChannel chan ControlMessage, controllerCompletionChannels []<-chan bool, clock Clock) *ScenarioManager {
 	var activeCartCount, originalCartCount int
 	var controllerStops []chan struct{}
 
@@ -109,7 +119,8 @@ func NewScenarioManager(controllers []*Controller, goalChannels []chan<- float64
 		carts:              carts,
 		goalChannels:       goalChannels,
 		emergencyStops:     emergencyStops,
-		scenarios:          scenarios,
+		scenarios:          make([]CoordinationScenario, 0),
+		definitions:        make(map[string]*ScenarioDefinition),
 		currentStatus:      make(map[string]string),
 		activeCartCount:    activeCartCount,
 		originalCartCount:  originalCartCount,
@@ -117,14 +128,18 @@ func NewScenarioManager(controllers []*Controller, goalChannels []chan<- float64
 		physicsExitChannel: make(chan struct{}),
 		controllerStops:    controllerStops,
 		isRunning:          false,
+		clock:              clock,
+		seed:               1,
+
+		// Collisions halt the simulation unless configured otherwise
+		collisionPolicy: CollisionHalt,
+		restitution:     defaultRestitution,
+		contacts:        make(map[[2]int]bool),
 
 		// Network simulation - default to low latency, no packet loss
-		currentNetworkConfig: NetworkConfig{
-			MinDelay:        10 * time.Millisecond,
-			MaxDelay:        20 * time.Millisecond,
-			LossProbability: 0.0,
-		},
-		networkSimulators: make([]*NetworkDelaySimulator, 0),
+		currentNetworkConfig: defaultNetworkConfig(),
+		networkSimulators:    make([]*NetworkDelaySimulator, 0),
+		messageQueue:         NewMessageQueue(clock),
 
 		// Goal manager integration
 		randomControlChannel:         randomControlChannel,
@@ -134,9 +149,12 @@ func NewScenarioManager(controllers []*Controller, goalChannels []chan<- float64
 	// Copy original carts
 	copy(sm.originalCarts, carts)
 
+	// Register the scenarios shipped with the binary
+	sm.loadBuiltinScenarios()
+
 	// Initialize goal manager only if we have initial controllers
 	if controllers != nil && goalChannels != nil && controllerCompletionChannels != nil {
-		sm.goalManager = NewGoalManager(sm.goalChannels, sm.controllerCompletionChannels, sm.randomControlChannel)
+		sm.goalManager = NewGoalManager(sm.goalChannels, sm.controllerCompletionChannels, sm.randomControlChannel, sm.clock)
 		sm.goalManager.Start()
 	}
 
@@ -182,7 +200,7 @@ func (sm *ScenarioManager) updateGoalManager() {
 		// Create new goal manager with current configuration
 		log.Printf("[SCENARIO] Creating new goal manager with %d goal channels and %d completion channels",
 			len(sm.goalChannels), len(sm.controllerCompletionChannels))
-		sm.goalManager = NewGoalManager(sm.goalChannels, sm.controllerCompletionChannels, sm.randomControlChannel)
+		sm.goalManager = NewGoalManager(sm.goalChannels, sm.controllerCompletionChannels, sm.randomControlChannel, sm.clock)
 		sm.goalManager.Start()
 	}
 
@@ -192,18 +210,52 @@ func (sm *ScenarioManager) updateGoalManager() {
 // setNetworkConfig updates the network configuration for scenarios
 func (sm *ScenarioManager) setNetworkConfig(config NetworkConfig) {
 	sm.currentNetworkConfig = config
-	log.Printf("[SCENARIO] Network config updated: minDelay=%v, maxDelay=%v, loss=%.3f",
-		config.MinDelay, config.MaxDelay, config.LossProbability)
+	log.Printf("[SCENARIO] Network config updated: %s", config)
 }
 
-// connectControllersWithConfig connects controllers using the current network configuration
-func (sm *ScenarioManager) connectControllersWithConfig(leftController, rightController *Controller) *NetworkDelaySimulator {
-	// Create network simulator with current config
+// applyNetworkConfig pushes the current network configuration to the running network simulators
+func (sm *ScenarioManager) applyNetworkConfig() {
+	for _, networkSim := range sm.networkSimulators {
+		networkSim.setConfig(sm.currentNetworkConfig)
+	}
+}
+
+// Messages returns the queue of messages held by manual links
+func (sm *ScenarioManager) Messages() *MessageQueue {
+	return sm.messageQueue
+}
+
+// LinkReport is what happened to the messages between two neighbouring carts
+type LinkReport struct {
+	LeftCart    int          `json:"leftCart"`
+	RightCart   int          `json:"rightCart"`
+	LeftToRight NetworkStats `json:"leftToRight"`
+	RightToLeft NetworkStats `json:"rightToLeft"`
+}
+
+// NetworkReport returns the message counts of every link since the carts were reset
+func (sm *ScenarioManager) NetworkReport() []LinkReport {
+	var reports []LinkReport
+	for i, networkSim := range sm.networkSimulators {
+		reports = append(reports, LinkReport{
+			LeftCart:    sm.controllers[i].Cart.Id,
+			RightCart:   sm.controllers[i+1].Cart.Id,
+			LeftToRight: networkSim.Stats(LeftToRight),
+			RightToLeft: networkSim.Stats(RightToLeft),
+		})
+	}
+	return reports
+}
+
+// connectControllersWithConfig connects controllers over a link using the current network configuration
+func (sm *ScenarioManager) connectControllersWithConfig(link int, leftController, rightController *Controller) *NetworkDelaySimulator {
+	// Create network simulator with current config, seeded per link so runs are repeatable
 	networkSim := NewNetworkDelaySimulator(
-		sm.currentNetworkConfig.MinDelay,
-		sm.currentNetworkConfig.MaxDelay,
-		sm.currentNetworkConfig.LossProbability,
+		sm.currentNetworkConfig,
+		sm.clock,
+		sm.seed+uint64(leftController.Cart.Id),
 	)
+	networkSim.useQueue(sm.messageQueue, link)
 
 	// Create intermediate channels for the network simulation
 	leftToRightRequestIntermediate := make(chan Request, 10)
@@ -229,10 +281,10 @@ func (sm *ScenarioManager) connectControllersWithConfig(leftController, rightCon
 	rightController.IncomingLeftResponse = leftToRightResponse
 
 	// Set up network intermediaries to relay with delays
-	networkSim.relayRequests(leftToRightRequestIntermediate, leftToRightRequest)
-	networkSim.relayRequests(rightToLeftRequestIntermediate, rightToLeftRequest)
-	networkSim.relayResponses(leftToRightResponseIntermediate, leftToRightResponse)
-	networkSim.relayResponses(rightToLeftResponseIntermediate, rightToLeftResponse)
+	networkSim.relayRequests(LeftToRight, leftToRightRequestIntermediate, leftToRightRequest)
+	networkSim.relayRequests(RightToLeft, rightToLeftRequestIntermediate, rightToLeftRequest)
+	networkSim.relayResponses(LeftToRight, leftToRightResponseIntermediate, leftToRightResponse)
+	networkSim.relayResponses(RightToLeft, rightToLeftResponseIntermediate, rightToLeftResponse)
 
 	return networkSim
 }
@@ -253,6 +305,26 @@ func (sm *ScenarioManager) GetGoalManager() *GoalManager {
 	return sm.goalManager
 }
 
+// SendPath sends a multi-waypoint path to a 1-based cart number
+func (sm *ScenarioManager) SendPath(cart int, path []Waypoint) error {
+	if err := validatePath(path); err != nil {
+		return err
+	}
+	sm.mu.RLock()
+	pathChannels := sm.pathChannels
+	sm.mu.RUnlock()
+	if cart < 1 || cart > len(pathChannels) {
+		return fmt.Errorf("cart %d does not exist", cart)
+	}
+	select {
+	case pathChannels[cart-1] <- path:
+		log.Printf("[SCENARIO] Cart %d path sent: %s", cart, describePath(path))
+		return nil
+	case <-sm.clock.After(1 * time.Second):
+		return fmt.Errorf("timeout sending path to Cart %d", cart)
+	}
+}
+
 // GetScenarios returns the list of available scenarios
 func (sm *ScenarioManager) GetScenarios() []CoordinationScenario {
 	sm.mu.RLock()
@@ -282,52 +354,31 @@ func (sm *ScenarioManager) RunScenario(scenarioName string) error {
 	// Initialize metrics for all controllers in the scenario
 	sm.initializeScenarioMetrics()
 
+	// Check the scenario's expectations while it runs
+	sm.resetExpectations()
+	stopMonitor := make(chan struct{})
+	monitorDone := make(chan struct{})
+	go sm.monitorExpectations(stopMonitor, monitorDone)
+
+	sm.mu.RLock()
+	definition, exists := sm.definitions[scenarioName]
+	sm.mu.RUnlock()
+
 	var err error
-	switch scenarioName {
-	// Default scenario
-	case "Privzeti scenarij":
-		err = sm.runDefault()
-
-	// Single Agent Scenarios
-	case "Preprost premik":
-		err = sm.runSimpleMove()
-	case "Zavrnjen cilj":
-		err = sm.runSimpleReject()
-	case "Ustavitev gibanja":
-		err = sm.runStopMovement()
-	case "Sprememba cilja med gibanjem":
-		err = sm.runChangeGoalMidMovement()
-
-	// Two Agent Scenarios
-	case "Premik meje":
-		err = sm.runBorderMove()
-	case "Umik soseda":
-		err = sm.runNeighborMove()
-	case "Odložena zahteva":
-		err = sm.runPostponedRequest()
-	case "Navzkrižni cilji":
-		err = sm.runCrossedGoals()
-	case "Prekinjen cilj":
-		err = sm.runOverriddenGoal()
-	case "Prekinjeno umikanje":
-		err = sm.runChangeOfPlans()
-
-	// Three Agent Scenarios
-	case "Verižne zahteve":
-		err = sm.runChainedRequests()
-	case "Nedosegljiv cilj":
-		err = sm.runTooFar()
-	case "Nezanesljivo omrežje":
-		err = sm.runUnreliableNetwork()
-	case "Počasno omrežje":
-		err = sm.runSlowNetwork()
-	case "Navzkrižni cilji z vmesnim agentom":
-		err = sm.runConcurrentChainedRequests()
-
-	default:
+	if exists {
+		err = sm.runDefinition(definition)
+	} else {
 		err = fmt.Errorf("unknown scenario: %s", scenarioName)
 	}
 
+	close(stopMonitor)
+	<-monitorDone
+	if err == nil {
+		if expectationErr := sm.evaluateExpectations(); expectationErr != nil {
+			err = fmt.Errorf("expectations failed: %w", expectationErr)
+		}
+	}
+
 	sm.mu.Lock()
 	if err != nil {
 		sm.currentStatus[scenarioName] = "failed"
@@ -345,110 +396,135 @@ func (sm *ScenarioManager) RunScenario(scenarioName string) error {
 // SCENARIO CONTROL AND CART MANAGEMENT
 // =====================================================
 
-// runDefault implements the default 4-cart scenario
-func (sm *ScenarioManager) runDefault() error {
-	log.Println("[SCENARIO] Default: Setting up standard 4-cart configuration")
-
-	sm.resetCartsWithCount(4)
-	log.Println("[SCENARIO] Default configuration active. System ready for manual goals.")
-
-	// Default scenario runs indefinitely until another scenario is started
-	return nil
-}
-
 // =====================================================
 // CART CONFIGURATION UTILITIES
 // =====================================================
 
-// resetCartsWithCount resets carts with a specific count for the scenario by creating new instances
-func (sm *ScenarioManager) resetCartsWithCount(cartCount int) {
+// resetCarts replaces the carts and controllers with new instances laid out as
+// given, with the track's limits if there are any
+func (sm *ScenarioManager) resetCarts(layout []ScenarioCart, feedForward FeedForward, track *TrackSpec) {
+	cartCount := len(layout)
 	log.Printf("[SCENARIO] Resetting to %d cart configuration with new instances", cartCount)
 
 	// Stop all current controllers
 	sm.stopAllControllers()
-	time.Sleep(100 * time.Millisecond) // Give time for controllers to stop
+	sm.clock.Sleep(100 * time.Millisecond) // Give time for controllers to stop
 
 	// Create new cart instances based on original carts
 	sm.carts = make([]Cart, cartCount)
 	for i := 0; i < cartCount; i++ {
-		// Copy from original carts with proper spacing
-		sm.carts[i] = sm.originalCarts[i]
-		// Reset positions based on cart count for proper spacing
-		switch cartCount {
-		case 1:
-			sm.carts[i].Position = 400.0 // Center of field
-		case 2:
-			positions := []float64{400.0, 1200.0}
-			sm.carts[i].Position = positions[i]
-		case 3:
-			positions := []float64{300.0, 800.0, 1300.0}
-			sm.carts[i].Position = positions[i]
-		case 4:
-			// Use original positions
-			sm.carts[i].Position = sm.originalCarts[i].Position
+		if i < len(sm.originalCarts) {
+			sm.carts[i] = sm.originalCarts[i]
+		} else {
+			// More carts than templates, derive one from the first template
+			sm.carts[i] = sm.originalCarts[0]
+			sm.carts[i].Name = fmt.Sprintf("Cart %d", i+1)
+			sm.carts[i].Id = i + 1
 		}
+		sm.carts[i].Position = layout[i].Position
 		// Reset motion state
 		sm.carts[i].Velocity = 0
 		sm.carts[i].Acceleration = 0
 		sm.carts[i].Force = 0
+		// Every cart gets its own drive state
+		drive := sm.drive
+		if layout[i].Drive != nil {
+			drive = *layout[i].Drive
+		}
+		sm.carts[i].Drive = NewActuatorDrive(drive)
+		sensor := sm.sensor
+		if layout[i].Sensor != nil {
+			sensor = *layout[i].Sensor
+		}
+		sm.carts[i].Sensor = nil // A perfect sensor reads the physics directly
+		if sensor != (SensorParameters{}) {
+			sm.carts[i].Sensor = NewEncoderSensor(sensor, sm.clock.Now(), PhysicsState{Position: layout[i].Position}, sm.seed+uint64(sm.carts[i].Id))
+		}
 	}
 
 	// Create new controller instances
-	sm.controllers = make([]*Controller, cartCount)
+	controllers := make([]*Controller, cartCount)
 	sm.goalChannels = make([]chan<- float64, cartCount)
+	sm.pathChannels = make([]chan<- []Waypoint, cartCount)
 	sm.emergencyStops = make([]chan<- bool, cartCount)
 
-	// Define territories based on cart count
-	var territoryBounds [][]float64
-	switch cartCount {
-	case 1:
-		territoryBounds = [][]float64{{100, 1500}}
-	case 2:
-		territoryBounds = [][]float64{{50, 800}, {800, 1550}}
-	case 3:
-		territoryBounds = [][]float64{{25, 533}, {533, 1066}, {1066, 1575}}
-	case 4:
-		territoryBounds = [][]float64{{0, 400}, {400, 800}, {800, 1200}, {1200, 1600}}
-	}
-
 	// Create new controllers with their territories
 	for i := 0; i < cartCount; i++ {
-		sm.controllers[i] = NewController(&sm.carts[i], territoryBounds[i][0], territoryBounds[i][1])
+		territory := layout[i].Territory
+		controllers[i] = NewController(&sm.carts[i], territory[0], territory[1], sm.clock)
+		if sm.logOutput != nil {
+			controllers[i].logger.SetOutput(sm.logOutput)
+		}
+		estimator := sm.estimator
+		if layout[i].Estimator != nil {
+			estimator = *layout[i].Estimator
+		}
+		controllers[i].Estimator = newStateEstimator(estimator, sm.carts[i].Mass, sm.clock.Now(), layout[i].Position)
+		controlLaw := sm.controlLaw
+		if layout[i].ControlLaw != nil {
+			controlLaw = *layout[i].ControlLaw
+		}
+		parameters := controllers[i].Parameters()
+		parameters.ControlLaw = resolveControlLaw(controlLaw)
+		parameters.FeedForward = feedForward
+		if track != nil {
+			if track.MaxDeceleration > 0 {
+				parameters.MaxDeceleration = track.MaxDeceleration
+			}
+			parameters.SpeedLimits = track.SpeedLimits
+		}
+		controllers[i].applyParameters(parameters)
 
 		// Create new goal and emergency channels
 		goalCh := make(chan float64, 10)
+		pathCh := make(chan []Waypoint, 10)
 		emergencyCh := make(chan bool, 10)
 
-		sm.controllers[i].IncomingGoalRequest = goalCh
-		sm.controllers[i].IncomingEmergencyStop = emergencyCh
+		controllers[i].IncomingGoalRequest = goalCh
+		controllers[i].IncomingPathRequest = pathCh
+		controllers[i].IncomingEmergencyStop = emergencyCh
 
 		sm.goalChannels[i] = goalCh
+		sm.pathChannels[i] = pathCh
 		sm.emergencyStops[i] = emergencyCh
 
 		// Start the controller
-		go sm.controllers[i].run_controller()
+		go controllers[i].run_controller()
 		log.Printf("[SCENARIO] Created and started new controller %d with territory [%.0f, %.0f]",
-			i+1, territoryBounds[i][0], territoryBounds[i][1])
+			i+1, territory[0], territory[1])
 	}
 
+	// The safety monitor reads the controllers from its own goroutine
+	sm.mu.Lock()
+	sm.controllers = controllers
+	sm.mu.Unlock()
+
 	// Connect controllers for coordination with current network config
 	sm.networkSimulators = make([]*NetworkDelaySimulator, 0)
+	sm.messageQueue.clear()
 	for i := 0; i < len(sm.controllers)-1; i++ {
-		networkSim := sm.connectControllersWithConfig(sm.controllers[i], sm.controllers[i+1])
+		networkSim := sm.connectControllersWithConfig(i+1, sm.controllers[i], sm.controllers[i+1])
 		sm.networkSimulators = append(sm.networkSimulators, networkSim)
 	}
 
 	sm.activeCartCount = cartCount
 
+	// New carts start without collisions or alarms, which also resumes a halted simulation
+	sm.resetCollisions()
+	sm.resetSafetyAlarms()
+
 	// Update goal manager for new cart configuration
 	sm.updateGoalManager()
 
 	log.Printf("[SCENARIO] Successfully created %d new cart instances with network config", cartCount)
 }
 
-// stopAllControllers stops all running controllers
+// stopAllControllers stops all running controllers and the links between them
 func (sm *ScenarioManager) stopAllControllers() {
 	log.Println("[SCENARIO] Stopping all controllers")
+	for _, networkSim := range sm.networkSimulators {
+		networkSim.Stop()
+	}
 	for i, controller := range sm.controllers {
 		if controller.StopController != nil {
 			select {
@@ -460,432 +536,3 @@ func (sm *ScenarioManager) stopAllControllers() {
 		}
 	}
 }
-
-// =====================================================
-// SINGLE AGENT SCENARIOS
-// =====================================================
-
-func (sm *ScenarioManager) runSimpleMove() error {
-	log.Println("[SCENARIO] Simple Move: Agent receives a goal within its borders and moves to it")
-
-	sm.resetCartsWithCount(1)
-	time.Sleep(500 * time.Millisecond)
-
-	// Single cart can use most of the field
-	goal := 1200.0 // Move to 1200
-
-	select {
-	case sm.goalChannels[0] <- goal:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f", goal)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	time.Sleep(8 * time.Second)
-	return nil
-}
-
-func (sm *ScenarioManager) runSimpleReject() error {
-	log.Println("[SCENARIO] Simple Reject: Agent receives a goal outside its borders (no neighbor present)")
-
-	sm.resetCartsWithCount(1)
-	time.Sleep(500 * time.Millisecond)
-
-	// Send a goal way outside the field bounds
-	goal := 2000.0 // Way beyond any reachable space
-	select {
-	case sm.goalChannels[0] <- goal:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f (should be rejected)", goal)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	time.Sleep(1 * time.Second)
-	return nil
-}
-
-func (sm *ScenarioManager) runStopMovement() error {
-	log.Println("[SCENARIO] Stop Movement: While moving towards a valid goal, agent receives a stop request")
-
-	sm.resetCartsWithCount(1)
-	time.Sleep(500 * time.Millisecond)
-
-	// Send single cart a goal across the field
-	goal := 1200.0
-
-	select {
-	case sm.goalChannels[0] <- goal:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f", goal)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	// Wait for movement to start, then send emergency stop
-	time.Sleep(2 * time.Second)
-
-	log.Println("[SCENARIO] Triggering emergency stop while moving!")
-	select {
-	case sm.emergencyStops[0] <- true:
-		log.Println("[SCENARIO] Emergency stop sent to Cart 1")
-	case <-time.After(100 * time.Millisecond):
-		return fmt.Errorf("timeout sending emergency stop to Cart 1")
-	}
-
-	time.Sleep(5 * time.Second)
-	return nil
-}
-
-func (sm *ScenarioManager) runChangeGoalMidMovement() error {
-	log.Println("[SCENARIO] Change Goal Mid Movement: Agent starts moving towards one goal, then receives a new goal mid movement")
-
-	sm.resetCartsWithCount(1)
-	time.Sleep(500 * time.Millisecond)
-
-	// Send single cart initial goal (towards one end)
-	goal1 := 1200.0
-
-	select {
-	case sm.goalChannels[0] <- goal1:
-		log.Printf("[SCENARIO] Cart 1 initial goal sent to position %.0f", goal1)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending initial goal to Cart 1")
-	}
-
-	// Wait for movement to start, then send opposite direction goal
-	time.Sleep(2000 * time.Millisecond)
-
-	goal2 := 400.0
-	select {
-	case sm.goalChannels[0] <- goal2:
-		log.Printf("[SCENARIO] Cart 1 opposite goal sent to position %.0f", goal2)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending opposite goal to Cart 1")
-	}
-
-	time.Sleep(8 * time.Second)
-	return nil
-}
-
-// =====================================================
-// TWO AGENT SCENARIOS
-// =====================================================
-
-func (sm *ScenarioManager) runBorderMove() error {
-	log.Println("[SCENARIO] Border Move: Agent requests a goal that requires neighbor to shift border but not vacate")
-
-	sm.resetCartsWithCount(2)
-	time.Sleep(500 * time.Millisecond)
-
-	// Cart 1 wants to move slightly into Cart 2's territory
-	// With 2 carts: Cart 1 (0-800), Cart 2 (800-1600)
-	goal := 850.0 // Just into Cart 2's territory
-	select {
-	case sm.goalChannels[0] <- goal:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f (requires border shift from Cart 2)", goal)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	time.Sleep(10 * time.Second)
-	return nil
-}
-
-func (sm *ScenarioManager) runNeighborMove() error {
-	log.Println("[SCENARIO] Neighbor Move: Agent requests a goal requiring neighbor to move border and relocate itself")
-
-	sm.resetCartsWithCount(2)
-	time.Sleep(500 * time.Millisecond)
-
-	// Cart 1 wants to move deep into Cart 2's territory, requiring Cart 2 to relocate
-	goal := 1400.0 // Deep into Cart 2's territory (800-1500)
-	select {
-	case sm.goalChannels[0] <- goal:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f (requires Cart 2 to relocate)", goal)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	time.Sleep(12 * time.Second)
-	return nil
-}
-
-func (sm *ScenarioManager) runPostponedRequest() error {
-	log.Println("[SCENARIO] Postponed Request: Agent requests a goal while neighbor is busy, must wait")
-
-	sm.resetCartsWithCount(2)
-	time.Sleep(500 * time.Millisecond)
-
-	// First make Cart 2 busy with its own goal
-	goal2 := 1200.0
-	select {
-	case sm.goalChannels[1] <- goal2:
-		log.Printf("[SCENARIO] Cart 2 goal sent to position %.0f (making it busy)", goal2)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 2")
-	}
-
-	// Wait a moment, then send Cart 1 a goal that requires Cart 2 to move out of the way
-	time.Sleep(1 * time.Second)
-
-	goal1 := 1200.0 // Requires Cart 2's cooperation while it's busy
-	select {
-	case sm.goalChannels[0] <- goal1:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f (should be postponed)", goal1)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	time.Sleep(15 * time.Second)
-	return nil
-}
-
-func (sm *ScenarioManager) runCrossedGoals() error {
-	log.Println("[SCENARIO] Crossed Goals: Both agents simultaneously request goals requiring the other to move")
-
-	sm.resetCartsWithCount(2)
-	time.Sleep(500 * time.Millisecond)
-
-	// Send crossed goals simultaneously
-	// Cart 1 (starts at 400) wants Cart 2's territory, Cart 2 (starts at 1200) wants Cart 1's territory
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		select {
-		case sm.goalChannels[0] <- 1100.0: // Cart 1 to Cart 2's territory
-			log.Println("[SCENARIO] Cart 1 goal sent to position 1100 (crosses into Cart 2's territory)")
-		case <-time.After(1 * time.Second):
-			log.Println("[SCENARIO] Timeout sending goal to Cart 1")
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		select {
-		case sm.goalChannels[1] <- 500.0: // Cart 2 to Cart 1's territory
-			log.Println("[SCENARIO] Cart 2 goal sent to position 500 (crosses into Cart 1's territory)")
-		case <-time.After(1 * time.Second):
-			log.Println("[SCENARIO] Timeout sending goal to Cart 2")
-		}
-	}()
-
-	wg.Wait()
-	log.Println("[SCENARIO] Crossed goals sent simultaneously. Watch coordination!")
-
-	time.Sleep(15 * time.Second)
-	return nil
-}
-
-func (sm *ScenarioManager) runOverriddenGoal() error {
-	log.Println("[SCENARIO] Overridden Goal: While moving, agent receives neighbor's request to vacate space")
-
-	sm.resetCartsWithCount(2)
-	time.Sleep(500 * time.Millisecond)
-
-	// Start Cart 1 moving towards a goal
-	goal1 := 700.0
-	select {
-	case sm.goalChannels[0] <- goal1:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f", goal1)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	// Wait for movement to start, then send Cart 2 a goal that requires Cart 1's space
-	time.Sleep(1000 * time.Millisecond)
-
-	goal2 := 250.0 // Cart 2 wants Cart 1's current area
-	select {
-	case sm.goalChannels[1] <- goal2:
-		log.Printf("[SCENARIO] Cart 2 goal sent to position %.0f (should override Cart 1's movement)", goal2)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 2")
-	}
-
-	time.Sleep(12 * time.Second)
-	return nil
-}
-
-func (sm *ScenarioManager) runChangeOfPlans() error {
-	log.Println("[SCENARIO] Change of Plans: Neighbor changes to new goal mid-avoidance, requiring further coordination")
-
-	sm.resetCartsWithCount(2)
-	time.Sleep(500 * time.Millisecond)
-
-	// Start by sending cart 1 deep into cart 2's territory
-	goal1 := 1400.0
-	select {
-	case sm.goalChannels[0] <- goal1:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f (crosses into Cart 2's territory)", goal1)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	// Wait for coordination to start, then change Cart 2's plan
-	time.Sleep(1 * time.Second)
-
-	newGoal2 := 150.0 // Cart 2 changes to different goal
-	select {
-	case sm.goalChannels[1] <- newGoal2:
-		log.Printf("[SCENARIO] Cart 2 changed plans to position %.0f mid-coordination", newGoal2)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending new goal to Cart 2")
-	}
-
-	time.Sleep(12 * time.Second)
-	return nil
-}
-
-// =====================================================
-// THREE AGENT SCENARIOS
-// =====================================================
-
-func (sm *ScenarioManager) runChainedRequests() error {
-	log.Println("[SCENARIO] Chained Requests: Agent requests goal in third agent's territory, requiring multi-hop negotiation")
-
-	sm.resetCartsWithCount(3)
-	time.Sleep(500 * time.Millisecond)
-
-	// Cart 1 wants to reach Cart 3's territory, requiring coordination through Cart 2
-	// With 3 carts: Cart 1 (0-533), Cart 2 (533-1067), Cart 3 (1067-1600)
-	goal := 1300.0 // Deep into Cart 3's territory
-	select {
-	case sm.goalChannels[0] <- goal:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f (requires chained negotiation through Cart 2)", goal)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	time.Sleep(15 * time.Second)
-	return nil
-}
-
-func (sm *ScenarioManager) runTooFar() error {
-	log.Println("[SCENARIO] Too Far: Agent requests goal beyond collective reachable space, farthest agent rejects")
-
-	sm.resetCartsWithCount(3)
-	time.Sleep(500 * time.Millisecond)
-
-	// Cart 1 wants to reach way beyond Cart 3's territory
-	goal := 1800.0 // Way beyond any reachable space
-	select {
-	case sm.goalChannels[0] <- goal:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f (should be rejected as too far)", goal)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	time.Sleep(10 * time.Second)
-	return nil
-}
-
-func (sm *ScenarioManager) runUnreliableNetwork() error {
-	log.Println("[SCENARIO] Unreliable Network: Chained requests with packet loss, system must converge without collision")
-
-	// Set network config with packet loss for this scenario
-	sm.setNetworkConfig(NetworkConfig{
-		MinDelay:        10 * time.Millisecond,
-		MaxDelay:        20 * time.Millisecond,
-		LossProbability: 0.15, // 15% packet loss
-	})
-
-	sm.resetCartsWithCount(3)
-	time.Sleep(500 * time.Millisecond)
-
-	// Enable packet loss simulation for this scenario
-	log.Println("[SCENARIO] Simulating packet loss during chained negotiation")
-
-	// Cart 1 wants to reach Cart 3's territory with unreliable network
-	goal := 1300.0
-	select {
-	case sm.goalChannels[0] <- goal:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f with network unreliability", goal)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	time.Sleep(20 * time.Second) // Longer time due to retries
-
-	// Reset to default network config
-	sm.setNetworkConfig(NetworkConfig{
-		MinDelay:        10 * time.Millisecond,
-		MaxDelay:        15 * time.Millisecond,
-		LossProbability: 0.0,
-	})
-
-	return nil
-}
-
-func (sm *ScenarioManager) runSlowNetwork() error {
-	log.Println("[SCENARIO] Slow Network: Chained requests with high latency, agents must handle delayed responses")
-
-	// Set network config with high latency for this scenario
-	sm.setNetworkConfig(NetworkConfig{
-		MinDelay:        100 * time.Millisecond,
-		MaxDelay:        300 * time.Millisecond,
-		LossProbability: 0.0, // No packet loss, just high latency
-	})
-
-	sm.resetCartsWithCount(3)
-	time.Sleep(500 * time.Millisecond)
-
-	log.Println("[SCENARIO] Simulating high network latency during chained negotiation")
-
-	// Cart 1 wants to reach Cart 3's territory with slow network
-	goal := 1300.0
-	select {
-	case sm.goalChannels[0] <- goal:
-		log.Printf("[SCENARIO] Cart 1 goal sent to position %.0f with high latency", goal)
-	case <-time.After(1 * time.Second):
-		return fmt.Errorf("timeout sending goal to Cart 1")
-	}
-
-	time.Sleep(25 * time.Second) // Much longer time due to latency
-
-	// Reset to default network config
-	sm.setNetworkConfig(NetworkConfig{
-		MinDelay:        10 * time.Millisecond,
-		MaxDelay:        15 * time.Millisecond,
-		LossProbability: 0.0,
-	})
-
-	return nil
-}
-
-func (sm *ScenarioManager) runConcurrentChainedRequests() error {
-	log.Println("[SCENARIO] Concurrent Chained Requests: Two agents simultaneously initiate requests requiring middle agent cooperation")
-
-	sm.resetCartsWithCount(3)
-	time.Sleep(500 * time.Millisecond)
-
-	// Cart 1 and Cart 3 simultaneously request goals that require Cart 2's cooperation
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		select {
-		case sm.goalChannels[0] <- 1400.0: // Cart 1 to Cart 3's territory
-			log.Println("[SCENARIO] Cart 1 goal sent to position 1400 (requires Cart 2's cooperation)")
-		case <-time.After(1 * time.Second):
-			log.Println("[SCENARIO] Timeout sending goal to Cart 1")
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		select {
-		case sm.goalChannels[2] <- 300.0: // Cart 3 to Cart 1's territory
-			log.Println("[SCENARIO] Cart 3 goal sent to position 300 (requires Cart 2's cooperation)")
-		case <-time.After(1 * time.Second):
-			log.Println("[SCENARIO] Timeout sending goal to Cart 3")
-		}
-	}()
-
-	wg.Wait()
-	log.Println("[SCENARIO] Concurrent chained requests sent. Cart 2 must prioritize and resolve!")
-
-	time.Sleep(20 * time.Second)
-	return nil
-}
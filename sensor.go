@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SensorModel sits between the physics and a controller. The physics loop
+// feeds it the true state after every step, the controller reads whatever
+// measurement the sensor would have produced by then.
+type SensorModel interface {
+	// Sample is called by the physics loop with the true state at time now
+	Sample(now time.Time, state PhysicsState)
+	// Read returns the latest measurement available at time now
+	Read(now time.Time) Measurement
+}
+
+// Measurement is what a controller knows about its cart
+type Measurement struct {
+	Time     time.Time // When the measurement was taken
+	Position float64
+	Velocity float64
+}
+
+// SensorParameters describes a cart's position encoder. Zero values disable
+// the corresponding effect.
+type SensorParameters struct {
+	PositionNoise     float64  `json:"positionNoise,omitempty"`     // Standard deviation of the position noise
+	EncoderResolution float64  `json:"encoderResolution,omitempty"` // Smallest position step the encoder reports
+	SampleInterval    Duration `json:"sampleInterval,omitempty"`    // Sample-and-hold period, zero samples every physics step
+	Delay             Duration `json:"delay,omitempty"`             // Time from sampling until the controller sees the measurement
+	VelocityFilter    Duration `json:"velocityFilter,omitempty"`    // Time constant of the velocity estimate's low-pass filter
+}
+
+// sensorPresets are named sensor configurations selectable from the command line
+var sensorPresets = map[string]SensorParameters{
+	"ideal": {},
+	"encoder": {
+		PositionNoise:     0.05,
+		EncoderResolution: 0.1,
+		SampleInterval:    Duration(2 * time.Millisecond),
+		Delay:             Duration(2 * time.Millisecond),
+		VelocityFilter:    Duration(10 * time.Millisecond),
+	},
+}
+
+// getSensorPreset looks up a sensor preset by name
+func getSensorPreset(name string) (SensorParameters, error) {
+	params, exists := sensorPresets[name]
+	if !exists {
+		names := make([]string, 0, len(sensorPresets))
+		for preset := range sensorPresets {
+			names = append(names, preset)
+		}
+		sort.Strings(names)
+		return SensorParameters{}, fmt.Errorf("unknown sensor preset %q (expected one of %s)", name, strings.Join(names, ", "))
+	}
+	return params, nil
+}
+
+// validate checks the parameters
+func (p SensorParameters) validate() error {
+	if p.PositionNoise < 0 || p.EncoderResolution < 0 || p.SampleInterval < 0 || p.Delay < 0 || p.VelocityFilter < 0 {
+		return fmt.Errorf("sensor parameters must not be negative")
+	}
+	return nil
+}
+
+// =====================================================
+// ENCODER SENSOR
+// =====================================================
+
+// EncoderSensor samples the cart position with noise and quantization, holds
+// it for the sample interval and delivers it after a delay. Velocity is
+// estimated from consecutive quantized positions, never read from the physics.
+type EncoderSensor struct {
+	params SensorParameters
+	rng    *rand.Rand
+
+	nextSample time.Time
+	last       Measurement   // Most recent sample taken
+	pending    []Measurement // Samples still in flight to the controller
+	delivered  Measurement   // Latest sample the controller can see
+
+	mu sync.Mutex
+}
+
+// NewEncoderSensor creates a sensor that starts out reading the given state
+func NewEncoderSensor(params SensorParameters, now time.Time, initial PhysicsState, seed uint64) *EncoderSensor {
+	s := &EncoderSensor{
+		params: params,
+		rng:    rand.New(rand.NewPCG(seed, 0x5e4503)),
+	}
+	s.last = Measurement{Time: now, Position: s.quantize(initial.Position)}
+	s.delivered = s.last
+	s.nextSample = now.Add(time.Duration(params.SampleInterval))
+	return s
+}
+
+// quantize adds noise to a true position and rounds it to the encoder resolution
+func (s *EncoderSensor) quantize(position float64) float64 {
+	if s.params.PositionNoise > 0 {
+		position += s.rng.NormFloat64() * s.params.PositionNoise
+	}
+	if s.params.EncoderResolution > 0 {
+		position = math.Round(position/s.params.EncoderResolution) * s.params.EncoderResolution
+	}
+	return position
+}
+
+func (s *EncoderSensor) Sample(now time.Time, state PhysicsState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Sample and hold: nothing changes between samples
+	if now.Before(s.nextSample) {
+		return
+	}
+	s.nextSample = s.nextSample.Add(time.Duration(s.params.SampleInterval))
+	if s.nextSample.Before(now) {
+		s.nextSample = now.Add(time.Duration(s.params.SampleInterval))
+	}
+
+	measurement := Measurement{Time: now, Position: s.quantize(state.Position)}
+
+	// Velocity from the difference of quantized positions, low-pass filtered
+	if dt := now.Sub(s.last.Time).Seconds(); dt > 0 {
+		raw := (measurement.Position - s.last.Position) / dt
+		alpha := 1.0
+		if tau := time.Duration(s.params.VelocityFilter).Seconds(); tau > 0 {
+			alpha = dt / (tau + dt)
+		}
+		measurement.Velocity = s.last.Velocity + alpha*(raw-s.last.Velocity)
+	} else {
+		measurement.Velocity = s.last.Velocity
+	}
+	s.last = measurement
+	s.pending = append(s.pending, measurement)
+}
+
+func (s *EncoderSensor) Read(now time.Time) Measurement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Deliver every sample that has made it through the delay
+	available := now.Add(-time.Duration(s.params.Delay))
+	delivered := 0
+	for delivered < len(s.pending) && !s.pending[delivered].Time.After(available) {
+		s.delivered = s.pending[delivered]
+		delivered++
+	}
+	s.pending = s.pending[delivered:]
+	return s.delivered
+}
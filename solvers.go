@@ -1,18 +1,106 @@
 package main
 
-func rk4_step(f func(float64, float64) float64, t, y, h float64) float64 {
-	k1 := h * f(t, y)
-	k2 := h * f(t+0.5*h, y+0.5*k1)
-	k3 := h * f(t+0.5*h, y+0.5*k2)
-	k4 := h * f(t+h, y+k3)
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
-	return y + (k1+2*k2+2*k3+k4)/6
+// PhysicsState is the state vector integrated for each cart
+type PhysicsState struct {
+	Position float64
+	Velocity float64
 }
 
-func newton_step(f func(float64, float64) float64, t, y, h float64) float64 {
-	return y + h*f(t, y)
+// AccelerationFunc returns the acceleration of a cart in the given state at time t
+type AccelerationFunc func(t float64, state PhysicsState) float64
+
+// Integrator advances a state by one step of length h
+type Integrator interface {
+	Step(f AccelerationFunc, t float64, state PhysicsState, h float64) PhysicsState
+}
+
+// IntegratorFunc adapts a step function to the Integrator interface
+type IntegratorFunc func(f AccelerationFunc, t float64, state PhysicsState, h float64) PhysicsState
+
+func (step IntegratorFunc) Step(f AccelerationFunc, t float64, state PhysicsState, h float64) PhysicsState {
+	return step(f, t, state, h)
+}
+
+// integrators are the selectable integration methods by name
+var integrators = map[string]Integrator{
+	"euler":               IntegratorFunc(newton_step),
+	"semi-implicit-euler": IntegratorFunc(semi_implicit_euler_step),
+	"midpoint":            IntegratorFunc(midpoint_step),
+	"velocity-verlet":     IntegratorFunc(verlet_step),
+	"rk4":                 IntegratorFunc(rk4_step),
+}
+
+// integratorNames returns the names of the available integrators, sorted
+func integratorNames() []string {
+	names := make([]string, 0, len(integrators))
+	for name := range integrators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getIntegrator looks up an integrator by name
+func getIntegrator(name string) (Integrator, error) {
+	integrator, exists := integrators[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown integrator %q (expected one of %s)", name, strings.Join(integratorNames(), ", "))
+	}
+	return integrator, nil
+}
+
+// derivative is the time derivative of a state: (velocity, acceleration)
+func derivative(f AccelerationFunc, t float64, state PhysicsState) PhysicsState {
+	return PhysicsState{Position: state.Velocity, Velocity: f(t, state)}
+}
+
+// add returns s + h*d
+func (s PhysicsState) add(d PhysicsState, h float64) PhysicsState {
+	return PhysicsState{Position: s.Position + h*d.Position, Velocity: s.Velocity + h*d.Velocity}
+}
+
+// rk4_step is the classic fourth-order Runge-Kutta method
+func rk4_step(f AccelerationFunc, t float64, state PhysicsState, h float64) PhysicsState {
+	k1 := derivative(f, t, state)
+	k2 := derivative(f, t+0.5*h, state.add(k1, 0.5*h))
+	k3 := derivative(f, t+0.5*h, state.add(k2, 0.5*h))
+	k4 := derivative(f, t+h, state.add(k3, h))
+
+	return PhysicsState{
+		Position: state.Position + h*(k1.Position+2*k2.Position+2*k3.Position+k4.Position)/6,
+		Velocity: state.Velocity + h*(k1.Velocity+2*k2.Velocity+2*k3.Velocity+k4.Velocity)/6,
+	}
+}
+
+// newton_step is the explicit (forward) Euler method
+func newton_step(f AccelerationFunc, t float64, state PhysicsState, h float64) PhysicsState {
+	return state.add(derivative(f, t, state), h)
+}
+
+// semi_implicit_euler_step updates the velocity first and moves with the new velocity
+func semi_implicit_euler_step(f AccelerationFunc, t float64, state PhysicsState, h float64) PhysicsState {
+	velocity := state.Velocity + h*f(t, state)
+	return PhysicsState{Position: state.Position + h*velocity, Velocity: velocity}
+}
+
+// midpoint_step evaluates the derivative at the middle of the step
+func midpoint_step(f AccelerationFunc, t float64, state PhysicsState, h float64) PhysicsState {
+	middle := state.add(derivative(f, t, state), h/2)
+	return state.add(derivative(f, t+h/2, middle), h)
 }
 
-func verlet_step(f func(float64, float64) float64, t, y, h float64) float64 {
-	return y + h*f(t+h/2, y+h/2*f(t, y))
+// verlet_step is the velocity Verlet method. The velocity used for the
+// acceleration at the end of the step is predicted with Euler, which is exact
+// for forces that do not depend on velocity.
+func verlet_step(f AccelerationFunc, t float64, state PhysicsState, h float64) PhysicsState {
+	a0 := f(t, state)
+	position := state.Position + h*state.Velocity + 0.5*h*h*a0
+	a1 := f(t+h, PhysicsState{Position: position, Velocity: state.Velocity + h*a0})
+	return PhysicsState{Position: position, Velocity: state.Velocity + 0.5*h*(a0+a1)}
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// =====================================================
+// TRAJECTORY SERIALIZATION
+// =====================================================
+
+// Sample never returns more than maxTrajectorySamples states, it samples long
+// trajectories more coarsely than asked
+const maxTrajectorySamples = 10000
+
+// TrajectoryLimits are the planner limits a trajectory was planned with
+type TrajectoryLimits struct {
+	Jerk         float64     `json:"jerk"`
+	Acceleration float64     `json:"acceleration"`
+	Deceleration float64     `json:"deceleration"`
+	Velocity     float64     `json:"velocity"`
+	SpeedLimits  []SpeedZone `json:"speedLimits,omitempty"`
+}
+
+// TrajectoryState is the planned motion at one time along a trajectory
+type TrajectoryState struct {
+	Time         float64 `json:"time"` // Seconds since the trajectory's start
+	Position     float64 `json:"position"`
+	Velocity     float64 `json:"velocity"`
+	Acceleration float64 `json:"acceleration"`
+	Jerk         float64 `json:"jerk"`
+}
+
+// trajectoryTiming holds the phase durations the symmetric profiles are built from
+type trajectoryTiming struct {
+	Tj      float64 `json:"tj"`
+	Ta      float64 `json:"ta"`
+	Tv      float64 `json:"tv"`
+	TjStop1 float64 `json:"tjStop1"`
+	TaStop  float64 `json:"taStop"`
+	TjStop2 float64 `json:"tjStop2"`
+}
+
+// trajectoryJSON is the wire form of a Trajectory. States are the eight phase
+// boundaries, each with the jerk of the phase that starts there.
+type trajectoryJSON struct {
+	Type      string             `json:"type"`              // "stationary", "point_to_point", "stopping", "from_state" or "route"
+	Profile   string             `json:"profile,omitempty"` // Which symmetric point to point profile, see trajectoryTypeNames
+	Label     string             `json:"label,omitempty"`
+	StartTime time.Time          `json:"startTime"`
+	Duration  float64            `json:"duration"` // Seconds
+	Start     float64            `json:"start"`
+	End       float64            `json:"end"`
+	Limits    TrajectoryLimits   `json:"limits"`
+	States    [8]TrajectoryState `json:"states"`
+	Timing    trajectoryTiming   `json:"timing"`
+	Segments  []*Trajectory      `json:"segments,omitempty"` // Consecutive segments of a route, their times are from startTime
+}
+
+var trajectoryTypeNames = map[TrajectoryType]string{
+	VelocityLimited:                       "velocity limited",
+	JerkLimited:                           "jerk limited",
+	AccelerationLimitedWithMaxVelocity:    "acceleration limited with max velocity",
+	AccelerationLimitedWithoutMaxVelocity: "acceleration limited without max velocity",
+}
+
+// pointToPointType tells which profile a symmetric point to point trajectory has
+func pointToPointType(trajectory *Trajectory) TrajectoryType {
+	switch {
+	case trajectory.ta == 0 && trajectory.tv == 0:
+		return JerkLimited
+	case trajectory.ta == 0:
+		return VelocityLimited
+	case trajectory.tv == 0:
+		return AccelerationLimitedWithoutMaxVelocity
+	default:
+		return AccelerationLimitedWithMaxVelocity
+	}
+}
+
+// Type names how the trajectory was planned
+func (trajectory Trajectory) Type() string {
+	switch {
+	case len(trajectory.segments) > 0:
+		return "route"
+	case trajectory.isStopping:
+		return "stopping"
+	case trajectory.fromState:
+		return "from_state"
+	case trajectory.state[7].t == 0:
+		return "stationary"
+	default:
+		return "point_to_point"
+	}
+}
+
+func (trajectory Trajectory) MarshalJSON() ([]byte, error) {
+	data := trajectoryJSON{
+		Type:      trajectory.Type(),
+		Label:     trajectory.label,
+		StartTime: trajectory.t0.UTC(),
+		Duration:  trajectory.state[7].t,
+		Start:     trajectory.state[0].p,
+		End:       trajectory.end,
+		Limits:    trajectory.limits,
+		Timing: trajectoryTiming{
+			Tj: trajectory.tj, Ta: trajectory.ta, Tv: trajectory.tv,
+			TjStop1: trajectory.tjStop1, TaStop: trajectory.taStop, TjStop2: trajectory.tjStop2,
+		},
+		Segments: trajectory.segments,
+	}
+	if data.Type == "point_to_point" {
+		data.Profile = trajectoryTypeNames[pointToPointType(&trajectory)]
+	}
+	for i, state := range trajectory.state {
+		data.States[i] = state.export()
+	}
+	return json.Marshal(data)
+}
+
+// UnmarshalJSON restores a trajectory, e.g. one received from a neighbour. It
+// has no clock until UseClock is called, GetStateAt works without one.
+func (trajectory *Trajectory) UnmarshalJSON(b []byte) error {
+	var data trajectoryJSON
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	switch data.Type {
+	case "stationary", "point_to_point", "stopping", "from_state", "route":
+	default:
+		return fmt.Errorf("unknown trajectory type %q", data.Type)
+	}
+	if data.Type == "route" && len(data.Segments) == 0 {
+		return fmt.Errorf("route trajectory has no segments")
+	}
+
+	*trajectory = Trajectory{
+		end:        data.End,
+		t0:         data.StartTime,
+		tj:         data.Timing.Tj,
+		ta:         data.Timing.Ta,
+		tv:         data.Timing.Tv,
+		tjStop1:    data.Timing.TjStop1,
+		taStop:     data.Timing.TaStop,
+		tjStop2:    data.Timing.TjStop2,
+		isStopping: data.Type == "stopping",
+		fromState:  data.Type == "from_state" || data.Type == "route",
+		segments:   data.Segments,
+		label:      data.Label,
+		limits:     data.Limits,
+	}
+	for i, state := range data.States {
+		trajectory.state[i] = internalState{t: state.Time, p: state.Position, v: state.Velocity, a: state.Acceleration, j: state.Jerk}
+	}
+	for _, segment := range trajectory.segments {
+		segment.t0 = trajectory.t0
+	}
+	return nil
+}
+
+// UseClock sets the clock a decoded trajectory is evaluated against
+func (trajectory *Trajectory) UseClock(clock Clock) {
+	trajectory.clock = clock
+	for _, segment := range trajectory.segments {
+		segment.UseClock(clock)
+	}
+}
+
+// Sample returns the planned state every resolution from the trajectory's start,
+// and its final state
+func (trajectory Trajectory) Sample(resolution time.Duration) []TrajectoryState {
+	duration := trajectory.state[7].t
+	step := max(resolution.Seconds(), duration/maxTrajectorySamples)
+	if step <= 0 {
+		return []TrajectoryState{trajectory.calculateStateAtTime(0).export()}
+	}
+
+	count := int(math.Ceil(duration/step-1e-9)) + 1
+	samples := make([]TrajectoryState, 0, count)
+	for i := 0; i < count-1; i++ {
+		samples = append(samples, trajectory.calculateStateAtTime(float64(i)*step).export())
+	}
+	return append(samples, trajectory.calculateStateAtTime(duration).export())
+}
+
+// export converts a state for serialization
+func (s internalState) export() TrajectoryState {
+	return TrajectoryState{Time: s.t, Position: s.p, Velocity: s.v, Acceleration: s.a, Jerk: s.j}
+}
+
+// =====================================================
+// TRAJECTORY SNAPSHOT
+// =====================================================
+
+// PlannedTrajectory is a trajectory with its profile sampled ahead of time
+type PlannedTrajectory struct {
+	Trajectory *Trajectory       `json:"trajectory"`
+	Samples    []TrajectoryState `json:"samples,omitempty"`
+}
+
+// CartTrajectories are a cart's current trajectory and the trajectories of the borders it keeps to
+type CartTrajectories struct {
+	CartId      int                `json:"cartId"`
+	Current     *PlannedTrajectory `json:"current"`
+	LeftBorder  *PlannedTrajectory `json:"leftBorder"`
+	RightBorder *PlannedTrajectory `json:"rightBorder"`
+}
+
+// TrajectorySnapshot is every cart's trajectories at one time
+type TrajectorySnapshot struct {
+	Time  string             `json:"time"`
+	Carts []CartTrajectories `json:"carts"`
+}
+
+// TrajectorySnapshot returns every cart's trajectories, sampled every resolution
+// when it is positive
+func (sm *ScenarioManager) TrajectorySnapshot(resolution time.Duration) TrajectorySnapshot {
+	sm.mu.RLock()
+	controllers := sm.controllers
+	sm.mu.RUnlock()
+
+	plan := func(trajectory *Trajectory) *PlannedTrajectory {
+		if trajectory == nil {
+			return nil
+		}
+		planned := &PlannedTrajectory{Trajectory: trajectory}
+		if resolution > 0 {
+			planned.Samples = trajectory.Sample(resolution)
+		}
+		return planned
+	}
+
+	snapshot := TrajectorySnapshot{Time: sm.clock.Now().UTC().Format(time.RFC3339Nano), Carts: []CartTrajectories{}}
+	for _, controller := range controllers {
+		// The controllers replace their trajectories as they run, so read what they published
+		state := controller.publishedState()
+		snapshot.Carts = append(snapshot.Carts, CartTrajectories{
+			CartId:      controller.Cart.Id,
+			Current:     plan(state.current),
+			LeftBorder:  plan(state.left),
+			RightBorder: plan(state.right),
+		})
+	}
+	return snapshot
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// =====================================================
+// TRAJECTORY VALIDATION
+// =====================================================
+
+// Properties that are not checked at phase boundaries are sampled every
+// validationStep, or more sparsely on long trajectories
+const (
+	validationStep       = 0.005
+	maxValidationSamples = 2000
+)
+
+// TrajectoryViolation is a property a planned trajectory breaks
+type TrajectoryViolation struct {
+	Property string  `json:"property"` // "planning", "phase_duration", "continuity", "jerk_limit", "acceleration_limit", "velocity_limit", "speed_limit", "end_state" or "monotonicity"
+	Time     float64 `json:"time"`     // Seconds since the trajectory's start
+	Detail   string  `json:"detail"`
+}
+
+func (v TrajectoryViolation) String() string {
+	return fmt.Sprintf("%s at %.3fs: %s", v.Property, v.Time, v.Detail)
+}
+
+// ValidateTrajectory checks a trajectory against the planner's limits: phases
+// join up in position, velocity and acceleration, jerk, acceleration, velocity
+// and speed zone limits hold, it ends at rest at its end position, and point
+// to point and stopping trajectories never reverse. A trajectory that starts
+// outside the limits, e.g. after they were lowered, may exceed them until it is
+// back within.
+func (mpc *MovementPlanner) ValidateTrajectory(trajectory *Trajectory) []TrajectoryViolation {
+	var violations []TrajectoryViolation
+	report := func(property string, t float64, format string, args ...interface{}) {
+		violations = append(violations, TrajectoryViolation{Property: property, Time: t, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	// Phase boundaries, checked exactly
+	segments := trajectory.segments
+	if len(segments) == 0 {
+		segments = []*Trajectory{trajectory}
+	}
+	times := []float64{0}
+	for k, segment := range segments {
+		if k > 0 {
+			previous, next := segments[k-1].state[7], segment.state[0]
+			if !statesJoin(previous, next) {
+				report("continuity", next.t, "segment %d starts at %s, the previous one ends at %s", k+1, describeState(next), describeState(previous))
+			}
+		}
+		for phase := 1; phase <= 7; phase++ {
+			from, to := segment.state[phase-1], segment.state[phase]
+			dt := to.t - from.t
+			if dt < -tolerance(to.t) || math.IsNaN(dt) {
+				report("phase_duration", from.t, "phase %d lasts %gs", phase, dt)
+				continue
+			}
+			if math.Abs(from.j) > mpc.max_jerk+tolerance(mpc.max_jerk) {
+				report("jerk_limit", from.t, "jerk %.3f exceeds %.3f in phase %d", from.j, mpc.max_jerk, phase)
+			}
+			if reached := from.moveStateForward(dt, from.j); !statesJoin(reached, to) {
+				report("continuity", to.t, "phase %d ends at %s, not %s", phase, describeState(reached), describeState(to))
+			}
+			times = append(times, to.t)
+			// Velocity peaks where the acceleration crosses zero
+			if from.j != 0 {
+				if peak := -from.a / from.j; peak > 0 && peak < dt {
+					times = append(times, from.t+peak)
+				}
+			}
+		}
+	}
+
+	final := trajectory.state[7]
+	if math.Abs(final.p-trajectory.end) > tolerance(trajectory.end) || math.Abs(final.v) > tolerance(mpc.max_velocity) || math.Abs(final.a) > tolerance(mpc.max_acceleration) {
+		report("end_state", final.t, "ends at %s instead of resting at %.3f", describeState(final), trajectory.end)
+	}
+
+	// Limits and direction, between the boundaries
+	step := max(validationStep, final.t/maxValidationSamples)
+	for t := step; t < final.t; t += step {
+		times = append(times, t)
+	}
+	slices.Sort(times)
+
+	initial := trajectory.state[0]
+	direction := math.Copysign(1, trajectory.end-initial.p)
+	if trajectory.isStopping {
+		direction = math.Copysign(1, initial.v)
+	}
+	monotonic := trajectory.isStopping || !trajectory.fromState && len(trajectory.segments) == 0
+
+	// A trajectory may start outside the limits, and an initial acceleration carries
+	// the velocity on until the jerk limit takes it away. Until the trajectory is
+	// back within a limit, it may only exceed it by as much as it started with.
+	inevitable := math.Abs(initial.v + initial.a*math.Abs(initial.a)/(2*mpc.max_jerk))
+	inevitableUntil := initial.t + math.Abs(initial.a)/mpc.max_jerk
+	initialSpeed := max(math.Abs(initial.v), inevitable)
+	if trajectory.isStopping && (initial.v+initial.a*math.Abs(initial.a)/(2*mpc.max_jerk))*direction < 0 {
+		monotonic = false // Braking too hard to ease off before the velocity crosses zero
+	}
+	settled := map[string]bool{}
+	reported := map[string]bool{}
+	check := func(property string, t, value, limit, allowance float64, format string, args ...interface{}) {
+		settled[property] = settled[property] || t > inevitableUntil && value <= limit+tolerance(limit)
+		if !settled[property] {
+			limit = max(limit, allowance)
+		}
+		if value > limit+tolerance(limit) && !reported[property] {
+			reported[property] = true
+			report(property, t, format, args...)
+		}
+	}
+
+	for _, t := range times {
+		state := trajectory.calculateStateAtTime(t)
+
+		limit := mpc.max_acceleration
+		if state.a*state.v < 0 {
+			limit = mpc.max_deceleration
+		}
+		check("acceleration_limit", t, math.Abs(state.a), limit, math.Abs(initial.a),
+			"acceleration %.3f exceeds %.3f at velocity %.3f", state.a, limit, state.v)
+		check("velocity_limit", t, math.Abs(state.v), mpc.max_velocity, initialSpeed,
+			"velocity %.3f exceeds %.3f", state.v, mpc.max_velocity)
+		zoneLimit := mpc.speedLimitBetween(state.p, state.p)
+		check("speed_limit", t, math.Abs(state.v), zoneLimit, initialSpeed,
+			"velocity %.3f exceeds the speed limit %.3f at %.3f", state.v, zoneLimit, state.p)
+
+		if monotonic && state.v*direction < -tolerance(mpc.max_velocity) && !reported["monotonicity"] {
+			reported["monotonicity"] = true
+			report("monotonicity", t, "velocity %.3f reverses the direction of travel", state.v)
+		}
+	}
+	return violations
+}
+
+// tolerance is the numerical slack allowed when comparing a quantity of the given magnitude
+func tolerance(magnitude float64) float64 {
+	return 1e-6 * max(1, math.Abs(magnitude))
+}
+
+// statesJoin reports whether two states agree in position, velocity and acceleration
+func statesJoin(a, b internalState) bool {
+	return math.Abs(a.p-b.p) <= tolerance(a.p) && math.Abs(a.v-b.v) <= tolerance(a.v) && math.Abs(a.a-b.a) <= tolerance(a.a) && math.Abs(a.t-b.t) <= tolerance(a.t)
+}
+
+// describeState formats a state for a violation
+func describeState(s internalState) string {
+	return fmt.Sprintf("(p %.4f, v %.4f, a %.4f)", s.p, s.v, s.a)
+}
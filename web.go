@@ -3,17 +3,20 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 type ControlMessage struct {
-	Command    string  `json:"command"`
-	Controller int     `json:"controller,omitempty"`
-	Position   float64 `json:"position,omitempty"`
-	Enabled    bool    `json:"enabled,omitempty"`
+	Command    string     `json:"command"`
+	Controller int        `json:"controller,omitempty"`
+	Position   float64    `json:"position,omitempty"`
+	Waypoints  []Waypoint `json:"waypoints,omitempty"` // Path for "setPath"
+	Enabled    bool       `json:"enabled,omitempty"`
 }
 
 type TestMessage struct {
@@ -38,6 +41,13 @@ type SocketData struct {
 	// Real-time data (actual cart physics values)
 	Position float64 `json:"position"`
 
+	// What the controller measures through the cart's sensor
+	MeasuredPosition float64 `json:"measuredPosition"`
+	MeasuredVelocity float64 `json:"measuredVelocity"`
+
+	// State estimator output, when the controller has one
+	Estimator *EstimatorReport `json:"estimator,omitempty"`
+
 	LeftBorder  float64 `json:"leftBorder"`
 	RightBorder float64 `json:"rightBorder"`
 	Goal        float64 `json:"goal"`
@@ -54,9 +64,58 @@ type SocketData struct {
 	Metrics MessageMetricsReport `json:"metrics"`
 }
 
+// EstimatorReport is a controller's state estimate with the values needed to tune the filter
+type EstimatorReport struct {
+	Position     float64       `json:"position"`
+	Velocity     float64       `json:"velocity"`
+	Acceleration float64       `json:"acceleration"`
+	Residual     float64       `json:"residual"`   // Last measurement minus the predicted position
+	Covariance   [3][3]float64 `json:"covariance"` // Of position, velocity and acceleration
+}
+
 type AllCartsData struct {
 	Carts     []SocketData `json:"carts"`
 	Timestamp string       `json:"timestamp"`
+
+	// Collisions since the carts were last reset, and whether one halted the simulation
+	Collisions []CollisionEvent `json:"collisions"`
+	Halted     bool             `json:"halted"`
+
+	// Safety alarms since the carts were last reset
+	SafetyAlarms []SafetyAlarm `json:"safetyAlarms"`
+}
+
+// clientRegistry tracks the response channels of connected WebSocket clients, for broadcasts
+type clientRegistry struct {
+	mu      sync.Mutex
+	clients map[chan ScenarioMessage]bool
+}
+
+var wsClients = &clientRegistry{clients: make(map[chan ScenarioMessage]bool)}
+
+func (r *clientRegistry) add(client chan ScenarioMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clients[client] = true
+}
+
+func (r *clientRegistry) remove(client chan ScenarioMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, client)
+}
+
+// broadcast sends a message to every connected client, skipping clients that are not keeping up
+func (r *clientRegistry) broadcast(message ScenarioMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for client := range r.clients {
+		select {
+		case client <- message:
+		default:
+			log.Printf("Dropping %s message for a slow WebSocket client", message.Type)
+		}
+	}
 }
 
 // Upgrader is used to upgrade HTTP connections to WebSocket connections.
@@ -83,22 +142,140 @@ func handleScenarioMessage(msgType string, rawMsg map[string]interface{}, scenar
 			go func() {
 				err := scenarioManager.RunScenario(scenarioName)
 				status := "completed"
+				reason := ""
 				if err != nil {
 					status = "failed"
+					reason = err.Error() // Readable reason, e.g. which expectation was violated
 				}
 
 				response := ScenarioMessage{
 					Type: "scenario_result",
 					Data: map[string]interface{}{
-						"scenario": scenarioName,
-						"status":   status,
-						"error":    err,
+						"scenario":           scenarioName,
+						"status":             status,
+						"error":              reason,
+						"collisions":         scenarioManager.GetCollisions(),
+						"safetyAlarms":       scenarioManager.GetSafetyAlarms(),
+						"skippedSafetyTicks": scenarioManager.SkippedSafetyTicks(),
 					},
 				}
 				responseChannel <- response
 			}()
 		}
 
+	case "set_collision_policy":
+		// Change how the physics loop handles collisions
+		policyName, _ := rawMsg["policy"].(string)
+		_, restitution := scenarioManager.GetCollisionPolicy()
+		if value, ok := rawMsg["restitution"].(float64); ok {
+			restitution = value
+		}
+		policy, err := ParseCollisionPolicy(policyName)
+		if err == nil {
+			err = scenarioManager.SetCollisionPolicy(policy, restitution)
+		}
+		data := map[string]interface{}{}
+		if err != nil {
+			data["error"] = err.Error()
+		}
+		data["policy"], data["restitution"] = scenarioManager.GetCollisionPolicy()
+		responseChannel <- ScenarioMessage{
+			Type: "collision_policy",
+			Data: data,
+		}
+
+	case "autotune":
+		// Tune one cart's PID gains on a simulated copy of its plant, optionally applying them
+		cart, _ := rawMsg["cart"].(float64)
+		apply, _ := rawMsg["apply"].(bool)
+		go func() {
+			data := map[string]interface{}{"cart": int(cart)}
+			result, err := scenarioManager.AutotuneCart(int(cart), apply)
+			if err != nil {
+				data["error"] = err.Error()
+			} else {
+				data["result"] = result
+			}
+			responseChannel <- ScenarioMessage{
+				Type: "autotune_result",
+				Data: data,
+			}
+		}()
+
+	case "get_parameters":
+		// Send every controller's tunable parameters, also usable as a config snapshot
+		responseChannel <- ScenarioMessage{
+			Type: "parameters",
+			Data: scenarioManager.ParameterSnapshot(),
+		}
+
+	case "set_parameters":
+		// Change some of one controller's parameters, every client is told about the result
+		cart, _ := rawMsg["cart"].(float64)
+		patch, err := json.Marshal(rawMsg["parameters"])
+		if err == nil {
+			_, err = scenarioManager.PatchParameters(int(cart), patch)
+		}
+		if err != nil {
+			responseChannel <- ScenarioMessage{
+				Type: "parameters_error",
+				Data: map[string]interface{}{"cart": int(cart), "error": err.Error()},
+			}
+		}
+
+	case "get_network":
+		// Send the network of every link between neighbouring carts
+		responseChannel <- ScenarioMessage{
+			Type: "network",
+			Data: scenarioManager.LinkNetworks(),
+		}
+
+	case "set_network":
+		// Change some of a link's network settings, or every link's for link 0; every client is told about the result
+		link, _ := rawMsg["link"].(float64)
+		var err error
+		if reset, _ := rawMsg["reset"].(bool); reset {
+			err = scenarioManager.ResetLinkNetwork(int(link))
+		} else {
+			var patch []byte
+			patch, err = json.Marshal(rawMsg["network"])
+			if err == nil {
+				_, err = scenarioManager.PatchLinkNetwork(int(link), patch)
+			}
+		}
+		if err != nil {
+			responseChannel <- ScenarioMessage{
+				Type: "network_error",
+				Data: map[string]interface{}{"link": int(link), "error": err.Error()},
+			}
+		}
+
+	case "get_messages":
+		// Send the messages held by manual links
+		responseChannel <- ScenarioMessage{
+			Type: "messages",
+			Data: scenarioManager.Messages().Messages(),
+		}
+
+	case "message_action":
+		// Deliver, drop, duplicate or delay a held message, the oldest one without an id; every client is told about the result
+		operation, _ := rawMsg["operation"].(string)
+		id, _ := rawMsg["id"].(float64)
+		var delay time.Duration
+		var err error
+		if text, ok := rawMsg["delay"].(string); ok {
+			delay, err = time.ParseDuration(text)
+		}
+		if err == nil {
+			err = scenarioManager.Messages().apply(operation, int(id), delay)
+		}
+		if err != nil {
+			responseChannel <- ScenarioMessage{
+				Type: "message_error",
+				Data: map[string]interface{}{"id": int(id), "operation": operation, "error": err.Error()},
+			}
+		}
+
 	case "scenario_status":
 		// Send current scenario statuses
 		scenarios := scenarioManager.GetScenarios()
@@ -120,8 +297,10 @@ func wsHandler(w http.ResponseWriter, r *http.Request, c <-chan AllCartsData, sc
 	}
 	defer conn.Close()
 
-	// Create a channel for scenario responses
+	// Create a channel for scenario responses, broadcasts arrive on it too
 	scenarioResponseChannel := make(chan ScenarioMessage, 10)
+	wsClients.add(scenarioResponseChannel)
+	defer wsClients.remove(scenarioResponseChannel)
 
 	// Start a goroutine to handle incoming messages from the client
 	go func() {
@@ -162,6 +341,11 @@ func wsHandler(w http.ResponseWriter, r *http.Request, c <-chan AllCartsData, sc
 					fmt.Printf("Frontend: Setting goal for cart %d to %f\n", msg.Controller+1, msg.Position)
 					scenarioManager.goalChannels[msg.Controller] <- msg.Position
 				}
+			case "setPath":
+				fmt.Printf("Frontend: Setting path for cart %d\n", msg.Controller+1)
+				if err := scenarioManager.SendPath(msg.Controller+1, msg.Waypoints); err != nil {
+					fmt.Println("Error sending path:", err)
+				}
 			case "emergencyStop":
 				if msg.Controller >= 0 && msg.Controller < len(scenarioManager.emergencyStops) {
 					fmt.Printf("Frontend: Emergency stop for cart %d\n", msg.Controller+1)
@@ -225,27 +409,42 @@ func collectCartData(controller *Controller) SocketData {
 		trajectoryTransitions = append(trajectoryTransitions, controller.CurrentTrajectory.t0.UTC().Format(time.RFC3339Nano))
 		trajectoryPhases = append(trajectoryPhases, "Start")
 
-		// Add phase transition times and corresponding phase names
-		for i, state := range controller.CurrentTrajectory.state {
-			if state.t > 0 { // Only include actual phase transitions
-				transitionTime := controller.CurrentTrajectory.t0.Add(time.Duration(state.t * float64(time.Second)))
-				trajectoryTransitions = append(trajectoryTransitions, transitionTime.UTC().Format(time.RFC3339Nano))
-
-				// Determine phase name based on trajectory type and index
-				if controller.CurrentTrajectory.isStopping {
-					// For stopping trajectories, phases start from index 0
-					if i < len(phaseNames) {
-						trajectoryPhases = append(trajectoryPhases, phaseNames[i])
-					} else {
-						trajectoryPhases = append(trajectoryPhases, "Unknown")
-					}
-				} else {
-					// For point-to-point trajectories, phases start from index 3
-					phaseIndex := i + 3
-					if phaseIndex < len(phaseNames) {
-						trajectoryPhases = append(trajectoryPhases, phaseNames[phaseIndex])
+		trajectory := controller.CurrentTrajectory
+		if trajectory.fromState {
+			// Replanned and multi-waypoint trajectories name their own phases
+			for _, phase := range trajectory.Phases() {
+				if phase.Start > 0 {
+					transitionTime := trajectory.t0.Add(time.Duration(phase.Start * float64(time.Second)))
+					trajectoryTransitions = append(trajectoryTransitions, transitionTime.UTC().Format(time.RFC3339Nano))
+					trajectoryPhases = append(trajectoryPhases, phase.Name)
+				}
+			}
+			endTime := trajectory.t0.Add(time.Duration(trajectory.state[7].t * float64(time.Second)))
+			trajectoryTransitions = append(trajectoryTransitions, endTime.UTC().Format(time.RFC3339Nano))
+			trajectoryPhases = append(trajectoryPhases, "Final state")
+		} else {
+			// Add phase transition times and corresponding phase names
+			for i, state := range controller.CurrentTrajectory.state {
+				if state.t > 0 { // Only include actual phase transitions
+					transitionTime := controller.CurrentTrajectory.t0.Add(time.Duration(state.t * float64(time.Second)))
+					trajectoryTransitions = append(trajectoryTransitions, transitionTime.UTC().Format(time.RFC3339Nano))
+
+					// Determine phase name based on trajectory type and index
+					if controller.CurrentTrajectory.isStopping {
+						// For stopping trajectories, phases start from index 0
+						if i < len(phaseNames) {
+							trajectoryPhases = append(trajectoryPhases, phaseNames[i])
+						} else {
+							trajectoryPhases = append(trajectoryPhases, "Unknown")
+						}
 					} else {
-						trajectoryPhases = append(trajectoryPhases, "Unknown")
+						// For point-to-point trajectories, phases start from index 3
+						phaseIndex := i + 3
+						if phaseIndex < len(phaseNames) {
+							trajectoryPhases = append(trajectoryPhases, phaseNames[phaseIndex])
+						} else {
+							trajectoryPhases = append(trajectoryPhases, "Unknown")
+						}
 					}
 				}
 			}
@@ -262,6 +461,20 @@ func collectCartData(controller *Controller) SocketData {
 		goal = controller.CurrentTrajectory.end
 	}
 
+	measurement := controller.measure()
+
+	var estimator *EstimatorReport
+	if controller.Estimator != nil {
+		estimate := controller.Estimator.Current()
+		estimator = &EstimatorReport{
+			Position:     estimate.Position,
+			Velocity:     estimate.Velocity,
+			Acceleration: estimate.Acceleration,
+			Residual:     estimate.Residual,
+			Covariance:   estimate.Covariance,
+		}
+	}
+
 	return SocketData{
 		Id: controller.Cart.Id,
 
@@ -274,10 +487,14 @@ func collectCartData(controller *Controller) SocketData {
 		// Real-time data (actual cart physics values)
 		Position: controller.Cart.Position,
 
+		MeasuredPosition: measurement.Position,
+		MeasuredVelocity: measurement.Velocity,
+		Estimator:        estimator,
+
 		LeftBorder:  controller.LeftBorderTrajectory.GetCurrentPosition(),
 		RightBorder: controller.RightBorderTrajectory.GetCurrentPosition(),
 		Goal:        goal,
-		Setpoint:    controller.PositionPID.Setpoint,
+		Setpoint:    controller.ControlLaw.Setpoint(),
 		State:       controller.State.String(),
 
 		// Trajectory phase transitions (timestamps when trajectory phases change)
@@ -306,7 +523,7 @@ func startWebsocketServer(scenarioManager *ScenarioManager) {
 		for range ticker.C {
 			// Collect data for all controllers in a single message
 			var cartsData []SocketData
-			timestamp := time.Now().UTC().Format(time.RFC3339Nano)
+			timestamp := scenarioManager.clock.Now().UTC().Format(time.RFC3339Nano)
 
 			// Use scenario manager's current controllers (which may be fewer than the original)
 			if scenarioManager.controllers != nil {
@@ -319,8 +536,11 @@ func startWebsocketServer(scenarioManager *ScenarioManager) {
 			}
 
 			allCartsData := AllCartsData{
-				Carts:     cartsData,
-				Timestamp: timestamp,
+				Carts:        cartsData,
+				Timestamp:    timestamp,
+				Collisions:   scenarioManager.GetCollisions(),
+				Halted:       scenarioManager.IsHalted(),
+				SafetyAlarms: scenarioManager.GetSafetyAlarms(),
 			}
 
 			select {
@@ -332,10 +552,65 @@ func startWebsocketServer(scenarioManager *ScenarioManager) {
 		}
 	}()
 
+	// Tell every client about parameter changes, whoever made them
+	scenarioManager.OnParameterChange(func(change CartParameters) {
+		wsClients.broadcast(ScenarioMessage{Type: "parameters_changed", Data: change})
+	})
+
+	// Tell every client about network changes, whether scheduled or made by hand
+	scenarioManager.OnNetworkChange(func(links []LinkNetwork) {
+		wsClients.broadcast(ScenarioMessage{Type: "network_changed", Data: links})
+	})
+
+	// Tell every client which messages the manual links hold
+	scenarioManager.Messages().OnChange(func(messages []HeldMessage) {
+		wsClients.broadcast(ScenarioMessage{Type: "messages_changed", Data: messages})
+	})
+
+	// Tell every client about safety alarms as soon as they are raised
+	scenarioManager.OnSafetyAlarm(func(alarm SafetyAlarm) {
+		wsClients.broadcast(ScenarioMessage{Type: "safety_alarm", Data: alarm})
+	})
+
 	// Register HTTP handlers
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		wsHandler(w, r, dataChannel, scenarioManager)
 	})
+	http.HandleFunc("/parameters", func(w http.ResponseWriter, r *http.Request) {
+		// Parameter snapshot as a downloadable file, encoded first so that a failure can still be reported
+		data, err := json.MarshalIndent(scenarioManager.ParameterSnapshot(), "", "  ")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("encoding parameters: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="parameters.json"`)
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			log.Printf("Error sending parameters: %v", err)
+		}
+	})
+	http.HandleFunc("/trajectories", func(w http.ResponseWriter, r *http.Request) {
+		// Every cart's planned trajectories, sampled with ?resolution=50ms
+		var resolution time.Duration
+		if value := r.URL.Query().Get("resolution"); value != "" {
+			var err error
+			resolution, err = time.ParseDuration(value)
+			if err != nil || resolution <= 0 {
+				http.Error(w, fmt.Sprintf("invalid resolution %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		data, err := json.Marshal(scenarioManager.TrajectorySnapshot(resolution))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("encoding trajectories: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			log.Printf("Error sending trajectories: %v", err)
+		}
+	})
 	// http.HandleFunc("/api/historical-data", historicalDataHandler)
 
 	fmt.Println("WebSocket server started on :8080")